@@ -1,12 +1,11 @@
 package circuit
 
 import (
-	"fmt"
 	"github.com/xiaoyisha/Perseus/config"
 	"github.com/xiaoyisha/Perseus/metrics"
-	"log"
+	"github.com/xiaoyisha/Perseus/rolling"
+	"slices"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -14,22 +13,38 @@ import (
 // for each ExecutorPool according to the Health of the circuit
 type CircuitBreaker struct {
 	Name                   string
-	open                   bool
+	state                  State
 	forceOpen              bool
 	mutex                  *sync.RWMutex
 	openedOrLastTestedTime int64
-	ExecutorPool           *ExecutorPool
-	Metrics                *metrics.MetricExchange
+	halfOpenTrials         []trialSlot
+	halfOpenSuccesses      int
+	// ExecutorPool is the pool of the circuit when it was created.
+	//
+	// Deprecated: use Pool, which follows changes of PoolKey.
+	ExecutorPool *ExecutorPool
+	Metrics      *metrics.MetricExchange
+
+	// pool is the executor pool of the circuit, as configured by poolConfig
+	pool       *ExecutorPool
+	poolConfig *config.Config
+	// tripStrategy decides when the circuit opens, as configured by tripConfig
+	tripStrategy TripStrategy
+	tripConfig   *config.Config
+
+	// rateLimiter caps how many commands start, as configured by rateConfig, or is nil
+	rateLimiter RateLimiter
+	rateConfig  *config.Config
+	// hedges counts the hedged attempts allowed within the rolling window
+	hedges *rolling.Number
 }
 
-// A CircuitError is an error which models various failure states of execution,
-// such as the circuit being open or a timeout.
-type CircuitError struct {
-	Message string
-}
-
-func (e CircuitError) Error() string {
-	return e.Message
+// trialSlot is a trial request in flight in a half-open circuit.
+type trialSlot struct {
+	// flagged is set for requests admitted by AllowTrialRequest, whose outcome is reported with Outcome.Trial set
+	flagged bool
+	// deadline is when the slot is given back if the outcome of the request was never reported, in nanoseconds
+	deadline int64
 }
 
 var (
@@ -44,11 +59,15 @@ func init() {
 
 // NewCircuitBreaker creates a CircuitBreaker with associated Health
 func NewCircuitBreaker(name string) *CircuitBreaker {
+	cfg := config.GetCircuitConfig(name)
+
 	c := &CircuitBreaker{}
 	c.Name = name
 	c.Metrics = metrics.NewMetricExchange(name)
-	c.ExecutorPool = NewExecutorPool(name)
 	c.mutex = &sync.RWMutex{}
+	c.ExecutorPool = c.Pool()
+	c.hedges = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	c.currentTripStrategy()
 
 	return c
 }
@@ -74,15 +93,48 @@ func GetCircuitBreaker(name string) (*CircuitBreaker, bool, error) {
 	return circuitBreakers[name], !ok, nil
 }
 
+// GetCircuitBreakerMap returns a snapshot of all circuits created so far, keyed by name.
+func GetCircuitBreakerMap() map[string]*CircuitBreaker {
+	copy := make(map[string]*CircuitBreaker)
+
+	circuitBreakersMutex.RLock()
+	for name, cb := range circuitBreakers {
+		copy[name] = cb
+	}
+	circuitBreakersMutex.RUnlock()
+
+	return copy
+}
+
 func (circuitBreaker *CircuitBreaker) SwitchForceOpen(forceOpen bool) error {
 	circuitBreaker, _, err := GetCircuitBreaker(circuitBreaker.Name)
 	if err != nil {
 		return err
 	}
+	circuitBreaker.mutex.Lock()
+	var change *StateChange
+	if circuitBreaker.forceOpen != forceOpen && circuitBreaker.state != StateOpen {
+		if forceOpen {
+			change = circuitBreaker.newStateChange(circuitBreaker.state, StateOpen)
+		} else {
+			change = circuitBreaker.newStateChange(StateOpen, circuitBreaker.state)
+		}
+		change.Forced = true
+	}
 	circuitBreaker.forceOpen = forceOpen
+	circuitBreaker.mutex.Unlock()
+
+	notifyStateChange(change)
 	return nil
 }
 
+// IsForceOpen reports whether the circuit was forced open with SwitchForceOpen.
+func (circuitBreaker *CircuitBreaker) IsForceOpen() bool {
+	circuitBreaker.mutex.RLock()
+	defer circuitBreaker.mutex.RUnlock()
+	return circuitBreaker.forceOpen
+}
+
 // Flush purges all circuit and metric information from memory.
 func Flush() {
 	circuitBreakersMutex.Lock()
@@ -90,27 +142,24 @@ func Flush() {
 
 	for name, cb := range circuitBreakers {
 		cb.Metrics.Reset()
-		cb.ExecutorPool.Metrics.Reset()
 		delete(circuitBreakers, name)
 	}
+	flushExecutorPools()
 }
 
 // IsOpen returns true if circuit is ‘open’, false otherwise
-// An "open" circuit means the command should be rejected
+// An "open" circuit means the command should be rejected. A half-open circuit
+// is also reported as open, since only trial requests may pass through it.
 func (circuitBreaker *CircuitBreaker) IsOpen() bool {
 	circuitBreaker.mutex.RLock()
-	o := circuitBreaker.forceOpen || circuitBreaker.open
+	o := circuitBreaker.forceOpen || circuitBreaker.state != StateClosed
 	circuitBreaker.mutex.RUnlock()
 	if o {
 		return true
 	}
 
-	if uint64(circuitBreaker.Metrics.Requests().Sum(time.Now())) < config.GetCircuitConfig(circuitBreaker.Name).RequestVolumeThreshold {
-		return false
-	}
-
-	if !circuitBreaker.Metrics.IsHealthy(time.Now()) {
-		// too many failures, open the circuit
+	if circuitBreaker.currentTripStrategy().ShouldTrip(circuitBreaker, time.Now()) {
+		// the trip strategy considers the circuit unhealthy, open the circuit
 		circuitBreaker.SetOpen()
 		return true
 	}
@@ -118,86 +167,341 @@ func (circuitBreaker *CircuitBreaker) IsOpen() bool {
 	return false
 }
 
+// State returns the current state of the circuit. A forced open circuit is always StateOpen.
+func (circuitBreaker *CircuitBreaker) State() State {
+	circuitBreaker.mutex.RLock()
+	defer circuitBreaker.mutex.RUnlock()
+
+	if circuitBreaker.forceOpen {
+		return StateOpen
+	}
+	return circuitBreaker.state
+}
+
 // AllowRequest is called before any Command execution.
-// When the circuit is open, this call will occasionally return true to measure whether the external service
-// has recovered.
+// When the circuit is open, this call will return true for a limited number of trial requests
+// once the sleep window has passed, to measure whether the external service has recovered.
+// The next success or failure reported while the circuit is half-open counts as the result
+// of such a trial request.
 func (circuitBreaker *CircuitBreaker) AllowRequest() bool {
-	return !circuitBreaker.IsOpen() || circuitBreaker.allowSingleTest()
+	if !circuitBreaker.IsOpen() {
+		return true
+	}
+	allowed, _ := circuitBreaker.admitTrialRequest(false)
+	return allowed
+}
 
+// AllowTrialRequest is AllowRequest, also telling whether the request is a trial request of
+// a half-open circuit: its outcome must then be reported with Outcome.Trial set, to free its slot
+// and count towards closing the circuit. Outcomes reported without Outcome.Trial, such as those of
+// requests admitted while the circuit was closed, then leave the half-open circuit as is.
+func (circuitBreaker *CircuitBreaker) AllowTrialRequest() (allowed, trial bool) {
+	if !circuitBreaker.IsOpen() {
+		return true, false
+	}
+	return circuitBreaker.admitTrialRequest(true)
 }
 
-func (circuitBreaker *CircuitBreaker) allowSingleTest() bool {
-	circuitBreaker.mutex.RLock()
-	defer circuitBreaker.mutex.RUnlock()
+// admitTrialRequest moves an open circuit to half-open once its sleep window has elapsed
+// and admits trial requests while fewer than HalfOpenMaxRequests are in flight. A trial request
+// whose outcome is not reported within the Timeout of the circuit gives its slot back.
+// It reports whether the request is allowed, and whether it is a trial request.
+func (circuitBreaker *CircuitBreaker) admitTrialRequest(flagged bool) (bool, bool) {
+	var change *StateChange
+	defer func() { notifyStateChange(change) }()
+
+	circuitBreaker.mutex.Lock()
+	defer circuitBreaker.mutex.Unlock()
+
+	if circuitBreaker.forceOpen {
+		return false, false
+	}
+
+	cfg := config.GetCircuitConfig(circuitBreaker.Name)
+	switch circuitBreaker.state {
+	case StateClosed:
+		// the circuit closed since IsOpen was checked
+		return true, false
+	case StateOpen:
+		now := time.Now().UnixNano()
+		if now <= circuitBreaker.openedOrLastTestedTime+cfg.SleepWindow.Nanoseconds() {
+			return false, false
+		}
+		config.GetLogger(circuitBreaker.Name).Info("half-opening circuit", "circuit", circuitBreaker.Name)
+		change = circuitBreaker.newStateChange(StateOpen, StateHalfOpen)
+		circuitBreaker.state = StateHalfOpen
+		circuitBreaker.openedOrLastTestedTime = now
+		circuitBreaker.halfOpenTrials = nil
+		circuitBreaker.halfOpenSuccesses = 0
+	}
 
 	now := time.Now().UnixNano()
-	openedOrLastTestedTime := circuitBreaker.openedOrLastTestedTime
-	if circuitBreaker.open && now > openedOrLastTestedTime+config.GetCircuitConfig(circuitBreaker.Name).SleepWindow.Nanoseconds() {
-		swapped := atomic.CompareAndSwapInt64(&circuitBreaker.openedOrLastTestedTime, openedOrLastTestedTime, now)
-		if swapped {
-			log.Printf("allowing single test to possibly close circuit %v", circuitBreaker.Name)
+	trials := circuitBreaker.halfOpenTrials[:0]
+	for _, slot := range circuitBreaker.halfOpenTrials {
+		if slot.deadline > now {
+			trials = append(trials, slot)
 		}
-		return swapped
 	}
+	circuitBreaker.halfOpenTrials = trials
 
-	return false
+	if len(trials) >= cfg.HalfOpenMaxRequests {
+		return false, false
+	}
+	circuitBreaker.halfOpenTrials = append(trials, trialSlot{flagged: flagged, deadline: now + cfg.Timeout.Nanoseconds()})
+	config.GetLogger(circuitBreaker.Name).Debug("allowing trial request to possibly close circuit", "circuit", circuitBreaker.Name)
+
+	return true, true
 }
 
-func (circuitBreaker *CircuitBreaker) SetOpen() {
+// AllowRate reports whether the rate limiter of the circuit lets a command start now, and counts it if so.
+// It is called once the circuit allowed the command, before it takes a ticket from the executor pool.
+func (circuitBreaker *CircuitBreaker) AllowRate() bool {
+	limiter := circuitBreaker.currentRateLimiter()
+	return limiter == nil || limiter.Allow(time.Now())
+}
+
+// currentRateLimiter returns the rate limiter of the circuit, replacing it first if its settings changed.
+func (circuitBreaker *CircuitBreaker) currentRateLimiter() RateLimiter {
+	cfg := config.GetCircuitConfig(circuitBreaker.Name)
+
+	circuitBreaker.mutex.RLock()
+	limiter, stale := circuitBreaker.rateLimiter, cfg != circuitBreaker.rateConfig
+	circuitBreaker.mutex.RUnlock()
+	if !stale {
+		return limiter
+	}
+
 	circuitBreaker.mutex.Lock()
 	defer circuitBreaker.mutex.Unlock()
 
-	if circuitBreaker.open {
-		return
+	// read the config again, lest a concurrent call applied a newer one in the meantime
+	cfg = config.GetCircuitConfig(circuitBreaker.Name)
+	previous := circuitBreaker.rateConfig
+	circuitBreaker.rateConfig = cfg
+	if previous != nil && cfg.RateLimiter == previous.RateLimiter && cfg.RateLimit == previous.RateLimit &&
+		cfg.RateLimitWindow == previous.RateLimitWindow && cfg.RateLimitBurst == previous.RateLimitBurst {
+		// keep the starts counted so far
+		return circuitBreaker.rateLimiter
+	}
+
+	limiter, err := NewRateLimiter(cfg.RateLimiter, cfg.RateLimit, cfg.RateLimitWindow, cfg.RateLimitBurst)
+	if err != nil {
+		config.GetLogger(circuitBreaker.Name).Error("invalid rate limiter", "circuit", circuitBreaker.Name, "error", err, "fallback", RateLimiterNone)
+	}
+	circuitBreaker.rateLimiter = limiter
+	return limiter
+}
+
+// currentTripStrategy returns the trip strategy of the circuit, replacing it first if TripStrategy
+// or TripStrategies changed.
+func (circuitBreaker *CircuitBreaker) currentTripStrategy() TripStrategy {
+	cfg := config.GetCircuitConfig(circuitBreaker.Name)
+
+	circuitBreaker.mutex.RLock()
+	strategy, stale := circuitBreaker.tripStrategy, cfg != circuitBreaker.tripConfig
+	circuitBreaker.mutex.RUnlock()
+	if !stale {
+		return strategy
+	}
+
+	circuitBreaker.mutex.Lock()
+	defer circuitBreaker.mutex.Unlock()
+
+	// read the config again, lest a concurrent call applied a newer one in the meantime
+	cfg = config.GetCircuitConfig(circuitBreaker.Name)
+	previous := circuitBreaker.tripConfig
+	circuitBreaker.tripConfig = cfg
+	if previous != nil && cfg.TripStrategy == previous.TripStrategy && slices.Equal(cfg.TripStrategies, previous.TripStrategies) {
+		// keep the failures counted so far
+		return circuitBreaker.tripStrategy
+	}
+
+	strategy, err := NewTripStrategy(circuitBreaker.Name, cfg.TripStrategy)
+	if err != nil {
+		config.GetLogger(circuitBreaker.Name).Error("invalid trip strategy", "circuit", circuitBreaker.Name, "error", err, "fallback", TripErrorPercent)
+		strategy = newErrorPercentStrategy(circuitBreaker.Name)
+	}
+	circuitBreaker.tripStrategy = strategy
+	return strategy
+}
+
+// Pool returns the executor pool the commands of the circuit draw their tickets from, replacing it
+// first if PoolKey changed.
+func (circuitBreaker *CircuitBreaker) Pool() *ExecutorPool {
+	cfg := config.GetCircuitConfig(circuitBreaker.Name)
+
+	circuitBreaker.mutex.RLock()
+	pool, stale := circuitBreaker.pool, cfg != circuitBreaker.poolConfig
+	circuitBreaker.mutex.RUnlock()
+	if !stale {
+		return pool
+	}
+
+	circuitBreaker.mutex.Lock()
+	defer circuitBreaker.mutex.Unlock()
+
+	// read the config again, lest a concurrent call applied a newer one in the meantime
+	cfg = config.GetCircuitConfig(circuitBreaker.Name)
+	circuitBreaker.poolConfig = cfg
+	if circuitBreaker.pool == nil || circuitBreaker.pool.Name != cfg.PoolKey {
+		circuitBreaker.pool = GetExecutorPool(cfg.PoolKey)
 	}
+	return circuitBreaker.pool
+}
+
+// AllowHedge reports whether a slow command may start a hedged attempt, and counts it if so.
+// Hedged attempts are capped to HedgePercent of the requests of the rolling window, lest they
+// double the load on a downstream which is slow for every command.
+func (circuitBreaker *CircuitBreaker) AllowHedge() bool {
+	percent := config.GetCircuitConfig(circuitBreaker.Name).HedgePercent
+	now := time.Now()
+
+	circuitBreaker.mutex.Lock()
+	defer circuitBreaker.mutex.Unlock()
+
+	// count the request of the command, whose metrics are not reported yet
+	requests := circuitBreaker.Metrics.Requests().Sum(now) + 1
+	if (circuitBreaker.hedges.Sum(now)+1)*100 > requests*float64(percent) {
+		return false
+	}
+	circuitBreaker.hedges.Increment(1)
+	return true
+}
 
-	log.Printf("opening circuit %v", circuitBreaker.Name)
+func (circuitBreaker *CircuitBreaker) SetOpen() {
+	circuitBreaker.mutex.Lock()
+	change := circuitBreaker.setOpenLocked()
+	circuitBreaker.mutex.Unlock()
+
+	notifyStateChange(change)
+}
 
+// setOpenLocked must be called with the circuit mutex held.
+// It returns the transition for the listeners, or nil if the circuit was already open.
+func (circuitBreaker *CircuitBreaker) setOpenLocked() *StateChange {
+	if circuitBreaker.state == StateOpen {
+		return nil
+	}
+
+	change := circuitBreaker.newStateChange(circuitBreaker.state, StateOpen)
+	config.GetLogger(circuitBreaker.Name).Warn("opening circuit", "circuit", circuitBreaker.Name,
+		"from", change.From.String(), "error_percent", change.ErrorPercent, "request_volume", change.RequestVolume)
 	circuitBreaker.openedOrLastTestedTime = time.Now().UnixNano()
-	circuitBreaker.open = true
+	circuitBreaker.state = StateOpen
+	return change
 }
 
-func (circuitBreaker *CircuitBreaker) setClose() {
+// setCloseLocked must be called with the circuit mutex held.
+// It returns the transition for the listeners, or nil if the circuit was already closed.
+func (circuitBreaker *CircuitBreaker) setCloseLocked() *StateChange {
+	if circuitBreaker.state == StateClosed {
+		return nil
+	}
+
+	change := circuitBreaker.newStateChange(circuitBreaker.state, StateClosed)
+	config.GetLogger(circuitBreaker.Name).Info("closing circuit", "circuit", circuitBreaker.Name, "from", change.From.String())
+	circuitBreaker.state = StateClosed
+	circuitBreaker.Metrics.Reset()
+	circuitBreaker.tripStrategy.Reset()
+	return change
+}
+
+// newStateChange captures the health of the circuit before it moves from one state to another.
+func (circuitBreaker *CircuitBreaker) newStateChange(from, to State) *StateChange {
+	now := time.Now()
+	return &StateChange{
+		Name:          circuitBreaker.Name,
+		From:          from,
+		To:            to,
+		ErrorPercent:  circuitBreaker.Metrics.ErrorPercent(now),
+		RequestVolume: circuitBreaker.Metrics.Requests().Sum(now),
+		Time:          now,
+	}
+}
+
+// reportTrialResult feeds the outcome of a trial request into the state machine of the half-open circuit.
+// A success counts towards HalfOpenSuccessThreshold, a failure or timeout re-opens the circuit, and any
+// other outcome just frees its trial slot. Short-circuited requests were never admitted, so they hold no slot.
+//
+// An outcome reported with Outcome.Trial frees a slot taken by AllowTrialRequest, if any. One reported
+// without it only counts if a slot taken by AllowRequest is in flight, whose callers cannot flag outcomes.
+func (circuitBreaker *CircuitBreaker) reportTrialResult(eventType metrics.EventType, flagged bool) {
+	var change *StateChange
+	defer func() { notifyStateChange(change) }()
+
 	circuitBreaker.mutex.Lock()
 	defer circuitBreaker.mutex.Unlock()
 
-	if !circuitBreaker.open {
+	if circuitBreaker.state != StateHalfOpen || eventType == metrics.EventShortCircuit {
 		return
 	}
 
-	log.Printf("closing circuit %v", circuitBreaker.Name)
+	if !circuitBreaker.takeTrialSlotLocked(flagged) && !flagged {
+		// requests admitted while the circuit was closed say nothing about its recovery
+		return
+	}
 
-	circuitBreaker.open = false
-	circuitBreaker.Metrics.Reset()
+	switch eventType {
+	case metrics.EventSuccess:
+		circuitBreaker.halfOpenSuccesses++
+		if circuitBreaker.halfOpenSuccesses >= config.GetCircuitConfig(circuitBreaker.Name).HalfOpenSuccessThreshold {
+			change = circuitBreaker.setCloseLocked()
+		}
+	case metrics.EventFailure, metrics.EventTimeout:
+		change = circuitBreaker.setOpenLocked()
+	}
 }
 
-// ReportEvent records command metrics for tracking recent error rates
-func (circuitBreaker *CircuitBreaker) ReportEvent(eventTypes []string, start time.Time, runDuration time.Duration) error {
-	if len(eventTypes) == 0 {
-		return fmt.Errorf("no event types sent for metrics")
+// takeTrialSlotLocked frees the oldest trial slot which is flagged as given, falling back to any slot
+// for flagged outcomes. It reports whether a slot was freed, and must be called with the circuit mutex held.
+func (circuitBreaker *CircuitBreaker) takeTrialSlotLocked(flagged bool) bool {
+	index := -1
+	for i, slot := range circuitBreaker.halfOpenTrials {
+		if slot.flagged == flagged {
+			index = i
+			break
+		}
 	}
+	if index < 0 && flagged && len(circuitBreaker.halfOpenTrials) > 0 {
+		index = 0
+	}
+	if index < 0 {
+		return false
+	}
+	circuitBreaker.halfOpenTrials = append(circuitBreaker.halfOpenTrials[:index], circuitBreaker.halfOpenTrials[index+1:]...)
+	return true
+}
 
-	circuitBreaker.mutex.RLock()
-	o := circuitBreaker.open
-	circuitBreaker.mutex.RUnlock()
-	if eventTypes[0] == "success" && o {
-		circuitBreaker.setClose()
+// ReportEvent records command metrics for tracking recent error rates.
+// An outcome without an event only records its fallback, and leaves the health of the circuit as is.
+func (circuitBreaker *CircuitBreaker) ReportEvent(outcome metrics.Outcome, start time.Time, runDuration time.Duration) error {
+	if outcome.Event == metrics.EventNone && outcome.Fallback == metrics.EventNone {
+		return &CircuitError{Name: circuitBreaker.Name, Message: "no event type sent for metrics"}
 	}
 
+	if outcome.Event != metrics.EventNone {
+		circuitBreaker.currentTripStrategy().Observe(outcome.Event, runDuration)
+		circuitBreaker.reportTrialResult(outcome.Event, outcome.Trial)
+	}
+
+	pool := circuitBreaker.Pool()
+	if outcome.Pool != "" {
+		pool = GetExecutorPool(outcome.Pool)
+	}
 	var concurrencyInUse float64
-	if circuitBreaker.ExecutorPool.MaxReq > 0 {
-		concurrencyInUse = float64(circuitBreaker.ExecutorPool.ActiveCount()) / float64(circuitBreaker.ExecutorPool.MaxReq)
+	if size := pool.Size(); size > 0 {
+		concurrencyInUse = float64(pool.ActiveCount()) / float64(size)
 	}
 
 	select {
 	case circuitBreaker.Metrics.Updates <- &metrics.CommandExecution{
-		Types:            eventTypes,
+		Outcome:          outcome,
 		Start:            start,
 		RunDuration:      runDuration,
 		ConcurrencyInUse: concurrencyInUse,
 	}:
 	default:
-		return CircuitError{Message: fmt.Sprintf("metrics channel (%v) is at capacity", circuitBreaker.Name)}
+		return &CircuitError{Name: circuitBreaker.Name, Message: "metrics channel is at capacity"}
 	}
 
 	return nil
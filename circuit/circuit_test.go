@@ -2,6 +2,7 @@ package circuit
 
 import (
 	"Perseus/config"
+	"Perseus/metrics"
 	. "github.com/smartystreets/goconvey/convey"
 	"math/rand"
 	"sync"
@@ -76,10 +77,10 @@ func TestReportEventMultiThreaded(t *testing.T) {
 		defer Flush()
 		// Make the circuit easily open and close intermittently.
 		config.ConfigureCommand("", config.CommandConfig{
-			MaxConcurrentRequests:  1,
-			ErrorPercentThreshold:  1,
-			RequestVolumeThreshold: 1,
-			SleepWindow:            10,
+			MaxConcurrentRequests:  config.Int(1),
+			ErrorPercentThreshold:  config.Int(1),
+			RequestVolumeThreshold: config.Int(1),
+			SleepWindow:            config.Int(10),
 		})
 		cb, _, _ := GetCircuitBreaker("")
 		count := 5
@@ -97,11 +98,11 @@ func TestReportEventMultiThreaded(t *testing.T) {
 					}
 				}()
 				// randomized eventType to open/close circuit
-				eventType := "rejected"
+				eventType := metrics.EventRejected
 				if rand.Intn(3) == 1 {
-					eventType = "success"
+					eventType = metrics.EventSuccess
 				}
-				err := cb.ReportEvent([]string{eventType}, time.Now(), time.Second)
+				err := cb.ReportEvent(metrics.Outcome{Event: eventType}, time.Now(), time.Second)
 				if err != nil {
 					t.Error(err)
 				}
@@ -120,3 +121,207 @@ func TestReportEventMultiThreaded(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestHalfOpen(t *testing.T) {
+	Convey("with an open circuit allowing 2 trial requests and needing 2 successes", t, func() {
+		defer Flush()
+		config.ConfigureCommand("", config.CommandConfig{
+			SleepWindow:              config.Int(10),
+			HalfOpenMaxRequests:      config.Int(2),
+			HalfOpenSuccessThreshold: config.Int(2),
+		})
+		cb, _, _ := GetCircuitBreaker("")
+		cb.SetOpen()
+
+		Convey("requests are rejected during the sleep window", func() {
+			So(cb.AllowRequest(), ShouldBeFalse)
+			So(cb.State(), ShouldEqual, StateOpen)
+		})
+
+		Convey("after the sleep window", func() {
+			time.Sleep(20 * time.Millisecond)
+
+			Convey("only 2 trial requests are allowed and the circuit is half-open", func() {
+				So(cb.AllowRequest(), ShouldBeTrue)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				So(cb.AllowRequest(), ShouldBeFalse)
+				So(cb.State(), ShouldEqual, StateHalfOpen)
+				So(cb.IsOpen(), ShouldBeTrue)
+			})
+
+			Convey("a single success does not close the circuit", func() {
+				So(cb.AllowRequest(), ShouldBeTrue)
+				So(cb.ReportEvent(metrics.Outcome{Trial: true, Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+				So(cb.State(), ShouldEqual, StateHalfOpen)
+
+				Convey("but meeting the success quota does", func() {
+					So(cb.AllowRequest(), ShouldBeTrue)
+					So(cb.ReportEvent(metrics.Outcome{Trial: true, Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+					So(cb.State(), ShouldEqual, StateClosed)
+					So(cb.IsOpen(), ShouldBeFalse)
+				})
+			})
+
+			Convey("a failed trial re-opens the circuit immediately", func() {
+				So(cb.AllowRequest(), ShouldBeTrue)
+				So(cb.ReportEvent(metrics.Outcome{Trial: true, Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				So(cb.ReportEvent(metrics.Outcome{Trial: true, Event: metrics.EventTimeout}, time.Now(), 0), ShouldBeNil)
+				So(cb.State(), ShouldEqual, StateOpen)
+				So(cb.AllowRequest(), ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("with a command admitted while the circuit is closed", t, func() {
+		defer Flush()
+		config.ConfigureCommand("", config.CommandConfig{
+			SleepWindow:              config.Int(10),
+			HalfOpenMaxRequests:      config.Int(1),
+			HalfOpenSuccessThreshold: config.Int(1),
+		})
+		cb, _, _ := GetCircuitBreaker("")
+		allowed, trial := cb.AllowTrialRequest()
+		So(allowed, ShouldBeTrue)
+		So(trial, ShouldBeFalse)
+
+		Convey("finishing while the circuit is half-open should not count as a trial", func() {
+			cb.SetOpen()
+			time.Sleep(20 * time.Millisecond)
+			allowed, trial := cb.AllowTrialRequest()
+			So(allowed, ShouldBeTrue)
+			So(trial, ShouldBeTrue)
+
+			So(cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+			So(cb.State(), ShouldEqual, StateHalfOpen)
+			So(cb.AllowRequest(), ShouldBeFalse)
+
+			So(cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0), ShouldBeNil)
+			So(cb.State(), ShouldEqual, StateHalfOpen)
+
+			Convey("while the outcome of the trial should still close the circuit", func() {
+				So(cb.ReportEvent(metrics.Outcome{Trial: true, Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+				So(cb.State(), ShouldEqual, StateClosed)
+			})
+		})
+	})
+}
+
+func TestHalfOpenUnflagged(t *testing.T) {
+	Convey("with an open circuit allowing 1 trial request and needing 1 success", t, func() {
+		defer Flush()
+		config.ConfigureCommand("", config.CommandConfig{
+			Timeout:                  config.Int(50),
+			SleepWindow:              config.Int(10),
+			HalfOpenMaxRequests:      config.Int(1),
+			HalfOpenSuccessThreshold: config.Int(1),
+		})
+		cb, _, _ := GetCircuitBreaker("")
+		cb.SetOpen()
+		time.Sleep(20 * time.Millisecond)
+		So(cb.AllowRequest(), ShouldBeTrue)
+
+		Convey("a success reported without the trial flag should close it", func() {
+			So(cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+			So(cb.State(), ShouldEqual, StateClosed)
+			So(cb.AllowRequest(), ShouldBeTrue)
+		})
+
+		Convey("a trial request whose outcome is never reported should give its slot back after the timeout", func() {
+			So(cb.AllowRequest(), ShouldBeFalse)
+			time.Sleep(60 * time.Millisecond)
+			So(cb.AllowRequest(), ShouldBeTrue)
+			So(cb.State(), ShouldEqual, StateHalfOpen)
+		})
+	})
+}
+
+func TestStateForceOpen(t *testing.T) {
+	Convey("when a closed circuit is forced open", t, func() {
+		defer Flush()
+		cb, _, _ := GetCircuitBreaker("")
+		So(cb.State(), ShouldEqual, StateClosed)
+		So(cb.SwitchForceOpen(true), ShouldBeNil)
+
+		Convey("its state should be open", func() {
+			So(cb.State(), ShouldEqual, StateOpen)
+		})
+	})
+}
+
+func TestOnStateChange(t *testing.T) {
+	Convey("with a listener subscribed to state changes", t, func() {
+		defer Flush()
+		config.ConfigureCommand("listened", config.CommandConfig{SleepWindow: config.Int(10)})
+		changes := make(chan StateChange, 10)
+		remove := OnStateChange(func(change StateChange) {
+			if change.Name == "listened" {
+				changes <- change
+			}
+		})
+		defer remove()
+		cb, _, _ := GetCircuitBreaker("listened")
+
+		Convey("opening the circuit notifies the listener with its health", func() {
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+			time.Sleep(10 * time.Millisecond)
+			cb.SetOpen()
+
+			change := <-changes
+			So(change.From, ShouldEqual, StateClosed)
+			So(change.To, ShouldEqual, StateOpen)
+			So(change.Forced, ShouldBeFalse)
+			So(change.ErrorPercent, ShouldEqual, 100)
+			So(change.RequestVolume, ShouldEqual, 1)
+
+			Convey("and so do half-opening and closing it", func() {
+				time.Sleep(20 * time.Millisecond)
+				So(cb.AllowRequest(), ShouldBeTrue)
+				change = <-changes
+				So(change.From, ShouldEqual, StateOpen)
+				So(change.To, ShouldEqual, StateHalfOpen)
+
+				cb.ReportEvent(metrics.Outcome{Trial: true, Event: metrics.EventSuccess}, time.Now(), 0)
+				change = <-changes
+				So(change.From, ShouldEqual, StateHalfOpen)
+				So(change.To, ShouldEqual, StateClosed)
+			})
+		})
+
+		Convey("forcing the circuit open and releasing it notifies the listener", func() {
+			So(cb.SwitchForceOpen(true), ShouldBeNil)
+			change := <-changes
+			So(change.To, ShouldEqual, StateOpen)
+			So(change.Forced, ShouldBeTrue)
+
+			So(cb.SwitchForceOpen(false), ShouldBeNil)
+			change = <-changes
+			So(change.To, ShouldEqual, StateClosed)
+			So(change.Forced, ShouldBeTrue)
+		})
+
+		Convey("a removed listener is not notified", func() {
+			remove()
+			cb.SetOpen()
+			So(len(changes), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestReconfiguredSleepWindow(t *testing.T) {
+	Convey("with a circuit opened for a long sleep window", t, func() {
+		defer Flush()
+		defer config.ConfigureCommand("reconfigured", config.CommandConfig{})
+		config.ConfigureCommand("reconfigured", config.CommandConfig{SleepWindow: config.Int(60000)})
+		cb, _, _ := GetCircuitBreaker("reconfigured")
+		cb.SetOpen()
+
+		Convey("shortening the sleep window should take effect on the open circuit", func() {
+			config.ConfigureCommand("reconfigured", config.CommandConfig{SleepWindow: config.Int(10)})
+			time.Sleep(20 * time.Millisecond)
+
+			So(cb.AllowRequest(), ShouldBeTrue)
+			So(cb.State(), ShouldEqual, StateHalfOpen)
+		})
+	})
+}
@@ -0,0 +1,47 @@
+package circuit
+
+import (
+	"fmt"
+	"github.com/xiaoyisha/Perseus/metrics"
+)
+
+// A CircuitError is an error which models various failure states of execution,
+// such as the circuit being open or a timeout.
+//
+// A command which fails returns a CircuitError naming its circuit and what happened to the run, holding
+// the error which ended the run and, when the fallback failed too, the error of the fallback.
+// errors.Is and errors.As look into both, so errors.Is(err, Perseus.ErrTimeout) holds for a timed out
+// command whatever its fallback returned.
+type CircuitError struct {
+	// Name is the circuit the error occurred on, if any.
+	Name string
+	// Event is what happened to the run function, or metrics.EventNone for errors not about an execution.
+	Event   metrics.EventType
+	Message string
+	// RunErr is the error which ended the run, e.g. Perseus.ErrTimeout or the error returned by the run function.
+	RunErr error
+	// FallbackErr is the error returned by the fallback function.
+	FallbackErr error
+}
+
+func (e *CircuitError) Error() string {
+	if e.FallbackErr != nil {
+		return fmt.Sprintf("fallback err: %v, run err: %v", e.FallbackErr, e.RunErr)
+	}
+	if e.Message == "" && e.RunErr != nil {
+		return e.RunErr.Error()
+	}
+	return "Perseus: " + e.Message
+}
+
+// Unwrap returns the run and fallback errors, so errors.Is and errors.As can match either of them.
+func (e *CircuitError) Unwrap() []error {
+	var errs []error
+	if e.RunErr != nil {
+		errs = append(errs, e.RunErr)
+	}
+	if e.FallbackErr != nil {
+		errs = append(errs, e.FallbackErr)
+	}
+	return errs
+}
@@ -0,0 +1,177 @@
+package circuit
+
+import (
+	"fmt"
+	"github.com/xiaoyisha/Perseus/config"
+	"math"
+	"time"
+)
+
+// ConcurrencyLimiter adjusts the concurrency limit of an executor pool from the run durations of its commands,
+// so that the pool shrinks when its downstream slows down and grows when it recovers.
+// Calls are serialized by the pool.
+type ConcurrencyLimiter interface {
+	// Update is called when a command finishes with its run duration, how many commands were in flight,
+	// and whether it was dropped because it timed out. It returns the new limit.
+	Update(rtt time.Duration, inFlight int, dropped bool) int
+}
+
+// Names of the concurrency limiters, as used by config.CommandConfig.ConcurrencyLimiter.
+const (
+	LimiterFixed    = "fixed"
+	LimiterAIMD     = "aimd"
+	LimiterVegas    = "vegas"
+	LimiterGradient = "gradient"
+)
+
+// concurrencyLimiters holds the constructors of the concurrency limiters by name.
+var concurrencyLimiters = map[string]func(initial float64, bounds limitBounds) ConcurrencyLimiter{
+	LimiterFixed: func(float64, limitBounds) ConcurrencyLimiter { return nil },
+	LimiterAIMD: func(initial float64, bounds limitBounds) ConcurrencyLimiter {
+		return &aimdLimiter{limitBounds: bounds, limit: initial}
+	},
+	LimiterVegas: func(initial float64, bounds limitBounds) ConcurrencyLimiter {
+		return &vegasLimiter{limitBounds: bounds, limit: initial}
+	},
+	LimiterGradient: func(initial float64, bounds limitBounds) ConcurrencyLimiter {
+		return &gradientLimiter{limitBounds: bounds, limit: initial}
+	},
+}
+
+func init() {
+	for kind := range concurrencyLimiters {
+		config.RegisterConcurrencyLimiterName(kind)
+	}
+}
+
+// NewConcurrencyLimiter creates the ConcurrencyLimiter of the given kind, starting at initial and kept between min and max.
+// It returns nil for LimiterFixed.
+func NewConcurrencyLimiter(kind string, initial, min, max int) (ConcurrencyLimiter, error) {
+	newLimiter, ok := concurrencyLimiters[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown concurrency limiter %q", kind)
+	}
+	return newLimiter(float64(initial), limitBounds{min: float64(min), max: float64(max)}), nil
+}
+
+type limitBounds struct {
+	min float64
+	max float64
+}
+
+func (b limitBounds) clamp(limit float64) float64 {
+	return math.Max(b.min, math.Min(b.max, limit))
+}
+
+// appLimited reports whether too few commands are in flight for their run durations to tell
+// anything about the limit, in which case it is left as it is.
+func appLimited(limit float64, inFlight int) bool {
+	return float64(inFlight)*2 < limit
+}
+
+// aimdLimiter raises the limit by one for every command which completes while the pool is busy,
+// and cuts it by aimdBackoff whenever a command times out.
+type aimdLimiter struct {
+	limitBounds
+	limit float64
+}
+
+const aimdBackoff = 0.9
+
+func (l *aimdLimiter) Update(rtt time.Duration, inFlight int, dropped bool) int {
+	if dropped {
+		l.limit = l.clamp(l.limit * aimdBackoff)
+	} else if !appLimited(l.limit, inFlight) {
+		l.limit = l.clamp(l.limit + 1)
+	}
+	return int(l.limit)
+}
+
+// vegasLimiter estimates, as TCP Vegas does, how many commands are queued downstream from how much
+// longer they run than the shortest run duration seen, and keeps that queue between alpha and beta.
+type vegasLimiter struct {
+	limitBounds
+	limit float64
+	// minRTT is the shortest run duration seen, standing for the run duration without load
+	minRTT  time.Duration
+	samples int
+}
+
+// vegasProbeInterval is how many samples the shortest run duration is kept before it is measured again,
+// so that the limiter follows a downstream which became permanently slower or faster.
+const vegasProbeInterval = 1000
+
+func (l *vegasLimiter) Update(rtt time.Duration, inFlight int, dropped bool) int {
+	l.samples++
+	if l.samples >= vegasProbeInterval {
+		l.samples = 0
+		l.minRTT = 0
+	}
+	if rtt > 0 && (l.minRTT == 0 || rtt < l.minRTT) {
+		l.minRTT = rtt
+	}
+
+	step := math.Max(1, math.Log10(l.limit))
+	switch {
+	case dropped:
+		l.limit = l.clamp(l.limit - step)
+	case appLimited(l.limit, inFlight) || rtt <= 0:
+	default:
+		queue := math.Ceil(l.limit * (1 - float64(l.minRTT)/float64(rtt)))
+		alpha, beta := 3*step, 6*step
+		switch {
+		case queue <= step:
+			l.limit = l.clamp(l.limit + beta)
+		case queue < alpha:
+			l.limit = l.clamp(l.limit + step)
+		case queue > beta:
+			l.limit = l.clamp(l.limit - step)
+		}
+	}
+	return int(l.limit)
+}
+
+// gradientLimiter compares each run duration to their long term average: the limit shrinks as
+// commands run slower than usual, and grows by a queue of sqrt(limit) while they do not.
+type gradientLimiter struct {
+	limitBounds
+	limit   float64
+	longRTT float64
+	samples int
+}
+
+const (
+	// gradientWindow is how many samples the long term average run duration is smoothed over
+	gradientWindow = 600
+	// gradientTolerance is how much slower than usual commands may run before the limit shrinks
+	gradientTolerance = 1.5
+	// gradientSmoothing is how far the limit moves toward its new value with each sample
+	gradientSmoothing = 0.2
+)
+
+func (l *gradientLimiter) Update(rtt time.Duration, inFlight int, dropped bool) int {
+	if rtt <= 0 {
+		return int(l.limit)
+	}
+	r := float64(rtt)
+
+	l.samples++
+	if l.samples <= 10 {
+		// warm up with a plain average
+		l.longRTT += (r - l.longRTT) / float64(l.samples)
+	} else {
+		l.longRTT += (r - l.longRTT) * 2 / (gradientWindow + 1)
+	}
+	if l.longRTT > 2*r {
+		// recover faster once the downstream is fast again
+		l.longRTT = 2 * r
+	}
+
+	if !dropped && appLimited(l.limit, inFlight) {
+		return int(l.limit)
+	}
+	gradient := math.Max(0.5, math.Min(1, gradientTolerance*l.longRTT/r))
+	next := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.clamp(l.limit*(1-gradientSmoothing) + next*gradientSmoothing)
+	return int(l.limit)
+}
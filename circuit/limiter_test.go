@@ -0,0 +1,122 @@
+package circuit
+
+import (
+	"Perseus/config"
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// feed updates limiter with samples of the given run duration from a busy pool, and returns the last limit.
+func feed(limiter ConcurrencyLimiter, samples int, rtt time.Duration, dropped bool) int {
+	var limit int
+	for i := 0; i < samples; i++ {
+		limit = limiter.Update(rtt, 100, dropped)
+	}
+	return limit
+}
+
+func TestConcurrencyLimiters(t *testing.T) {
+	for _, kind := range []string{LimiterAIMD, LimiterVegas, LimiterGradient} {
+		Convey("given a "+kind+" limiter starting at 20 and kept between 2 and 50", t, func() {
+			limiter, err := NewConcurrencyLimiter(kind, 20, 2, 50)
+			So(err, ShouldBeNil)
+			feed(limiter, 20, 10*time.Millisecond, false)
+
+			Convey("the limit should shrink when the downstream slows down", func() {
+				var limit int
+				if kind == LimiterAIMD {
+					limit = feed(limiter, 20, time.Second, true)
+				} else {
+					limit = feed(limiter, 50, 200*time.Millisecond, false)
+				}
+				So(limit, ShouldBeLessThan, 20)
+				So(limit, ShouldBeGreaterThanOrEqualTo, 2)
+
+				Convey("and grow back to the maximum once it recovers", func() {
+					So(feed(limiter, 500, 10*time.Millisecond, false), ShouldEqual, 50)
+				})
+			})
+		})
+	}
+
+	Convey("a limiter should keep its limit while the pool is mostly idle", t, func() {
+		limiter, _ := NewConcurrencyLimiter(LimiterAIMD, 20, 2, 50)
+		So(limiter.Update(10*time.Millisecond, 1, false), ShouldEqual, 20)
+	})
+
+	Convey("the fixed limiter should adjust nothing", t, func() {
+		limiter, err := NewConcurrencyLimiter(LimiterFixed, 20, 2, 50)
+		So(err, ShouldBeNil)
+		So(limiter, ShouldBeNil)
+	})
+
+	Convey("unknown limiters should be rejected", t, func() {
+		_, err := NewConcurrencyLimiter("unknown", 20, 2, 50)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("configuring an unknown limiter should fail", t, func() {
+		So(config.ConfigureCommand("unknown_limiter", config.CommandConfig{ConcurrencyLimiter: "unknown"}), ShouldNotBeNil)
+	})
+
+	Convey("every limiter implemented should be accepted by the config", t, func() {
+		for kind := range concurrencyLimiters {
+			So(config.CommandConfig{ConcurrencyLimiter: kind}.Validate(), ShouldBeNil)
+		}
+	})
+}
+
+func TestAdaptiveExecutorPool(t *testing.T) {
+	defer Flush()
+	defer config.ConfigureCommand("adaptive", config.CommandConfig{})
+
+	Convey("with an AIMD pool of 10 tickets, 4 in use", t, func() {
+		config.ConfigureCommand("adaptive", config.CommandConfig{
+			MaxConcurrentRequests: config.Int(10),
+			MinConcurrentRequests: config.Int(2),
+			ConcurrencyLimiter:    LimiterAIMD,
+		})
+		pool := NewExecutorPool("adaptive")
+		var tickets []*struct{}
+		for i := 0; i < 4; i++ {
+			tickets = append(tickets, pool.AcquireTicket(context.Background()))
+		}
+		So(pool.Limit(), ShouldEqual, 10)
+
+		Convey("timeouts should lower the limit and hold back tickets", func() {
+			for i := 0; i < 10; i++ {
+				pool.Observe(time.Second, true)
+			}
+			So(pool.Limit(), ShouldEqual, 3)
+			So(pool.Metrics.ConcurrencyLimit(), ShouldEqual, 3)
+			So(pool.ActiveCount(), ShouldEqual, 4)
+			So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+
+			Convey("and tickets returned over the limit should be held back", func() {
+				pool.ReturnTicket(tickets[0])
+				pool.ReturnTicket(tickets[1])
+				So(pool.ActiveCount(), ShouldEqual, 2)
+				So(pool.AcquireTicket(context.Background()), ShouldNotBeNil)
+				So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+			})
+
+			Convey("fast commands should raise the limit again, up to twice the commands in flight", func() {
+				for i := 0; i < 10; i++ {
+					pool.Observe(time.Millisecond, false)
+				}
+				So(pool.Limit(), ShouldEqual, 8)
+				So(pool.AcquireTicket(context.Background()), ShouldNotBeNil)
+			})
+		})
+
+		Convey("switching back to the fixed limiter should release every ticket", func() {
+			pool.Observe(time.Second, true)
+			config.ConfigureCommand("adaptive", config.CommandConfig{MaxConcurrentRequests: config.Int(10)})
+			pool.AcquireTicket(context.Background())
+			So(pool.Limit(), ShouldEqual, 10)
+			So(len(pool.Tickets), ShouldEqual, 5)
+		})
+	})
+}
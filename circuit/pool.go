@@ -1,31 +1,343 @@
 package circuit
 
 import (
+	"context"
 	"github.com/xiaoyisha/Perseus/config"
 	"github.com/xiaoyisha/Perseus/rolling"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ExecutorPool hands out the tickets limiting how many commands run at once.
+//
+// The pool follows the config of its key: as soon as MaxConcurrentRequests changes, Tickets is
+// replaced with a channel of the new size and the queued callers wait on it instead. Tickets still
+// held when the pool shrinks are dropped as they are returned, until no more than MaxReq are in use.
+//
+// With an adaptive ConcurrencyLimiter, the pool lets fewer than MaxReq commands run at once:
+// the tickets above the current limit are held back until the limit grows again.
 type ExecutorPool struct {
-	Name    string
-	MaxReq  int
-	Tickets chan *struct{}
-	Metrics *poolMetrics
+	Name         string
+	MaxReq       int
+	Tickets      chan *struct{}
+	Metrics      *poolMetrics
+	QueueSize    int
+	QueueTimeout time.Duration
+	queued       int64
+
+	mutex *sync.RWMutex
+	// config is the config the pool was last sized from
+	config *config.Config
+	// debt is how many returned tickets to drop after the pool shrank
+	debt int
+	// resized is closed when Tickets is replaced, to wake up the queued callers
+	resized chan struct{}
+
+	// limiter adjusts limit, the number of tickets in use or in Tickets, or is nil to keep it at MaxReq
+	limiter ConcurrencyLimiter
+	limit   int
+	// held is how many tickets are held back while limit is below MaxReq
+	held int
+}
+
+var (
+	executorPoolsMutex *sync.RWMutex
+	executorPools      map[string]*ExecutorPool
+)
+
+func init() {
+	executorPoolsMutex = &sync.RWMutex{}
+	executorPools = make(map[string]*ExecutorPool)
+	config.OnChange(refreshExecutorPool)
+}
+
+// GetExecutorPool returns the executor pool with the given key, creating it the first time.
+// Circuits whose PoolKey is the same draw their tickets from the same pool, which takes its
+// MaxConcurrentRequests, QueueSize and QueueTimeout from the config of the key.
+func GetExecutorPool(key string) *ExecutorPool {
+	executorPoolsMutex.RLock()
+	p, ok := executorPools[key]
+	executorPoolsMutex.RUnlock()
+	if ok {
+		return p
+	}
+
+	executorPoolsMutex.Lock()
+	defer executorPoolsMutex.Unlock()
+	// another goroutine may have created the pool in the meantime
+	if p, ok := executorPools[key]; ok {
+		return p
+	}
+	p = NewExecutorPool(key)
+	executorPools[key] = p
+	return p
+}
+
+// GetExecutorPoolMap returns a snapshot of all executor pools created so far, keyed by pool key.
+func GetExecutorPoolMap() map[string]*ExecutorPool {
+	copy := make(map[string]*ExecutorPool)
+
+	executorPoolsMutex.RLock()
+	for key, p := range executorPools {
+		copy[key] = p
+	}
+	executorPoolsMutex.RUnlock()
+
+	return copy
+}
+
+// refreshExecutorPool applies the new config of the pool with the given key, if there is one.
+func refreshExecutorPool(key string) {
+	executorPoolsMutex.RLock()
+	p, ok := executorPools[key]
+	executorPoolsMutex.RUnlock()
+
+	if ok {
+		p.refresh()
+	}
+}
+
+// flushExecutorPools resets the metrics of all executor pools and forgets them.
+func flushExecutorPools() {
+	executorPoolsMutex.Lock()
+	defer executorPoolsMutex.Unlock()
+
+	for key, p := range executorPools {
+		p.Metrics.Reset()
+		delete(executorPools, key)
+	}
 }
 
 func NewExecutorPool(name string) *ExecutorPool {
+	cfg := config.LookupCircuitConfig(name)
+
 	p := &ExecutorPool{}
 	p.Name = name
-	p.MaxReq = config.GetCircuitConfig(name).MaxConcurrentRequests
+	p.mutex = &sync.RWMutex{}
+	p.config = cfg
+	p.MaxReq = cfg.MaxConcurrentRequests
+	p.QueueSize = cfg.QueueSize
+	p.QueueTimeout = cfg.QueueTimeout
 	p.Tickets = make(chan *struct{}, p.MaxReq)
 	for i := 0; i < p.MaxReq; i++ {
 		p.Tickets <- &struct{}{}
 	}
+	p.resized = make(chan struct{})
 	p.Metrics = newPoolMetrics(name)
+	p.limit = p.MaxReq
+	p.configureLimiter(cfg)
 
 	return p
 }
 
+// refresh applies the config of the pool if it changed since the pool was last sized.
+// It runs when the config changes, and before tickets are acquired in case the config changed
+// while the pool was being created.
+func (p *ExecutorPool) refresh() {
+	cfg := config.LookupCircuitConfig(p.Name)
+
+	p.mutex.RLock()
+	stale := cfg != p.config
+	p.mutex.RUnlock()
+	if !stale {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// read the config again, lest a concurrent refresh applied a newer one in the meantime
+	cfg = config.LookupCircuitConfig(p.Name)
+	if cfg == p.config {
+		return
+	}
+	previous := p.config
+	p.config = cfg
+	p.QueueSize = cfg.QueueSize
+	p.QueueTimeout = cfg.QueueTimeout
+	if cfg.MaxConcurrentRequests != p.MaxReq {
+		p.resize(cfg.MaxConcurrentRequests)
+	}
+	if cfg.ConcurrencyLimiter != previous.ConcurrencyLimiter || cfg.MinConcurrentRequests != previous.MinConcurrentRequests ||
+		cfg.MaxConcurrentRequests != previous.MaxConcurrentRequests {
+		p.configureLimiter(cfg)
+	}
+}
+
+// configureLimiter creates the limiter of the config, starting from the current limit.
+// It must be called with the mutex held, or before the pool is shared.
+func (p *ExecutorPool) configureLimiter(cfg *config.Config) {
+	min := cfg.MinConcurrentRequests
+	if min > p.MaxReq {
+		min = p.MaxReq
+	}
+	limit := p.limit
+	if limit < min {
+		limit = min
+	}
+	if limit > p.MaxReq {
+		limit = p.MaxReq
+	}
+
+	limiter, err := NewConcurrencyLimiter(cfg.ConcurrencyLimiter, limit, min, p.MaxReq)
+	if err != nil {
+		config.GetLogger(p.Name).Error("invalid concurrency limiter", "pool", p.Name, "error", err, "fallback", LimiterFixed)
+	}
+	p.limiter = limiter
+	if limiter == nil {
+		limit = p.MaxReq
+	}
+	p.setLimit(limit)
+}
+
+// setLimit holds back tickets, or releases them, so that no more than limit commands run at once.
+// It must be called with the mutex held.
+func (p *ExecutorPool) setLimit(limit int) {
+	p.limit = limit
+	target := p.MaxReq - limit
+release:
+	for p.held < target {
+		select {
+		case <-p.Tickets:
+			p.held++
+		default:
+			// the rest is held back as tickets are returned
+			break release
+		}
+	}
+	for p.held > target {
+		p.Tickets <- &struct{}{}
+		p.held--
+	}
+	atomic.StoreInt64(&p.Metrics.limit, int64(limit))
+}
+
+// Observe reports the run duration of a command which holds a ticket of the pool, and whether it was dropped
+// because it timed out, so that an adaptive pool adjusts its limit. It must be called before the ticket is returned.
+func (p *ExecutorPool) Observe(rtt time.Duration, dropped bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.limiter == nil {
+		return
+	}
+	p.setLimit(p.limiter.Update(rtt, p.activeCount(), dropped))
+}
+
+// resize replaces Tickets with a channel of max tickets, less those still in use.
+// It must be called with the mutex held, so that no ticket is returned to the old channel.
+func (p *ExecutorPool) resize(max int) {
+	old := p.Tickets
+	available := 0
+	for len(old) > 0 {
+		select {
+		case <-old:
+			available++
+		default:
+		}
+	}
+	active := p.MaxReq + p.debt - available - p.held
+
+	p.Tickets = make(chan *struct{}, max)
+	p.held = 0
+	p.debt = 0
+	if active > max {
+		p.debt = active - max
+	}
+	for i := active; i < max; i++ {
+		p.Tickets <- &struct{}{}
+	}
+	p.MaxReq = max
+
+	close(p.resized)
+	p.resized = make(chan struct{})
+}
+
+// AcquireTicket takes a ticket from the pool. When the pool is exhausted and has a wait queue,
+// the caller waits in line for up to QueueTimeout, or until ctx is done.
+// It returns nil if no ticket could be acquired.
+func (p *ExecutorPool) AcquireTicket(ctx context.Context) *struct{} {
+	p.refresh()
+
+	p.mutex.RLock()
+	tickets, resized := p.Tickets, p.resized
+	queueSize, queueTimeout := p.QueueSize, p.QueueTimeout
+	p.mutex.RUnlock()
+
+	select {
+	case ticket := <-tickets:
+		return ticket
+	default:
+	}
+
+	depth := atomic.AddInt64(&p.queued, 1)
+	defer atomic.AddInt64(&p.queued, -1)
+	if depth > int64(queueSize) {
+		return nil
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	var ticket *struct{}
+wait:
+	for ticket == nil {
+		select {
+		case ticket = <-tickets:
+		case <-resized:
+			// wait on the new channel instead
+			p.mutex.RLock()
+			tickets, resized = p.Tickets, p.resized
+			p.mutex.RUnlock()
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	p.Metrics.Updates <- poolMetricsUpdate{
+		queued:     true,
+		queueDepth: int(depth),
+		queueWait:  time.Since(start),
+	}
+
+	return ticket
+}
+
+// TryAcquireTicket takes a ticket from the pool if one is available, without waiting in its queue.
+// It returns nil otherwise.
+func (p *ExecutorPool) TryAcquireTicket() *struct{} {
+	p.refresh()
+
+	p.mutex.RLock()
+	tickets := p.Tickets
+	p.mutex.RUnlock()
+
+	select {
+	case ticket := <-tickets:
+		return ticket
+	default:
+		return nil
+	}
+}
+
+// QueuedCount number of callers waiting for a ticket
+func (p *ExecutorPool) QueuedCount() int {
+	p.mutex.RLock()
+	queueSize := p.QueueSize
+	p.mutex.RUnlock()
+
+	queued := int(atomic.LoadInt64(&p.queued))
+	if queued > queueSize {
+		// callers over the limit are about to be rejected
+		return queueSize
+	}
+	return queued
+}
+
 // ReturnTicket return ticket to the pool
 func (p *ExecutorPool) ReturnTicket(ticket *struct{}) {
 	if ticket == nil {
@@ -35,12 +347,53 @@ func (p *ExecutorPool) ReturnTicket(ticket *struct{}) {
 		activeCount: p.ActiveCount(),
 	}
 
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.debt > 0 {
+		// the pool shrank while the ticket was in use
+		p.debt--
+		return
+	}
+	if p.held < p.MaxReq-p.limit {
+		// the limit went down while the ticket was in use
+		p.held++
+		return
+	}
 	p.Tickets <- ticket
 }
 
 // ActiveCount number of threads that are active in the pool
 func (p *ExecutorPool) ActiveCount() int {
-	return p.MaxReq - len(p.Tickets)
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.activeCount()
+}
+
+// activeCount must be called with the mutex held.
+func (p *ExecutorPool) activeCount() int {
+	return p.MaxReq + p.debt - len(p.Tickets) - p.held
+}
+
+// Limit returns how many commands the pool currently lets run at once: MaxReq, unless an adaptive
+// ConcurrencyLimiter lowered it.
+func (p *ExecutorPool) Limit() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.limit
+}
+
+// QueueLimit returns how many callers may wait for a ticket, which is QueueSize as of the last resize.
+func (p *ExecutorPool) QueueLimit() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.QueueSize
+}
+
+// Size returns how many commands the pool lets run at once, which is MaxReq as of the last resize.
+func (p *ExecutorPool) Size() int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.MaxReq
 }
 
 // pool metrics
@@ -51,10 +404,20 @@ type poolMetrics struct {
 	Name              string
 	MaxActiveRequests *rolling.Number
 	Executed          *rolling.Number
+	MaxQueueDepth     *rolling.Number
+	QueueWait         *rolling.Timing
+
+	// limit is the current concurrency limit of the pool
+	limit int64
 }
 
+// poolMetricsUpdate is sent when a ticket is returned, or when queued is set,
+// when a caller leaves the wait queue.
 type poolMetricsUpdate struct {
 	activeCount int
+	queued      bool
+	queueDepth  int
+	queueWait   time.Duration
 }
 
 func newPoolMetrics(name string) *poolMetrics {
@@ -71,20 +434,34 @@ func newPoolMetrics(name string) *poolMetrics {
 }
 
 func (m *poolMetrics) Reset() {
+	cfg := config.LookupCircuitConfig(m.Name)
+
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
-	m.MaxActiveRequests = rolling.NewNumber()
-	m.Executed = rolling.NewNumber()
+	m.MaxActiveRequests = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	m.Executed = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	m.MaxQueueDepth = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	m.QueueWait = rolling.NewTimingWindow(cfg.RollingPercentileWindow, cfg.RollingPercentileWindowBuckets)
 }
 
 func (m *poolMetrics) Monitor() {
 	for u := range m.Updates {
 		m.Mutex.RLock()
 
-		m.Executed.Increment(1)
-		m.MaxActiveRequests.UpdateMax(float64(u.activeCount))
+		if u.queued {
+			m.MaxQueueDepth.UpdateMax(float64(u.queueDepth))
+			m.QueueWait.Add(u.queueWait)
+		} else {
+			m.Executed.Increment(1)
+			m.MaxActiveRequests.UpdateMax(float64(u.activeCount))
+		}
 
 		m.Mutex.RUnlock()
 	}
 }
+
+// ConcurrencyLimit returns the current concurrency limit of the pool.
+func (m *poolMetrics) ConcurrencyLimit() int {
+	return int(atomic.LoadInt64(&m.limit))
+}
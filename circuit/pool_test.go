@@ -1,7 +1,13 @@
 package circuit
 
 import (
+	"Perseus/config"
+	"Perseus/metrics"
+	"context"
+	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -43,3 +49,336 @@ func TestActiveCount(t *testing.T) {
 		})
 	})
 }
+
+func TestQueuedTicket(t *testing.T) {
+	defer Flush()
+
+	Convey("with an exhausted pool queueing 1 caller for 50 milliseconds", t, func() {
+		config.ConfigureCommand("queued", config.CommandConfig{MaxConcurrentRequests: config.Int(1), QueueSize: config.Int(1), QueueTimeout: config.Int(50)})
+		pool := NewExecutorPool("queued")
+		ticket := <-pool.Tickets
+
+		Convey("a queued caller gets the ticket once it is returned", func() {
+			got := make(chan *struct{}, 1)
+			go func() { got <- pool.AcquireTicket(context.Background()) }()
+			time.Sleep(10 * time.Millisecond)
+			So(pool.QueuedCount(), ShouldEqual, 1)
+
+			Convey("while another caller is rejected because the queue is full", func() {
+				So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+			})
+
+			pool.ReturnTicket(ticket)
+			So(<-got, ShouldNotBeNil)
+
+			Convey("and the queue depth and wait are recorded", func() {
+				time.Sleep(1 * time.Millisecond)
+				So(pool.Metrics.MaxQueueDepth.Max(time.Now()), ShouldEqual, 1)
+				So(pool.Metrics.QueueWait.Count(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("a queued caller is rejected after the queue timeout", func() {
+			start := time.Now()
+			So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+		})
+
+		Convey("a queued caller gives up when its context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			So(pool.AcquireTicket(ctx), ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, 50*time.Millisecond)
+		})
+	})
+}
+
+func TestSharedExecutorPool(t *testing.T) {
+	Convey("with two circuits configured with the same pool key", t, func() {
+		defer Flush()
+		config.ConfigureCommand("downstream", config.CommandConfig{MaxConcurrentRequests: config.Int(3)})
+		config.ConfigureCommand("first", config.CommandConfig{PoolKey: "downstream"})
+		config.ConfigureCommand("second", config.CommandConfig{PoolKey: "downstream"})
+		defer config.ConfigureCommand("downstream", config.CommandConfig{})
+		defer config.ConfigureCommand("first", config.CommandConfig{})
+		defer config.ConfigureCommand("second", config.CommandConfig{})
+
+		first, _, _ := GetCircuitBreaker("first")
+		second, _, _ := GetCircuitBreaker("second")
+
+		Convey("both draw their tickets from one pool sized by the config of the key", func() {
+			So(first.ExecutorPool, ShouldEqual, second.ExecutorPool)
+			So(first.ExecutorPool.Name, ShouldEqual, "downstream")
+			So(first.ExecutorPool.MaxReq, ShouldEqual, 3)
+			So(GetExecutorPool("downstream"), ShouldEqual, first.ExecutorPool)
+		})
+
+		Convey("a circuit without a pool key keeps a pool of its own", func() {
+			other, _, _ := GetCircuitBreaker("other")
+			So(other.ExecutorPool, ShouldNotEqual, first.ExecutorPool)
+			So(other.ExecutorPool.Name, ShouldEqual, "other")
+		})
+
+		Convey("changing the pool key of a circuit moves it to the pool of the new key", func() {
+			config.ConfigureCommand("second", config.CommandConfig{PoolKey: "upstream"})
+			So(second.Pool().Name, ShouldEqual, "upstream")
+			So(GetExecutorPool("upstream"), ShouldEqual, second.Pool())
+			So(first.Pool(), ShouldEqual, GetExecutorPool("downstream"))
+		})
+
+		Convey("the pools are listed by key", func() {
+			So(GetExecutorPoolMap(), ShouldContainKey, "downstream")
+			So(GetExecutorPoolMap(), ShouldNotContainKey, "first")
+		})
+	})
+}
+
+func TestPoolKeyConfig(t *testing.T) {
+	Convey("with a pool whose key is not a circuit", t, func() {
+		defer Flush()
+		key := fmt.Sprintf("pool_only_%d", time.Now().UnixNano())
+		pool := GetExecutorPool(key)
+
+		Convey("the key is not configured as a circuit", func() {
+			So(config.GetCircuitConfigMap(), ShouldNotContainKey, key)
+			So(pool.Size(), ShouldEqual, config.DefaultMaxConcurrent)
+		})
+
+		Convey("configuring the key resizes the pool", func() {
+			So(config.ConfigureCommand(key, config.CommandConfig{MaxConcurrentRequests: config.Int(3)}), ShouldBeNil)
+			So(pool.Size(), ShouldEqual, 3)
+		})
+	})
+}
+
+type concurrencyCollector struct {
+	concurrency chan float64
+}
+
+func (c *concurrencyCollector) Update(r metrics.MetricResult) {
+	c.concurrency <- r.ConcurrencyInUse
+}
+
+func (c *concurrencyCollector) Reset() {}
+
+func TestReportPoolConcurrency(t *testing.T) {
+	collector := &concurrencyCollector{concurrency: make(chan float64, 10)}
+	remove := metrics.Registry.Register(func(name string) metrics.MetricCollector {
+		if name == "reporting" {
+			return collector
+		}
+		return &concurrencyCollector{concurrency: make(chan float64, 10)}
+	})
+	defer remove()
+
+	Convey("with a command which took a ticket from a pool other than that of its circuit", t, func() {
+		defer Flush()
+		config.ConfigureCommand("reporting_pool", config.CommandConfig{MaxConcurrentRequests: config.Int(2)})
+		defer config.ConfigureCommand("reporting_pool", config.CommandConfig{})
+
+		cb, _, err := GetCircuitBreaker("reporting")
+		So(err, ShouldBeNil)
+		pool := GetExecutorPool("reporting_pool")
+		ticket := pool.AcquireTicket(context.Background())
+		defer pool.ReturnTicket(ticket)
+
+		Convey("the concurrency in use is that of the pool it used", func() {
+			So(cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess, Pool: "reporting_pool"}, time.Now(), 0), ShouldBeNil)
+			So(<-collector.concurrency, ShouldEqual, 0.5)
+
+			So(cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), 0), ShouldBeNil)
+			So(<-collector.concurrency, ShouldEqual, 0)
+		})
+	})
+}
+
+func TestResizeExecutorPool(t *testing.T) {
+	defer Flush()
+	defer config.ConfigureCommand("resized", config.CommandConfig{})
+
+	Convey("with a pool of 4 tickets all in use", t, func() {
+		config.ConfigureCommand("resized", config.CommandConfig{MaxConcurrentRequests: config.Int(4)})
+		pool := NewExecutorPool("resized")
+		var tickets []*struct{}
+		for i := 0; i < 4; i++ {
+			tickets = append(tickets, pool.AcquireTicket(context.Background()))
+		}
+
+		Convey("shrinking it to 2 should keep the tickets in use valid", func() {
+			config.ConfigureCommand("resized", config.CommandConfig{MaxConcurrentRequests: config.Int(2)})
+			So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+			So(pool.Size(), ShouldEqual, 2)
+			So(pool.ActiveCount(), ShouldEqual, 4)
+
+			Convey("and no ticket should be handed out until fewer than 2 are in use", func() {
+				pool.ReturnTicket(tickets[0])
+				pool.ReturnTicket(tickets[1])
+				So(pool.ActiveCount(), ShouldEqual, 2)
+				So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+
+				pool.ReturnTicket(tickets[2])
+				So(pool.AcquireTicket(context.Background()), ShouldNotBeNil)
+			})
+		})
+
+		Convey("growing it to 6 should hand out 2 more tickets at once", func() {
+			config.ConfigureCommand("resized", config.CommandConfig{MaxConcurrentRequests: config.Int(6)})
+			So(pool.AcquireTicket(context.Background()), ShouldNotBeNil)
+			So(pool.AcquireTicket(context.Background()), ShouldNotBeNil)
+			So(pool.AcquireTicket(context.Background()), ShouldBeNil)
+
+			Convey("and take back the tickets in use", func() {
+				for _, ticket := range tickets {
+					pool.ReturnTicket(ticket)
+				}
+				So(pool.ActiveCount(), ShouldEqual, 2)
+				So(len(pool.Tickets), ShouldEqual, 4)
+			})
+		})
+	})
+
+	Convey("with a caller queued on an exhausted pool", t, func() {
+		config.ConfigureCommand("resized", config.CommandConfig{MaxConcurrentRequests: config.Int(1), QueueSize: config.Int(1), QueueTimeout: config.Int(1000)})
+		pool := NewExecutorPool("resized")
+		pool.AcquireTicket(context.Background())
+
+		got := make(chan *struct{}, 1)
+		go func() { got <- pool.AcquireTicket(context.Background()) }()
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("growing the pool should hand the caller a ticket from the new channel", func() {
+			config.ConfigureCommand("resized", config.CommandConfig{MaxConcurrentRequests: config.Int(3), QueueSize: config.Int(1), QueueTimeout: config.Int(1000)})
+			// the next caller applies the new config
+			So(pool.AcquireTicket(context.Background()), ShouldNotBeNil)
+
+			select {
+			case ticket := <-got:
+				So(ticket, ShouldNotBeNil)
+			case <-time.After(500 * time.Millisecond):
+				t.Error("queued caller was not woken up by the resize")
+			}
+		})
+	})
+}
+
+func TestResizeExecutorPoolOnChange(t *testing.T) {
+	defer Flush()
+	defer config.ConfigureCommand("resized_now", config.CommandConfig{})
+
+	Convey("with a caller queued on an exhausted pool", t, func() {
+		config.ConfigureCommand("resized_now", config.CommandConfig{MaxConcurrentRequests: config.Int(1), QueueSize: config.Int(1), QueueTimeout: config.Int(1000)})
+		pool := GetExecutorPool("resized_now")
+		pool.AcquireTicket(context.Background())
+
+		got := make(chan *struct{}, 1)
+		go func() { got <- pool.AcquireTicket(context.Background()) }()
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("growing the pool should apply at once, without another caller", func() {
+			config.ConfigureCommand("resized_now", config.CommandConfig{MaxConcurrentRequests: config.Int(3), QueueSize: config.Int(2), QueueTimeout: config.Int(1000)})
+			So(pool.Size(), ShouldEqual, 3)
+			So(pool.QueueLimit(), ShouldEqual, 2)
+
+			select {
+			case ticket := <-got:
+				So(ticket, ShouldNotBeNil)
+			case <-time.After(500 * time.Millisecond):
+				t.Error("queued caller was not woken up by the resize")
+			}
+		})
+
+		Reset(func() {
+			Flush()
+		})
+	})
+}
+
+func TestResizeLookedUpExecutorPoolOnChange(t *testing.T) {
+	defer Flush()
+	defer config.ConfigureDefault(config.CommandConfig{})
+
+	Convey("with a caller queued on an exhausted pool whose key is not a circuit", t, func() {
+		config.ConfigureDefault(config.CommandConfig{MaxConcurrentRequests: config.Int(1), QueueSize: config.Int(1), QueueTimeout: config.Int(1000)})
+		pool := GetExecutorPool("looked_up")
+		pool.AcquireTicket(context.Background())
+
+		got := make(chan *struct{}, 1)
+		go func() { got <- pool.AcquireTicket(context.Background()) }()
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("raising the default limit should wake it up", func() {
+			config.ConfigureDefault(config.CommandConfig{MaxConcurrentRequests: config.Int(2), QueueSize: config.Int(1), QueueTimeout: config.Int(1000)})
+			So(pool.Size(), ShouldEqual, 2)
+
+			select {
+			case ticket := <-got:
+				So(ticket, ShouldNotBeNil)
+			case <-time.After(500 * time.Millisecond):
+				t.Error("queued caller was not woken up by the resize")
+			}
+		})
+
+		Reset(func() {
+			Flush()
+		})
+	})
+}
+
+func TestResizeExecutorPoolUnderLoad(t *testing.T) {
+	defer Flush()
+	defer config.ConfigureCommand("resized_load", config.CommandConfig{})
+
+	Convey("when the pool is resized while callers acquire and return tickets", t, func() {
+		config.ConfigureCommand("resized_load", config.CommandConfig{MaxConcurrentRequests: config.Int(8)})
+		pool := NewExecutorPool("resized_load")
+
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		var inUse, maxInUse int64
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					ticket := pool.AcquireTicket(context.Background())
+					if ticket == nil {
+						continue
+					}
+					n := atomic.AddInt64(&inUse, 1)
+					for {
+						max := atomic.LoadInt64(&maxInUse)
+						if n <= max || atomic.CompareAndSwapInt64(&maxInUse, max, n) {
+							break
+						}
+					}
+					time.Sleep(100 * time.Microsecond)
+					atomic.AddInt64(&inUse, -1)
+					pool.ReturnTicket(ticket)
+				}
+			}()
+		}
+
+		for _, size := range []int{2, 16, 1, 12, 4} {
+			config.ConfigureCommand("resized_load", config.CommandConfig{MaxConcurrentRequests: config.Int(size)})
+			time.Sleep(20 * time.Millisecond)
+		}
+		close(done)
+		wg.Wait()
+
+		Convey("no more tickets than the largest size should ever be in use", func() {
+			So(atomic.LoadInt64(&maxInUse), ShouldBeLessThanOrEqualTo, 16)
+		})
+
+		Convey("every ticket should be back in the pool at its last size", func() {
+			So(pool.Size(), ShouldEqual, 4)
+			So(pool.ActiveCount(), ShouldEqual, 0)
+			So(len(pool.Tickets), ShouldEqual, 4)
+		})
+	})
+}
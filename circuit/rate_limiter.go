@@ -0,0 +1,117 @@
+package circuit
+
+import (
+	"fmt"
+	"github.com/xiaoyisha/Perseus/config"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter caps how many commands of a circuit start per window of time, so that the circuit
+// stays within the quota of its downstream. Calls may be concurrent.
+type RateLimiter interface {
+	// Allow reports whether a command may start at now, and counts it if so.
+	Allow(now time.Time) bool
+}
+
+// Names of the rate limiters, as used by config.CommandConfig.RateLimiter.
+const (
+	RateLimiterNone          = "none"
+	RateLimiterTokenBucket   = "token_bucket"
+	RateLimiterSlidingWindow = "sliding_window"
+)
+
+// rateLimiters holds the constructors of the rate limiters by name.
+var rateLimiters = map[string]func(limit int, window time.Duration, burst int) RateLimiter{
+	RateLimiterNone: func(int, time.Duration, int) RateLimiter { return nil },
+	RateLimiterTokenBucket: func(limit int, window time.Duration, burst int) RateLimiter {
+		if burst <= 0 {
+			burst = limit
+		}
+		return &tokenBucket{
+			mutex:    &sync.Mutex{},
+			rate:     float64(limit) / float64(window),
+			capacity: float64(burst),
+			tokens:   float64(burst),
+		}
+	},
+	RateLimiterSlidingWindow: func(limit int, window time.Duration, _ int) RateLimiter {
+		return &slidingWindowLog{
+			mutex:  &sync.Mutex{},
+			window: window,
+			starts: make([]time.Time, limit),
+		}
+	},
+}
+
+func init() {
+	for kind := range rateLimiters {
+		config.RegisterRateLimiterName(kind)
+	}
+}
+
+// NewRateLimiter creates the RateLimiter of the given kind, letting limit commands start per window.
+// The token bucket lets up to burst commands start at once, or limit if burst is 0.
+// It returns nil for RateLimiterNone.
+func NewRateLimiter(kind string, limit int, window time.Duration, burst int) (RateLimiter, error) {
+	newLimiter, ok := rateLimiters[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limiter %q", kind)
+	}
+	if kind != RateLimiterNone && (limit < 1 || window <= 0) {
+		return nil, fmt.Errorf("rate limiter %q needs a positive limit and window, got %d per %v", kind, limit, window)
+	}
+	return newLimiter(limit, window, burst), nil
+}
+
+// tokenBucket lets a command start for each token in the bucket, which refills at a steady rate
+// up to its capacity: bursts of up to capacity commands pass, and the rate holds over time.
+type tokenBucket struct {
+	mutex *sync.Mutex
+	// rate is how many tokens are added per nanosecond
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func (b *tokenBucket) Allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if elapsed := now.Sub(b.last); !b.last.IsZero() && elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+float64(elapsed)*b.rate)
+	}
+	if b.last.IsZero() || now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// slidingWindowLog remembers when the last commands started, and lets a command start only if
+// fewer than limit did within the window before it: unlike the token bucket, no window ever
+// holds more than limit starts.
+type slidingWindowLog struct {
+	mutex  *sync.Mutex
+	window time.Duration
+	// starts is a ring of the last limit starts, next being the oldest
+	starts []time.Time
+	next   int
+}
+
+func (l *slidingWindowLog) Allow(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if oldest := l.starts[l.next]; !oldest.IsZero() && now.Sub(oldest) < l.window {
+		return false
+	}
+	l.starts[l.next] = now
+	l.next = (l.next + 1) % len(l.starts)
+	return true
+}
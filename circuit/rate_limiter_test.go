@@ -0,0 +1,86 @@
+package circuit
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/xiaoyisha/Perseus/config"
+	"testing"
+	"time"
+)
+
+// allowed counts how many of n commands starting at now the limiter lets through.
+func allowed(limiter RateLimiter, now time.Time, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if limiter.Allow(now) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestTokenBucket(t *testing.T) {
+	Convey("given a token bucket of 10 per second with bursts of 5", t, func() {
+		limiter, err := NewRateLimiter(RateLimiterTokenBucket, 10, time.Second, 5)
+		So(err, ShouldBeNil)
+		now := time.Now()
+
+		Convey("a burst should only let 5 commands start", func() {
+			So(allowed(limiter, now, 20), ShouldEqual, 5)
+
+			Convey("and the bucket should refill at 10 per second", func() {
+				So(allowed(limiter, now.Add(350*time.Millisecond), 20), ShouldEqual, 3)
+				So(allowed(limiter, now.Add(time.Hour), 20), ShouldEqual, 5)
+			})
+		})
+	})
+
+	Convey("a token bucket without burst should let the whole limit start at once", t, func() {
+		limiter, _ := NewRateLimiter(RateLimiterTokenBucket, 10, time.Second, 0)
+		So(allowed(limiter, time.Now(), 20), ShouldEqual, 10)
+	})
+}
+
+func TestSlidingWindowLog(t *testing.T) {
+	Convey("given a sliding window of 3 per second", t, func() {
+		limiter, err := NewRateLimiter(RateLimiterSlidingWindow, 3, time.Second, 0)
+		So(err, ShouldBeNil)
+		now := time.Now()
+		So(allowed(limiter, now, 2), ShouldEqual, 2)
+		So(allowed(limiter, now.Add(600*time.Millisecond), 2), ShouldEqual, 1)
+
+		Convey("no more than 3 commands should start within any second", func() {
+			So(allowed(limiter, now.Add(999*time.Millisecond), 1), ShouldEqual, 0)
+			So(allowed(limiter, now.Add(time.Second), 5), ShouldEqual, 2)
+			So(allowed(limiter, now.Add(1599*time.Millisecond), 1), ShouldEqual, 0)
+			So(allowed(limiter, now.Add(1600*time.Millisecond), 5), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	Convey("no rate limiter should be created for none", t, func() {
+		limiter, err := NewRateLimiter(RateLimiterNone, 0, 0, 0)
+		So(err, ShouldBeNil)
+		So(limiter, ShouldBeNil)
+	})
+
+	Convey("unknown rate limiters should be rejected", t, func() {
+		_, err := NewRateLimiter("leaky", 10, time.Second, 0)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("configuring an unknown rate limiter should fail", t, func() {
+		So(config.ConfigureCommand("unknown_rate_limiter", config.CommandConfig{RateLimiter: "leaky"}), ShouldNotBeNil)
+	})
+
+	Convey("every rate limiter implemented should be accepted by the config", t, func() {
+		for kind := range rateLimiters {
+			So(config.CommandConfig{RateLimiter: kind}.Validate(), ShouldBeNil)
+		}
+	})
+
+	Convey("rate limiters without a limit should be rejected", t, func() {
+		_, err := NewRateLimiter(RateLimiterSlidingWindow, 0, time.Second, 0)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,97 @@
+package circuit
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the position of a CircuitBreaker in its state machine.
+//
+// A closed circuit lets every request through. Once the circuit is measured as
+// unhealthy it opens and rejects requests for the sleep window, after which it
+// becomes half-open and admits a limited number of trial requests. Enough
+// successful trials close the circuit again, while a single failed trial
+// re-opens it.
+type State int
+
+const (
+	// StateClosed means requests flow normally.
+	StateClosed State = iota
+	// StateOpen means requests are short-circuited.
+	StateOpen
+	// StateHalfOpen means trial requests are probing whether the dependency has recovered.
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// StateChange describes a transition of a circuit from one State to another.
+type StateChange struct {
+	Name string
+	From State
+	To   State
+	// Forced is set when the transition was caused by SwitchForceOpen.
+	Forced bool
+	// ErrorPercent and RequestVolume are the rolling health metrics of the circuit at the time of the transition.
+	ErrorPercent  int
+	RequestVolume float64
+	Time          time.Time
+}
+
+var (
+	stateListenersMutex *sync.RWMutex
+	stateListeners      map[int]func(StateChange)
+	nextStateListener   int
+)
+
+func init() {
+	stateListenersMutex = &sync.RWMutex{}
+	stateListeners = make(map[int]func(StateChange))
+}
+
+// OnStateChange registers a listener called whenever any circuit opens, half-opens, closes,
+// or is forced open or released. Listeners run synchronously on the goroutine which caused the
+// transition, so they should return quickly. The returned function removes the listener.
+func OnStateChange(listener func(StateChange)) func() {
+	stateListenersMutex.Lock()
+	defer stateListenersMutex.Unlock()
+
+	id := nextStateListener
+	nextStateListener++
+	stateListeners[id] = listener
+
+	return func() {
+		stateListenersMutex.Lock()
+		defer stateListenersMutex.Unlock()
+		delete(stateListeners, id)
+	}
+}
+
+// notifyStateChange calls the listeners with change, if there is one.
+// It must not be called while holding the mutex of a circuit.
+func notifyStateChange(change *StateChange) {
+	if change == nil {
+		return
+	}
+
+	stateListenersMutex.RLock()
+	listeners := make([]func(StateChange), 0, len(stateListeners))
+	for _, listener := range stateListeners {
+		listeners = append(listeners, listener)
+	}
+	stateListenersMutex.RUnlock()
+
+	for _, listener := range listeners {
+		listener(*change)
+	}
+}
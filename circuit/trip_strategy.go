@@ -0,0 +1,250 @@
+package circuit
+
+import (
+	"fmt"
+	"github.com/xiaoyisha/Perseus/config"
+	"github.com/xiaoyisha/Perseus/metrics"
+	"github.com/xiaoyisha/Perseus/rolling"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TripStrategy decides when a closed circuit should open.
+// Implementations must be safe for concurrent use.
+type TripStrategy interface {
+	// Observe is called with the primary event type and run duration of every finished command.
+	Observe(eventType metrics.EventType, runDuration time.Duration)
+	// ShouldTrip reports whether the circuit should be opened.
+	ShouldTrip(circuitBreaker *CircuitBreaker, now time.Time) bool
+	// Reset clears any state kept by the strategy. It is called when the circuit closes.
+	Reset()
+}
+
+// Names of the built-in trip strategies, as used by config.CommandConfig.TripStrategy.
+const (
+	TripErrorPercent        = "error_percent"
+	TripConsecutiveFailures = "consecutive_failures"
+	TripSlowCallRate        = "slow_call_rate"
+	TripAny                 = "any"
+	TripAll                 = "all"
+)
+
+var (
+	tripStrategiesMutex *sync.RWMutex
+	tripStrategies      map[string]func(name string) TripStrategy
+)
+
+func init() {
+	tripStrategiesMutex = &sync.RWMutex{}
+	tripStrategies = map[string]func(name string) TripStrategy{
+		TripErrorPercent:        newErrorPercentStrategy,
+		TripConsecutiveFailures: newConsecutiveFailuresStrategy,
+		TripSlowCallRate:        newSlowCallRateStrategy,
+		TripAny:                 newAnyStrategy,
+		TripAll:                 newAllStrategy,
+	}
+	for kind := range tripStrategies {
+		config.RegisterTripStrategyName(kind)
+	}
+}
+
+// RegisterTripStrategy makes a custom TripStrategy selectable by kind through config.CommandConfig.
+// The initializer receives the circuit name and is called once per circuit.
+func RegisterTripStrategy(kind string, initTripStrategy func(name string) TripStrategy) {
+	tripStrategiesMutex.Lock()
+	defer tripStrategiesMutex.Unlock()
+
+	tripStrategies[kind] = initTripStrategy
+	config.RegisterTripStrategyName(kind)
+}
+
+// NewTripStrategy creates the TripStrategy of the given kind for a circuit.
+func NewTripStrategy(name, kind string) (TripStrategy, error) {
+	tripStrategiesMutex.RLock()
+	initTripStrategy, ok := tripStrategies[kind]
+	tripStrategiesMutex.RUnlock()
+
+	if !ok {
+		return nil, &CircuitError{Name: name, Message: fmt.Sprintf("unknown trip strategy %q", kind)}
+	}
+
+	strategy := initTripStrategy(name)
+	if composite, ok := strategy.(*compositeStrategy); ok && len(composite.strategies) == 0 {
+		// it would never trip
+		return nil, &CircuitError{Name: name, Message: fmt.Sprintf("trip strategy %q combines no valid strategy", kind)}
+	}
+	return strategy, nil
+}
+
+// errorPercentStrategy trips once the rolling error percent exceeds ErrorPercentThreshold
+// and at least RequestVolumeThreshold requests were made.
+type errorPercentStrategy struct {
+	name string
+}
+
+func newErrorPercentStrategy(name string) TripStrategy {
+	return &errorPercentStrategy{name: name}
+}
+
+func (s *errorPercentStrategy) Observe(eventType metrics.EventType, runDuration time.Duration) {}
+
+func (s *errorPercentStrategy) ShouldTrip(circuitBreaker *CircuitBreaker, now time.Time) bool {
+	if uint64(circuitBreaker.Metrics.Requests().Sum(now)) < config.GetCircuitConfig(s.name).RequestVolumeThreshold {
+		return false
+	}
+
+	return !circuitBreaker.Metrics.IsHealthy(now)
+}
+
+func (s *errorPercentStrategy) Reset() {}
+
+// consecutiveFailuresStrategy trips after ConsecutiveFailureThreshold failures or timeouts in a row.
+type consecutiveFailuresStrategy struct {
+	name     string
+	failures int64
+}
+
+func newConsecutiveFailuresStrategy(name string) TripStrategy {
+	return &consecutiveFailuresStrategy{name: name}
+}
+
+func (s *consecutiveFailuresStrategy) Observe(eventType metrics.EventType, runDuration time.Duration) {
+	switch eventType {
+	case metrics.EventSuccess:
+		atomic.StoreInt64(&s.failures, 0)
+	case metrics.EventFailure, metrics.EventTimeout:
+		atomic.AddInt64(&s.failures, 1)
+	}
+}
+
+func (s *consecutiveFailuresStrategy) ShouldTrip(circuitBreaker *CircuitBreaker, now time.Time) bool {
+	return atomic.LoadInt64(&s.failures) >= int64(config.GetCircuitConfig(s.name).ConsecutiveFailureThreshold)
+}
+
+func (s *consecutiveFailuresStrategy) Reset() {
+	atomic.StoreInt64(&s.failures, 0)
+}
+
+// slowCallRateStrategy trips once SlowCallRateThreshold percent of the calls in the rolling window
+// ran longer than SlowCallDuration, and at least RequestVolumeThreshold calls were made.
+// Timeouts always count as slow calls.
+type slowCallRateStrategy struct {
+	name      string
+	mutex     *sync.RWMutex
+	calls     *rolling.Number
+	slowCalls *rolling.Number
+}
+
+func newSlowCallRateStrategy(name string) TripStrategy {
+	s := &slowCallRateStrategy{name: name, mutex: &sync.RWMutex{}}
+	s.Reset()
+	return s
+}
+
+func (s *slowCallRateStrategy) Observe(eventType metrics.EventType, runDuration time.Duration) {
+	var slow bool
+	switch eventType {
+	case metrics.EventSuccess, metrics.EventFailure:
+		slow = runDuration > config.GetCircuitConfig(s.name).SlowCallDuration
+	case metrics.EventTimeout:
+		slow = true
+	default:
+		// the run function never completed, so there is no duration to judge
+		return
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	s.calls.Increment(1)
+	if slow {
+		s.slowCalls.Increment(1)
+	}
+}
+
+func (s *slowCallRateStrategy) ShouldTrip(circuitBreaker *CircuitBreaker, now time.Time) bool {
+	s.mutex.RLock()
+	calls := s.calls.Sum(now)
+	slowCalls := s.slowCalls.Sum(now)
+	s.mutex.RUnlock()
+
+	cfg := config.GetCircuitConfig(s.name)
+	if calls == 0 || uint64(calls) < cfg.RequestVolumeThreshold {
+		return false
+	}
+
+	return int(slowCalls/calls*100+0.5) >= cfg.SlowCallRateThreshold
+}
+
+func (s *slowCallRateStrategy) Reset() {
+	cfg := config.GetCircuitConfig(s.name)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.calls = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	s.slowCalls = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+}
+
+// compositeStrategy combines the strategies listed in TripStrategies, tripping when any
+// (or all) of them would trip.
+type compositeStrategy struct {
+	all        bool
+	strategies []TripStrategy
+}
+
+func newAnyStrategy(name string) TripStrategy {
+	return newCompositeStrategy(name, false)
+}
+
+func newAllStrategy(name string) TripStrategy {
+	return newCompositeStrategy(name, true)
+}
+
+func newCompositeStrategy(name string, all bool) *compositeStrategy {
+	s := &compositeStrategy{all: all}
+	for _, kind := range config.GetCircuitConfig(name).TripStrategies {
+		if kind == TripAny || kind == TripAll {
+			// nesting would build the same composite again
+			continue
+		}
+		strategy, err := NewTripStrategy(name, kind)
+		if err != nil {
+			config.GetLogger(name).Error("invalid trip strategy", "circuit", name, "error", err)
+			continue
+		}
+		s.strategies = append(s.strategies, strategy)
+	}
+	return s
+}
+
+func (s *compositeStrategy) Observe(eventType metrics.EventType, runDuration time.Duration) {
+	for _, strategy := range s.strategies {
+		strategy.Observe(eventType, runDuration)
+	}
+}
+
+func (s *compositeStrategy) ShouldTrip(circuitBreaker *CircuitBreaker, now time.Time) bool {
+	if len(s.strategies) == 0 {
+		return false
+	}
+
+	for _, strategy := range s.strategies {
+		trip := strategy.ShouldTrip(circuitBreaker, now)
+		if trip && !s.all {
+			return true
+		}
+		if !trip && s.all {
+			return false
+		}
+	}
+
+	return s.all
+}
+
+func (s *compositeStrategy) Reset() {
+	for _, strategy := range s.strategies {
+		strategy.Reset()
+	}
+}
@@ -0,0 +1,155 @@
+package circuit
+
+import (
+	"Perseus/config"
+	"Perseus/metrics"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestConsecutiveFailuresStrategy(t *testing.T) {
+	Convey("with a circuit tripping after 3 consecutive failures", t, func() {
+		defer Flush()
+		config.ConfigureCommand("", config.CommandConfig{
+			TripStrategy:                TripConsecutiveFailures,
+			ConsecutiveFailureThreshold: config.Int(3),
+		})
+		cb, _, _ := GetCircuitBreaker("")
+
+		Convey("2 failures do not open the circuit", func() {
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventTimeout}, time.Now(), 0)
+			So(cb.IsOpen(), ShouldBeFalse)
+
+			Convey("a success resets the count", func() {
+				cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), 0)
+				cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+				cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+				So(cb.IsOpen(), ShouldBeFalse)
+			})
+
+			Convey("a third failure opens the circuit", func() {
+				cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+				So(cb.IsOpen(), ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func TestSlowCallRateStrategy(t *testing.T) {
+	Convey("with a circuit tripping once half of 4 calls are slower than 10ms", t, func() {
+		defer Flush()
+		config.ConfigureCommand("", config.CommandConfig{
+			TripStrategy:           TripSlowCallRate,
+			SlowCallDuration:       config.Int(10),
+			SlowCallRateThreshold:  config.Int(50),
+			RequestVolumeThreshold: config.Int(4),
+		})
+		cb, _, _ := GetCircuitBreaker("")
+		cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), time.Millisecond)
+		cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), time.Millisecond)
+		cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), 20*time.Millisecond)
+
+		Convey("the circuit stays closed below the request volume", func() {
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+
+		Convey("a timeout counts as a slow call and opens the circuit", func() {
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventTimeout}, time.Now(), 0)
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+
+		Convey("a fast call keeps the circuit closed", func() {
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), time.Millisecond)
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+	})
+}
+
+func TestCompositeStrategy(t *testing.T) {
+	Convey("with strategies combining consecutive failures and the error percent", t, func() {
+		defer Flush()
+
+		Convey("any of them tripping opens an 'any' circuit", func() {
+			config.ConfigureCommand("", config.CommandConfig{
+				TripStrategy:                TripAny,
+				TripStrategies:              []string{TripErrorPercent, TripConsecutiveFailures},
+				ConsecutiveFailureThreshold: config.Int(2),
+			})
+			cb, _, _ := GetCircuitBreaker("")
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+
+		Convey("one of them tripping does not open an 'all' circuit", func() {
+			config.ConfigureCommand("", config.CommandConfig{
+				TripStrategy:                TripAll,
+				TripStrategies:              []string{TripErrorPercent, TripConsecutiveFailures},
+				ConsecutiveFailureThreshold: config.Int(2),
+			})
+			cb, _, _ := GetCircuitBreaker("")
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), 0)
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+	})
+}
+
+type alwaysTrip struct{}
+
+func (alwaysTrip) Observe(eventType metrics.EventType, runDuration time.Duration) {}
+func (alwaysTrip) ShouldTrip(circuitBreaker *CircuitBreaker, now time.Time) bool  { return true }
+func (alwaysTrip) Reset()                                                         {}
+
+func TestRegisterTripStrategy(t *testing.T) {
+	Convey("with a custom trip strategy registered and configured", t, func() {
+		defer Flush()
+		RegisterTripStrategy("always", func(name string) TripStrategy { return alwaysTrip{} })
+		config.ConfigureCommand("", config.CommandConfig{TripStrategy: "always"})
+		cb, _, _ := GetCircuitBreaker("")
+
+		Convey("the circuit uses it", func() {
+			So(cb.IsOpen(), ShouldBeTrue)
+		})
+
+		Convey("configuring another one should take effect on the circuit", func() {
+			config.ConfigureCommand("", config.CommandConfig{})
+			So(cb.IsOpen(), ShouldBeFalse)
+		})
+	})
+
+	Convey("with an unknown trip strategy", t, func() {
+		defer Flush()
+
+		Convey("configuring it fails", func() {
+			So(config.ConfigureCommand("", config.CommandConfig{TripStrategy: "unknown"}), ShouldNotBeNil)
+			So(config.ConfigureCommand("", config.CommandConfig{TripStrategy: TripAny, TripStrategies: []string{"unknown"}}), ShouldNotBeNil)
+		})
+
+		Convey("creating it fails", func() {
+			_, err := NewTripStrategy("", "unknown")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("every trip strategy implemented should be accepted by the config", t, func() {
+		for kind := range tripStrategies {
+			So(config.CommandConfig{TripStrategy: kind, TripStrategies: []string{TripErrorPercent}}.Validate(), ShouldBeNil)
+		}
+	})
+
+	Convey("with a composite trip strategy combining no strategy", t, func() {
+		defer Flush()
+
+		Convey("configuring it fails", func() {
+			So(config.ConfigureCommand("", config.CommandConfig{TripStrategy: TripAll}), ShouldNotBeNil)
+		})
+
+		Convey("creating it fails rather than never tripping", func() {
+			_, err := NewTripStrategy("", TripAll)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
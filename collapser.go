@@ -0,0 +1,205 @@
+package Perseus
+
+import (
+	"Perseus/config"
+	"Perseus/rolling"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// A BatchFunc loads the values of several keys at once. It returns the values found, along with the
+// errors of the keys which failed on their own. An error returned for the whole batch fails every key.
+type BatchFunc[K comparable, V any] func(ctx context.Context, keys []K) (map[K]V, map[K]error, error)
+
+// ErrMissingKey is returned by Collapser.Get when the batch returned neither a value nor an error for the key.
+var ErrMissingKey = errors.New("Perseus: batch returned no value for the key")
+
+// Collapser gathers the Get calls made within a window of time into a single batch, run as one command
+// of its circuit, and hands each caller the value of its own key. Calls for the same key share one slot
+// of the batch.
+//
+// A batch runs once the BatchWindow of the circuit has elapsed since its first call, or as soon as it
+// holds MaxBatchSize keys. Metrics, timeouts and fallbacks are those of Execute, for the whole batch.
+type Collapser[K comparable, V any] struct {
+	Metrics *CollapserMetrics
+
+	name  string
+	batch BatchFunc[K, V]
+	opts  []Option
+
+	mutex *sync.Mutex
+	// pending is the batch gathering calls, or nil until the next call
+	pending *batch[K, V]
+}
+
+// batch is a set of keys loaded by a single run of the BatchFunc.
+type batch[K comparable, V any] struct {
+	start time.Time
+	keys  []K
+	index map[K]struct{}
+	timer *time.Timer
+	// done is closed once the results below are set
+	done   chan struct{}
+	values map[K]V
+	errs   map[K]error
+	err    error
+}
+
+// batchResult is what the BatchFunc returned, as the result of the command running the batch.
+type batchResult[K comparable, V any] struct {
+	values map[K]V
+	errs   map[K]error
+}
+
+// NewCollapser creates a Collapser running its batches on the circuit with the given name.
+// The options apply to the command running each batch.
+func NewCollapser[K comparable, V any](name string, batch BatchFunc[K, V], opts ...Option) *Collapser[K, V] {
+	return &Collapser[K, V]{
+		Metrics: newCollapserMetrics(name),
+		name:    name,
+		batch:   batch,
+		opts:    opts,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Get adds key to the pending batch and blocks until the batch has run, or until ctx is done.
+// The batch itself runs with its own context, as other callers wait for it too.
+func (c *Collapser[K, V]) Get(ctx context.Context, key K) (V, error) {
+	b := c.add(key)
+
+	select {
+	case <-b.done:
+		return b.result(key)
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// add adds key to the pending batch, starting a new batch if there is none, and runs it if it is full.
+func (c *Collapser[K, V]) add(key K) *batch[K, V] {
+	cfg := config.GetCircuitConfig(c.name)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	b := c.pending
+	if b == nil {
+		b = &batch[K, V]{start: time.Now(), index: make(map[K]struct{}), done: make(chan struct{})}
+		b.timer = time.AfterFunc(cfg.BatchWindow, func() { c.flush(b) })
+		c.pending = b
+	}
+	if _, ok := b.index[key]; !ok {
+		b.index[key] = struct{}{}
+		b.keys = append(b.keys, key)
+	}
+	if len(b.keys) >= cfg.MaxBatchSize {
+		b.timer.Stop()
+		c.pending = nil
+		go c.run(b)
+	}
+	return b
+}
+
+// flush runs b once its window has elapsed, unless it already ran because it was full.
+func (c *Collapser[K, V]) flush(b *batch[K, V]) {
+	c.mutex.Lock()
+	pending := c.pending == b
+	if pending {
+		c.pending = nil
+	}
+	c.mutex.Unlock()
+
+	if pending {
+		c.run(b)
+	}
+}
+
+// run loads the keys of b as one command, and wakes up its callers.
+func (c *Collapser[K, V]) run(b *batch[K, V]) {
+	c.Metrics.update(len(b.keys), time.Since(b.start))
+
+	result, err := Execute(context.Background(), c.name, func(ctx context.Context) (batchResult[K, V], error) {
+		values, errs, err := c.batch(ctx, b.keys)
+		return batchResult[K, V]{values: values, errs: errs}, err
+	}, nil, c.opts...)
+
+	b.values, b.errs, b.err = result.values, result.errs, err
+	close(b.done)
+}
+
+// result returns the value of key once b has run.
+func (b *batch[K, V]) result(key K) (V, error) {
+	var zero V
+	if b.err != nil {
+		return zero, b.err
+	}
+	if err := b.errs[key]; err != nil {
+		return zero, err
+	}
+	if value, ok := b.values[key]; ok {
+		return value, nil
+	}
+	return zero, ErrMissingKey
+}
+
+// CollapserMetrics measures the batches of a Collapser over the rolling window of its circuit.
+type CollapserMetrics struct {
+	Mutex *sync.RWMutex
+
+	Name string
+	// Batches counts the batches run, and Keys the keys they held
+	Batches      *rolling.Number
+	Keys         *rolling.Number
+	MaxBatchSize *rolling.Number
+	// Window measures how long batches gathered calls before they ran
+	Window *rolling.Timing
+}
+
+func newCollapserMetrics(name string) *CollapserMetrics {
+	m := &CollapserMetrics{}
+	m.Name = name
+	m.Mutex = &sync.RWMutex{}
+
+	m.Reset()
+
+	return m
+}
+
+func (m *CollapserMetrics) Reset() {
+	cfg := config.GetCircuitConfig(m.Name)
+
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+
+	m.Batches = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	m.Keys = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	m.MaxBatchSize = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	m.Window = rolling.NewTimingWindow(cfg.RollingPercentileWindow, cfg.RollingPercentileWindowBuckets)
+}
+
+// update records a batch of size keys which gathered calls for window.
+func (m *CollapserMetrics) update(size int, window time.Duration) {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	m.Batches.Increment(1)
+	m.Keys.Increment(float64(size))
+	m.MaxBatchSize.UpdateMax(float64(size))
+	m.Window.Add(window)
+}
+
+// BatchSize returns the average number of keys of the batches in the rolling window.
+func (m *CollapserMetrics) BatchSize(now time.Time) float64 {
+	m.Mutex.RLock()
+	defer m.Mutex.RUnlock()
+
+	batches := m.Batches.Sum(now)
+	if batches == 0 {
+		return 0
+	}
+	return m.Keys.Sum(now) / batches
+}
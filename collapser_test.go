@@ -0,0 +1,128 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recordingBatch returns a BatchFunc which records the keys of each batch, and returns the key in
+// upper case for most keys, an error for "bad", and nothing for "missing".
+func recordingBatch(mutex *sync.Mutex, batches *[][]string) BatchFunc[string, string] {
+	errBad := errors.New("bad key")
+	return func(ctx context.Context, keys []string) (map[string]string, map[string]error, error) {
+		mutex.Lock()
+		*batches = append(*batches, keys)
+		mutex.Unlock()
+
+		values := make(map[string]string)
+		errs := make(map[string]error)
+		for _, key := range keys {
+			switch key {
+			case "bad":
+				errs[key] = errBad
+			case "missing":
+			default:
+				values[key] = fmt.Sprintf("<%s>", key)
+			}
+		}
+		return values, errs, nil
+	}
+}
+
+// getAll calls Get for each key at once, and returns the values and errors by key.
+func getAll(c *Collapser[string, string], keys ...string) (map[string]string, map[string]error) {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	values := make(map[string]string)
+	errs := make(map[string]error)
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			value, err := c.Get(context.Background(), key)
+			mutex.Lock()
+			values[key], errs[key] = value, err
+			mutex.Unlock()
+		}(key)
+	}
+	wg.Wait()
+	return values, errs
+}
+
+func TestCollapser(t *testing.T) {
+	Convey("with a collapser gathering calls for 50 milliseconds", t, func() {
+		defer circuit.Flush()
+		defer config.ConfigureCommand("collapsed", config.CommandConfig{})
+		config.ConfigureCommand("collapsed", config.CommandConfig{BatchWindow: config.Int(50), MaxBatchSize: config.Int(3)})
+		var mutex sync.Mutex
+		var batches [][]string
+		c := NewCollapser("collapsed", recordingBatch(&mutex, &batches))
+
+		Convey("calls made at once should run as a single batch", func() {
+			values, errs := getAll(c, "a", "b", "a")
+			So(batches, ShouldHaveLength, 1)
+			So(batches[0], ShouldHaveLength, 2)
+			So(errs["a"], ShouldBeNil)
+			So(values["a"], ShouldEqual, "<a>")
+			So(values["b"], ShouldEqual, "<b>")
+
+			Convey("and be measured", func() {
+				So(c.Metrics.Batches.Sum(time.Now()), ShouldEqual, 1)
+				So(c.Metrics.BatchSize(time.Now()), ShouldEqual, 2)
+				So(c.Metrics.MaxBatchSize.Max(time.Now()), ShouldEqual, 2)
+				So(c.Metrics.Window.Count(), ShouldEqual, 1)
+				So(c.Metrics.Window.PercentileDuration(50), ShouldBeGreaterThanOrEqualTo, 40*time.Millisecond)
+			})
+
+			Convey("and report a single command to the circuit", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("collapsed")
+				So(cb.Metrics.DefaultCollector().NumRequests().Sum(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("a full batch should run before the window elapses", func() {
+			config.ConfigureCommand("collapsed", config.CommandConfig{BatchWindow: config.Int(5000), MaxBatchSize: config.Int(2)})
+			start := time.Now()
+			_, errs := getAll(c, "a", "b")
+			So(time.Since(start), ShouldBeLessThan, time.Second)
+			So(errs["a"], ShouldBeNil)
+			So(batches, ShouldHaveLength, 1)
+		})
+
+		Convey("each key should get its own error", func() {
+			values, errs := getAll(c, "a", "bad", "missing")
+			So(values["a"], ShouldEqual, "<a>")
+			So(errs["bad"], ShouldNotBeNil)
+			So(errs["bad"].Error(), ShouldEqual, "bad key")
+			So(errs["missing"], ShouldEqual, ErrMissingKey)
+		})
+
+		Convey("a caller whose context is done should stop waiting", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := c.Get(ctx, "a")
+			So(err, ShouldEqual, context.Canceled)
+		})
+	})
+
+	Convey("a batch which fails should fail every key", t, func() {
+		defer circuit.Flush()
+		errBatch := errors.New("batch failed")
+		c := NewCollapser("collapsed_failing", func(ctx context.Context, keys []string) (map[string]string, map[string]error, error) {
+			return nil, nil, errBatch
+		})
+
+		_, errs := getAll(c, "a", "b")
+		So(errors.Is(errs["a"], errBatch), ShouldBeTrue)
+		So(errors.Is(errs["b"], errBatch), ShouldBeTrue)
+	})
+}
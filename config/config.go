@@ -1,6 +1,10 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"github.com/xiaoyisha/Perseus/logging"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -16,76 +20,412 @@ var (
 	DefaultSleepWindow = 5000
 	// DefaultErrorPercentThreshold causes circuits to open once the rolling measure of errors exceeds this percent of requests
 	DefaultErrorPercentThreshold = 50
+	// DefaultHalfOpenMaxRequests is how many trial requests may be in flight while a circuit is half-open
+	DefaultHalfOpenMaxRequests = 1
+	// DefaultHalfOpenSuccessThreshold is how many trial requests must succeed before a half-open circuit closes
+	DefaultHalfOpenSuccessThreshold = 1
+	// DefaultTripStrategy is the policy deciding when a closed circuit opens
+	DefaultTripStrategy = "error_percent"
+	// DefaultConsecutiveFailureThreshold is how many failures in a row open a circuit using the "consecutive_failures" strategy
+	DefaultConsecutiveFailureThreshold = 5
+	// DefaultSlowCallDuration is how long, in milliseconds, a call may run before the "slow_call_rate" strategy counts it as slow
+	DefaultSlowCallDuration = 500
+	// DefaultSlowCallRateThreshold causes circuits using the "slow_call_rate" strategy to open once this percent of calls are slow
+	DefaultSlowCallRateThreshold = 50
+	// DefaultRetryMaxAttempts is how many times a command is attempted before giving up; 1 disables retries
+	DefaultRetryMaxAttempts = 1
+	// DefaultRetryBackoff is how long, in milliseconds, to wait before the first retry
+	DefaultRetryBackoff = 100
+	// DefaultRetryMaxBackoff caps, in milliseconds, the wait between two retries
+	DefaultRetryMaxBackoff = 1000
+	// DefaultRetryBackoffMultiplier is the factor the wait grows by after each retry
+	DefaultRetryBackoffMultiplier = 2.0
+	// DefaultQueueSize is how many commands may wait for a ticket once an executor pool is exhausted; 0 rejects them immediately
+	DefaultQueueSize = 0
+	// DefaultQueueTimeout is how long, in milliseconds, a queued command waits for a ticket before being rejected
+	DefaultQueueTimeout = 100
+	// DefaultRollingWindow is how long, in milliseconds, the statistics used by the health check are kept
+	DefaultRollingWindow = 10000
+	// DefaultRollingWindowBuckets is how many buckets the rolling window is split into
+	DefaultRollingWindowBuckets = 10
+	// DefaultRollingPercentileWindow is how long, in milliseconds, the durations used for percentiles are kept
+	DefaultRollingPercentileWindow = 60000
+	// DefaultRollingPercentileWindowBuckets is how many buckets the rolling percentile window is split into
+	DefaultRollingPercentileWindowBuckets = 60
+	// DefaultConcurrencyLimiter is the algorithm adjusting the concurrency limit of executor pools; "fixed" keeps it at MaxConcurrentRequests
+	DefaultConcurrencyLimiter = "fixed"
+	// DefaultMinConcurrent is the lowest concurrency limit an adaptive concurrency limiter may set
+	DefaultMinConcurrent = 1
+	// DefaultRateLimiter is the algorithm capping how many commands of a circuit start per RateLimitWindow; "none" does not cap them
+	DefaultRateLimiter = "none"
+	// DefaultRateLimit is how many commands of a circuit may start per RateLimitWindow
+	DefaultRateLimit = 100
+	// DefaultRateLimitWindow is how long, in milliseconds, the window of the rate limiter is
+	DefaultRateLimitWindow = 1000
+	// DefaultRateLimitBurst is how many commands the "token_bucket" rate limiter lets start at once; 0 allows RateLimit
+	DefaultRateLimitBurst = 0
+	// DefaultHedgeDelay is how long, in milliseconds, a hedged command runs before a second attempt starts; 0 waits for the 95th percentile run duration
+	DefaultHedgeDelay = 0
+	// DefaultHedgePercent caps the hedged attempts of a circuit to this percent of its requests
+	DefaultHedgePercent = 10
+	// DefaultBatchWindow is how long, in milliseconds, a collapser gathers calls before running them as one batch
+	DefaultBatchWindow = 10
+	// DefaultMaxBatchSize is how many keys a collapser gathers at most into one batch
+	DefaultMaxBatchSize = 100
 )
 
 type Config struct {
-	Timeout                time.Duration
-	MaxConcurrentRequests  int
-	SleepWindow            time.Duration
-	RequestVolumeThreshold uint64
-	ErrorPercentThreshold  int
+	Timeout                        time.Duration
+	MaxConcurrentRequests          int
+	SleepWindow                    time.Duration
+	RequestVolumeThreshold         uint64
+	ErrorPercentThreshold          int
+	HalfOpenMaxRequests            int
+	HalfOpenSuccessThreshold       int
+	TripStrategy                   string
+	TripStrategies                 []string
+	ConsecutiveFailureThreshold    int
+	SlowCallDuration               time.Duration
+	SlowCallRateThreshold          int
+	RetryMaxAttempts               int
+	RetryBackoff                   time.Duration
+	RetryMaxBackoff                time.Duration
+	RetryBackoffMultiplier         float64
+	Retryable                      func(error) bool
+	QueueSize                      int
+	QueueTimeout                   time.Duration
+	RollingWindow                  time.Duration
+	RollingWindowBuckets           int
+	RollingPercentileWindow        time.Duration
+	RollingPercentileWindowBuckets int
+	PoolKey                        string
+	ConcurrencyLimiter             string
+	MinConcurrentRequests          int
+	RateLimiter                    string
+	RateLimit                      int
+	RateLimitWindow                time.Duration
+	RateLimitBurst                 int
+	HedgeDelay                     time.Duration
+	HedgePercent                   int
+	BatchWindow                    time.Duration
+	MaxBatchSize                   int
+	Logger                         logging.Logger
 }
 
 var circuitConfig map[string]*Config
 var configMutex *sync.RWMutex
 
+// lookedUpConfig holds the configs computed by LookupCircuitConfig for names which are not circuits,
+// until the defaults change.
+var lookedUpConfig map[string]*Config
+
+var (
+	changeHooksMutex *sync.RWMutex
+	changeHooks      map[int]func(name string)
+	nextChangeHook   int
+)
+
 func init() {
 	circuitConfig = make(map[string]*Config)
+	lookedUpConfig = make(map[string]*Config)
 	configMutex = &sync.RWMutex{}
+	changeHooksMutex = &sync.RWMutex{}
+	changeHooks = make(map[int]func(name string))
+}
+
+// OnChange registers a function called with the name of each circuit whose config is replaced,
+// once the new config is in place, and of each name looked up with LookupCircuitConfig whose config
+// may have changed. It is not called for circuits configured for the first time.
+// The returned function removes the hook.
+func OnChange(hook func(name string)) func() {
+	changeHooksMutex.Lock()
+	defer changeHooksMutex.Unlock()
+
+	id := nextChangeHook
+	nextChangeHook++
+	changeHooks[id] = hook
+
+	return func() {
+		changeHooksMutex.Lock()
+		defer changeHooksMutex.Unlock()
+		delete(changeHooks, id)
+	}
+}
+
+// notifyChange calls the hooks registered with OnChange for each of the circuits given.
+// It must be called without configMutex held, as the hooks read the new configs.
+func notifyChange(names []string) {
+	changeHooksMutex.RLock()
+	hooks := make([]func(name string), 0, len(changeHooks))
+	for _, hook := range changeHooks {
+		hooks = append(hooks, hook)
+	}
+	changeHooksMutex.RUnlock()
+
+	for _, name := range names {
+		for _, hook := range hooks {
+			hook(name)
+		}
+	}
 }
 
-// CommandConfig is used to tune circuit settings at runtime
+// changedNames returns the circuits which had a config before, and have a new one, along with
+// the names only looked up so far, whose configs are computed again once lookedUpConfig is reset.
+// It must be called with configMutex held.
+func changedNames(configs map[string]*Config) []string {
+	var names []string
+	for name, config := range circuitConfig {
+		if configs[name] != config {
+			names = append(names, name)
+		}
+	}
+	for name := range lookedUpConfig {
+		if _, configured := circuitConfig[name]; !configured {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// CommandConfig is used to tune circuit settings at runtime.
+// Settings left nil use the defaults, so that zero can be set explicitly with Int(0).
 type CommandConfig struct {
-	Timeout                int `json:"timeout"`
-	MaxConcurrentRequests  int `json:"max_concurrent_requests"`
-	RequestVolumeThreshold int `json:"request_volume_threshold"`
-	SleepWindow            int `json:"sleep_window"`
-	ErrorPercentThreshold  int `json:"error_percent_threshold"`
+	Timeout                  *int `json:"timeout"`
+	MaxConcurrentRequests    *int `json:"max_concurrent_requests"`
+	RequestVolumeThreshold   *int `json:"request_volume_threshold"`
+	SleepWindow              *int `json:"sleep_window"`
+	ErrorPercentThreshold    *int `json:"error_percent_threshold"`
+	HalfOpenMaxRequests      *int `json:"half_open_max_requests"`
+	HalfOpenSuccessThreshold *int `json:"half_open_success_threshold"`
+	// TripStrategy names the policy used to open the circuit: "error_percent", "consecutive_failures",
+	// "slow_call_rate", or "any"/"all" to combine the strategies listed in TripStrategies.
+	TripStrategy                string   `json:"trip_strategy"`
+	TripStrategies              []string `json:"trip_strategies"`
+	ConsecutiveFailureThreshold *int     `json:"consecutive_failure_threshold"`
+	SlowCallDuration            *int     `json:"slow_call_duration"`
+	SlowCallRateThreshold       *int     `json:"slow_call_rate_threshold"`
+	RetryMaxAttempts            *int     `json:"retry_max_attempts"`
+	RetryBackoff                *int     `json:"retry_backoff"`
+	RetryMaxBackoff             *int     `json:"retry_max_backoff"`
+	RetryBackoffMultiplier      *float64 `json:"retry_backoff_multiplier"`
+	QueueSize                   *int     `json:"queue_size"`
+	QueueTimeout                *int     `json:"queue_timeout"`
+	// RollingWindow and RollingWindowBuckets set the statistical window of the circuit metrics and health check,
+	// e.g. 30000 and 60 keep 30 seconds in 500 millisecond buckets.
+	RollingWindow                  *int `json:"rolling_window"`
+	RollingWindowBuckets           *int `json:"rolling_window_buckets"`
+	RollingPercentileWindow        *int `json:"rolling_percentile_window"`
+	RollingPercentileWindowBuckets *int `json:"rolling_percentile_window_buckets"`
+	// PoolKey names the executor pool the circuit takes its tickets from, the circuit name by default.
+	// Circuits with the same PoolKey share one pool, configured under the name of the key.
+	PoolKey string `json:"pool_key"`
+	// ConcurrencyLimiter names the algorithm adjusting the concurrency limit of the executor pool from the
+	// run durations of its commands: "fixed", "aimd", "vegas" or "gradient". Adaptive limits stay
+	// between MinConcurrentRequests and MaxConcurrentRequests.
+	ConcurrencyLimiter    string `json:"concurrency_limiter"`
+	MinConcurrentRequests *int   `json:"min_concurrent_requests"`
+	// RateLimiter names the algorithm capping how many commands of the circuit start per RateLimitWindow,
+	// to stay within the quota of the downstream: "none", "token_bucket" or "sliding_window".
+	// Commands over RateLimit are rejected with Perseus.ErrRateLimited.
+	RateLimiter     string `json:"rate_limiter"`
+	RateLimit       *int   `json:"rate_limit"`
+	RateLimitWindow *int   `json:"rate_limit_window"`
+	RateLimitBurst  *int   `json:"rate_limit_burst"`
+	// HedgeDelay and HedgePercent tune the commands started with Perseus.WithHedging: a second attempt starts
+	// once the first ran for HedgeDelay, or for the 95th percentile run duration of the circuit if it is 0,
+	// as long as the hedged attempts stay within HedgePercent of the requests of the rolling window.
+	HedgeDelay   *int `json:"hedge_delay"`
+	HedgePercent *int `json:"hedge_percent"`
+	// BatchWindow and MaxBatchSize tune the Perseus.Collapser running its batches on the circuit: a batch runs
+	// once BatchWindow has elapsed since its first call, or as soon as it holds MaxBatchSize keys.
+	BatchWindow  *int `json:"batch_window"`
+	MaxBatchSize *int `json:"max_batch_size"`
+	// Retryable reports whether a failed attempt should be retried. When nil, every error
+	// except an open circuit or a done context is retried.
+	Retryable func(error) bool `json:"-"`
+	// Logger receives the logs of the circuit instead of the global logger set with logging.SetLogger.
+	Logger logging.Logger `json:"-"`
+}
+
+// Int returns a pointer to v, to set an int setting of a CommandConfig.
+func Int(v int) *int {
+	return &v
+}
+
+// Float64 returns a pointer to v, to set a float64 setting of a CommandConfig.
+func Float64(v float64) *float64 {
+	return &v
 }
 
-// Configure applies settings for a set of circuits
-func Configure(cmds map[string]CommandConfig) {
+// Configure applies settings for a set of circuits. Circuits whose settings are invalid are left
+// as they were, and their errors returned together.
+func Configure(cmds map[string]CommandConfig) error {
+	var errs []error
 	for k, v := range cmds {
-		ConfigureCommand(k, v)
+		if err := ConfigureCommand(k, v); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
 }
 
-// ConfigureCommand applies settings for a circuit
-func ConfigureCommand(name string, config CommandConfig) {
+// ConfigureCommand applies settings for a circuit. It returns an error, and leaves the circuit
+// as it was, if the settings are invalid once the defaults are applied.
+//
+// Settings given by a config file, the environment or flags take precedence over those given in code.
+func ConfigureCommand(name string, config CommandConfig) error {
 	configMutex.Lock()
-	defer configMutex.Unlock()
+	next := layers
+	next[sourceCode] = layers[sourceCode].withCommand(name, config)
+	c, err := resolveLayers(name, &next)
+	if err != nil {
+		configMutex.Unlock()
+		return err
+	}
+	// a name only looked up until now counts as changed, so that the executor pool it keys is resized
+	_, configured := circuitConfig[name]
+	_, lookedUp := lookedUpConfig[name]
+	changed := configured || lookedUp
+	layers = next
+	circuitConfig[name] = c
+	delete(lookedUpConfig, name)
+	configMutex.Unlock()
 
-	timeout := DefaultTimeout
-	if config.Timeout != 0 {
-		timeout = config.Timeout
+	if changed {
+		notifyChange([]string{name})
 	}
+	return nil
+}
 
-	max := DefaultMaxConcurrent
-	if config.MaxConcurrentRequests != 0 {
-		max = config.MaxConcurrentRequests
+// ConfigureDefault applies settings to every circuit which does not set them itself,
+// taking precedence over the Default values of the package. It returns an error, and changes
+// nothing, if the settings of any circuit become invalid.
+func ConfigureDefault(config CommandConfig) error {
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("default config: %w", err)
 	}
 
-	volume := DefaultVolumeThreshold
-	if config.RequestVolumeThreshold != 0 {
-		volume = config.RequestVolumeThreshold
+	configMutex.Lock()
+	next := layers
+	next[sourceCode].defaults = config
+	configs, err := resolveAll(&next)
+	if err != nil {
+		configMutex.Unlock()
+		return err
 	}
 
-	sleep := DefaultSleepWindow
-	if config.SleepWindow != 0 {
-		sleep = config.SleepWindow
+	changed := changedNames(configs)
+	layers = next
+	circuitConfig = configs
+	lookedUpConfig = make(map[string]*Config)
+	configMutex.Unlock()
+
+	notifyChange(changed)
+	return nil
+}
+
+// resolve validates the settings of a circuit once the given defaults and the Default values are applied,
+// and computes its config.
+func resolve(name string, config CommandConfig, defaults CommandConfig) (*Config, error) {
+	resolved := withDefaults(withDefaults(config, defaults), packageDefaults())
+	if err := resolved.validateResolved(); err != nil {
+		return nil, fmt.Errorf("config of circuit %q: %w", name, err)
+	}
+	return newConfig(name, resolved), nil
+}
+
+// withDefaults fills the settings left unset in config with those of defaults.
+func withDefaults(config CommandConfig, defaults CommandConfig) CommandConfig {
+	c := reflect.ValueOf(&config).Elem()
+	d := reflect.ValueOf(defaults)
+	for i := 0; i < c.NumField(); i++ {
+		if c.Field(i).IsZero() {
+			c.Field(i).Set(d.Field(i))
+		}
+	}
+	return config
+}
+
+// packageDefaults returns the Default values of the package as settings.
+func packageDefaults() CommandConfig {
+	return CommandConfig{
+		Timeout:                        Int(DefaultTimeout),
+		MaxConcurrentRequests:          Int(DefaultMaxConcurrent),
+		RequestVolumeThreshold:         Int(DefaultVolumeThreshold),
+		SleepWindow:                    Int(DefaultSleepWindow),
+		ErrorPercentThreshold:          Int(DefaultErrorPercentThreshold),
+		HalfOpenMaxRequests:            Int(DefaultHalfOpenMaxRequests),
+		HalfOpenSuccessThreshold:       Int(DefaultHalfOpenSuccessThreshold),
+		TripStrategy:                   DefaultTripStrategy,
+		ConsecutiveFailureThreshold:    Int(DefaultConsecutiveFailureThreshold),
+		SlowCallDuration:               Int(DefaultSlowCallDuration),
+		SlowCallRateThreshold:          Int(DefaultSlowCallRateThreshold),
+		RetryMaxAttempts:               Int(DefaultRetryMaxAttempts),
+		RetryBackoff:                   Int(DefaultRetryBackoff),
+		RetryMaxBackoff:                Int(DefaultRetryMaxBackoff),
+		RetryBackoffMultiplier:         Float64(DefaultRetryBackoffMultiplier),
+		QueueSize:                      Int(DefaultQueueSize),
+		QueueTimeout:                   Int(DefaultQueueTimeout),
+		RollingWindow:                  Int(DefaultRollingWindow),
+		RollingWindowBuckets:           Int(DefaultRollingWindowBuckets),
+		RollingPercentileWindow:        Int(DefaultRollingPercentileWindow),
+		RollingPercentileWindowBuckets: Int(DefaultRollingPercentileWindowBuckets),
+		ConcurrencyLimiter:             DefaultConcurrencyLimiter,
+		MinConcurrentRequests:          Int(DefaultMinConcurrent),
+		RateLimiter:                    DefaultRateLimiter,
+		RateLimit:                      Int(DefaultRateLimit),
+		RateLimitWindow:                Int(DefaultRateLimitWindow),
+		RateLimitBurst:                 Int(DefaultRateLimitBurst),
+		HedgeDelay:                     Int(DefaultHedgeDelay),
+		HedgePercent:                   Int(DefaultHedgePercent),
+		BatchWindow:                    Int(DefaultBatchWindow),
+		MaxBatchSize:                   Int(DefaultMaxBatchSize),
 	}
+}
 
-	errorPercent := DefaultErrorPercentThreshold
-	if config.ErrorPercentThreshold != 0 {
-		errorPercent = config.ErrorPercentThreshold
+// newConfig computes the config of a circuit from settings which have all been resolved.
+func newConfig(name string, config CommandConfig) *Config {
+	poolKey := name
+	if config.PoolKey != "" {
+		poolKey = config.PoolKey
 	}
 
-	circuitConfig[name] = &Config{
-		Timeout:                time.Duration(timeout) * time.Millisecond,
-		MaxConcurrentRequests:  max,
-		RequestVolumeThreshold: uint64(volume),
-		SleepWindow:            time.Duration(sleep) * time.Millisecond,
-		ErrorPercentThreshold:  errorPercent,
+	return &Config{
+		Timeout:                        time.Duration(*config.Timeout) * time.Millisecond,
+		MaxConcurrentRequests:          *config.MaxConcurrentRequests,
+		RequestVolumeThreshold:         uint64(*config.RequestVolumeThreshold),
+		SleepWindow:                    time.Duration(*config.SleepWindow) * time.Millisecond,
+		ErrorPercentThreshold:          *config.ErrorPercentThreshold,
+		HalfOpenMaxRequests:            *config.HalfOpenMaxRequests,
+		HalfOpenSuccessThreshold:       *config.HalfOpenSuccessThreshold,
+		TripStrategy:                   config.TripStrategy,
+		TripStrategies:                 config.TripStrategies,
+		ConsecutiveFailureThreshold:    *config.ConsecutiveFailureThreshold,
+		SlowCallDuration:               time.Duration(*config.SlowCallDuration) * time.Millisecond,
+		SlowCallRateThreshold:          *config.SlowCallRateThreshold,
+		RetryMaxAttempts:               *config.RetryMaxAttempts,
+		RetryBackoff:                   time.Duration(*config.RetryBackoff) * time.Millisecond,
+		RetryMaxBackoff:                time.Duration(*config.RetryMaxBackoff) * time.Millisecond,
+		RetryBackoffMultiplier:         *config.RetryBackoffMultiplier,
+		Retryable:                      config.Retryable,
+		QueueSize:                      *config.QueueSize,
+		QueueTimeout:                   time.Duration(*config.QueueTimeout) * time.Millisecond,
+		RollingWindow:                  time.Duration(*config.RollingWindow) * time.Millisecond,
+		RollingWindowBuckets:           *config.RollingWindowBuckets,
+		RollingPercentileWindow:        time.Duration(*config.RollingPercentileWindow) * time.Millisecond,
+		RollingPercentileWindowBuckets: *config.RollingPercentileWindowBuckets,
+		PoolKey:                        poolKey,
+		ConcurrencyLimiter:             config.ConcurrencyLimiter,
+		MinConcurrentRequests:          *config.MinConcurrentRequests,
+		RateLimiter:                    config.RateLimiter,
+		RateLimit:                      *config.RateLimit,
+		RateLimitWindow:                time.Duration(*config.RateLimitWindow) * time.Millisecond,
+		RateLimitBurst:                 *config.RateLimitBurst,
+		HedgeDelay:                     time.Duration(*config.HedgeDelay) * time.Millisecond,
+		HedgePercent:                   *config.HedgePercent,
+		BatchWindow:                    time.Duration(*config.BatchWindow) * time.Millisecond,
+		MaxBatchSize:                   *config.MaxBatchSize,
+		Logger:                         config.Logger,
 	}
 }
 
@@ -96,13 +436,64 @@ func GetCircuitConfig(name string) *Config {
 	configMutex.RUnlock()
 
 	if !exists {
-		ConfigureCommand(name, CommandConfig{}) // use the default config
+		if err := ConfigureCommand(name, CommandConfig{}); err != nil {
+			// only invalid Default values get here: use them anyway rather than fail every command
+			logging.GetLogger().Error("invalid default config", "circuit", name, "error", err)
+			configMutex.Lock()
+			if _, exists := circuitConfig[name]; !exists {
+				command, defaults := settingsOf(name, &layers)
+				circuitConfig[name] = newConfig(name, withDefaults(withDefaults(command, defaults), packageDefaults()))
+			}
+			configMutex.Unlock()
+		}
 		s = GetCircuitConfig(name)
 	}
 
 	return s
 }
 
+// LookupCircuitConfig returns the config of the circuit by name like GetCircuitConfig, but does not
+// configure the circuit if it has no config yet: it returns the config the circuit would get instead.
+// It suits names which may not be circuits, such as the keys of shared executor pools.
+func LookupCircuitConfig(name string) *Config {
+	configMutex.RLock()
+	s, exists := circuitConfig[name]
+	if !exists {
+		s, exists = lookedUpConfig[name]
+	}
+	configMutex.RUnlock()
+	if exists {
+		return s
+	}
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if s, exists := circuitConfig[name]; exists {
+		return s
+	}
+	if s, exists := lookedUpConfig[name]; exists {
+		return s
+	}
+	s, err := resolveLayers(name, &layers)
+	if err != nil {
+		// only invalid Default values get here: use them anyway, as GetCircuitConfig does
+		logging.GetLogger().Error("invalid default config", "circuit", name, "error", err)
+		command, defaults := settingsOf(name, &layers)
+		s = newConfig(name, withDefaults(withDefaults(command, defaults), packageDefaults()))
+	}
+	lookedUpConfig[name] = s
+	return s
+}
+
+// GetLogger returns the logger of the circuit, or the global logger if it has none
+func GetLogger(name string) logging.Logger {
+	if logger := LookupCircuitConfig(name).Logger; logger != nil {
+		return logger
+	}
+	return logging.GetLogger()
+}
+
 func GetCircuitConfigMap() map[string]*Config {
 	copy := make(map[string]*Config)
 
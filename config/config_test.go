@@ -1,6 +1,8 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -9,7 +11,7 @@ import (
 
 func TestConfigureConcurrency(t *testing.T) {
 	Convey("given a command configured for 100 concurrent requests", t, func() {
-		ConfigureCommand("", CommandConfig{MaxConcurrentRequests: 100})
+		ConfigureCommand("", CommandConfig{MaxConcurrentRequests: Int(100)})
 
 		Convey("reading the concurrency should be the same", func() {
 			So(GetCircuitConfig("").MaxConcurrentRequests, ShouldEqual, 100)
@@ -19,7 +21,7 @@ func TestConfigureConcurrency(t *testing.T) {
 
 func TestConfigureTimeout(t *testing.T) {
 	Convey("given a command configured for a 10000 milliseconds", t, func() {
-		ConfigureCommand("", CommandConfig{Timeout: 10000})
+		ConfigureCommand("", CommandConfig{Timeout: Int(10000)})
 
 		Convey("reading the timeout should be the same", func() {
 			So(GetCircuitConfig("").Timeout, ShouldEqual, time.Duration(10*time.Second))
@@ -29,7 +31,7 @@ func TestConfigureTimeout(t *testing.T) {
 
 func TestConfigureRVT(t *testing.T) {
 	Convey("given a command configured to need 30 requests before tripping the circuit", t, func() {
-		ConfigureCommand("", CommandConfig{RequestVolumeThreshold: 30})
+		ConfigureCommand("", CommandConfig{RequestVolumeThreshold: Int(30)})
 
 		Convey("reading the threshold should be the same", func() {
 			So(GetCircuitConfig("").RequestVolumeThreshold, ShouldEqual, uint64(30))
@@ -49,7 +51,7 @@ func TestSleepWindowDefault(t *testing.T) {
 
 func TestGetCircuitSettings(t *testing.T) {
 	Convey("when calling GetCircuitSettings", t, func() {
-		ConfigureCommand("test", CommandConfig{Timeout: 30000})
+		ConfigureCommand("test", CommandConfig{Timeout: Int(30000)})
 
 		Convey("should read the same setting just added", func() {
 			So(GetCircuitConfigMap()["test"], ShouldEqual, GetCircuitConfig("test"))
@@ -57,3 +59,153 @@ func TestGetCircuitSettings(t *testing.T) {
 		})
 	})
 }
+
+func TestValidate(t *testing.T) {
+	Convey("given settings out of range", t, func() {
+		err := CommandConfig{Timeout: Int(-1), ErrorPercentThreshold: Int(101), MaxConcurrentRequests: Int(0)}.Validate()
+
+		Convey("each one should be reported", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "invalid timeout -1: must be greater than 0")
+			So(err.Error(), ShouldContainSubstring, "invalid error_percent_threshold 101: must be between 1 and 100")
+			So(err.Error(), ShouldContainSubstring, "invalid max_concurrent_requests 0: must be greater than 0")
+		})
+
+		Convey("as a ValidationError", func() {
+			var validationErr *ValidationError
+			So(errors.As(err, &validationErr), ShouldBeTrue)
+			So(validationErr.Setting, ShouldEqual, "timeout")
+		})
+	})
+
+	Convey("an error percent threshold of 0, which no circuit is ever below, should be reported", t, func() {
+		err := CommandConfig{ErrorPercentThreshold: Int(0)}.Validate()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "invalid error_percent_threshold 0: must be between 1 and 100")
+	})
+
+	Convey("settings left unset should be valid", t, func() {
+		So(CommandConfig{}.Validate(), ShouldBeNil)
+	})
+
+	Convey("unknown trip strategies should be reported", t, func() {
+		err := CommandConfig{TripStrategy: "error_pct", TripStrategies: []string{"error_percent", "any"}}.Validate()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid trip_strategy error_pct: must be one of")
+		So(err.Error(), ShouldContainSubstring, "invalid trip_strategies any")
+		So(err.Error(), ShouldNotContainSubstring, "error_percent:")
+	})
+
+	Convey("unknown concurrency limiters should be reported", t, func() {
+		err := CommandConfig{ConcurrencyLimiter: "adaptive"}.Validate()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "invalid concurrency_limiter adaptive: must be one of")
+		So(CommandConfig{ConcurrencyLimiter: "fixed"}.Validate(), ShouldBeNil)
+	})
+
+	Convey("unknown rate limiters should be reported", t, func() {
+		err := CommandConfig{RateLimiter: "leaky_bucket"}.Validate()
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldStartWith, "invalid rate_limiter leaky_bucket: must be one of")
+		So(CommandConfig{RateLimiter: "none"}.Validate(), ShouldBeNil)
+	})
+}
+
+func TestConfigureInvalid(t *testing.T) {
+	defer ConfigureCommand("invalid", CommandConfig{})
+
+	Convey("given a valid command", t, func() {
+		So(ConfigureCommand("invalid", CommandConfig{Timeout: Int(500)}), ShouldBeNil)
+
+		Convey("invalid settings should be rejected and leave it as it was", func() {
+			err := ConfigureCommand("invalid", CommandConfig{Timeout: Int(100), SleepWindow: Int(-5)})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, `config of circuit "invalid"`)
+			So(GetCircuitConfig("invalid").Timeout, ShouldEqual, 500*time.Millisecond)
+		})
+
+		Convey("an invalid Default value should be rejected as well", func() {
+			DefaultMaxConcurrent = 0
+			defer func() { DefaultMaxConcurrent = 10 }()
+
+			So(ConfigureCommand("invalid", CommandConfig{}), ShouldNotBeNil)
+			So(ConfigureCommand("invalid", CommandConfig{MaxConcurrentRequests: Int(5)}), ShouldBeNil)
+		})
+
+		Convey("invalid defaults should be rejected", func() {
+			So(ConfigureDefault(CommandConfig{RetryBackoffMultiplier: Float64(0.5)}), ShouldNotBeNil)
+			So(GetCircuitConfig("invalid").RetryBackoffMultiplier, ShouldEqual, DefaultRetryBackoffMultiplier)
+		})
+	})
+}
+
+func TestExplicitZero(t *testing.T) {
+	defer ConfigureCommand("zero", CommandConfig{})
+
+	Convey("given a command setting its volume threshold to zero explicitly", t, func() {
+		So(ConfigureCommand("zero", CommandConfig{RequestVolumeThreshold: Int(0)}), ShouldBeNil)
+
+		Convey("zero should be used rather than the default", func() {
+			So(GetCircuitConfig("zero").RequestVolumeThreshold, ShouldEqual, uint64(0))
+		})
+	})
+
+	Convey("given defaults set with ConfigureDefault", t, func() {
+		So(ConfigureDefault(CommandConfig{SleepWindow: Int(1000), RetryBackoff: Int(50)}), ShouldBeNil)
+		defer ConfigureDefault(CommandConfig{})
+		So(ConfigureCommand("zero", CommandConfig{RetryBackoff: Int(0)}), ShouldBeNil)
+
+		Convey("they should apply to settings left unset but not to an explicit zero", func() {
+			So(GetCircuitConfig("zero").SleepWindow, ShouldEqual, time.Second)
+			So(GetCircuitConfig("zero").RetryBackoff, ShouldEqual, time.Duration(0))
+		})
+	})
+}
+
+func TestOnChange(t *testing.T) {
+	// a circuit is configured for the first time only once per process, whatever the test count
+	added := fmt.Sprintf("watched_%d", time.Now().UnixNano())
+	defer ConfigureCommand("watched", CommandConfig{})
+	defer ConfigureDefault(CommandConfig{})
+
+	var changes []*Config
+	remove := OnChange(func(name string) {
+		if name == "watched" || name == added {
+			changes = append(changes, GetCircuitConfig(name))
+		}
+	})
+	defer remove()
+
+	Convey("configuring a command the first time should not call the hooks", t, func() {
+		So(ConfigureCommand(added, CommandConfig{Timeout: Int(100)}), ShouldBeNil)
+		So(changes, ShouldBeEmpty)
+	})
+
+	Convey("given a configured command", t, func() {
+		So(ConfigureCommand("watched", CommandConfig{Timeout: Int(100)}), ShouldBeNil)
+		changes = nil
+
+		Convey("replacing its config should call them with the new config in place", func() {
+			So(ConfigureCommand("watched", CommandConfig{Timeout: Int(200)}), ShouldBeNil)
+			So(changes, ShouldHaveLength, 1)
+			So(changes[0].Timeout, ShouldEqual, 200*time.Millisecond)
+		})
+
+		Convey("changing the defaults should call them as well", func() {
+			So(ConfigureDefault(CommandConfig{SleepWindow: Int(1000)}), ShouldBeNil)
+			So(changes, ShouldNotBeEmpty)
+			So(changes[0].SleepWindow, ShouldEqual, time.Second)
+		})
+
+		Convey("an invalid config should not call them", func() {
+			So(ConfigureCommand("watched", CommandConfig{SleepWindow: Int(-5)}), ShouldNotBeNil)
+			So(changes, ShouldBeEmpty)
+		})
+
+		Convey("a removed hook should not be called", func() {
+			remove()
+			So(ConfigureCommand("watched", CommandConfig{Timeout: Int(300)}), ShouldBeNil)
+			So(changes, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"github.com/xiaoyisha/Perseus/logging"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvPrefix starts the name of the environment variables read by LoadEnv.
+const EnvPrefix = "PERSEUS_"
+
+// envDefault stands for the defaults in the name of an environment variable.
+const envDefault = "default"
+
+// envName ends the name of the environment variables giving the exact name of a circuit.
+const envName = "_NAME"
+
+// LoadEnv applies the settings given by environment variables, replacing those it applied before.
+// Settings for every circuit are named PERSEUS_DEFAULT_<SETTING> and settings for a single circuit
+// PERSEUS_<COMMAND>_<SETTING>, where SETTING is the upper-cased JSON key of the setting, e.g.
+//
+//	PERSEUS_DEFAULT_MAX_CONCURRENT_REQUESTS=50
+//	PERSEUS_MY_COMMAND_TIMEOUT=500
+//
+// sets the timeout of the circuit "my_command": COMMAND is lower-cased to get the name of the circuit,
+// and ends before the longest SETTING the variable ends with. Circuits whose name has upper-case letters,
+// or characters other than letters, digits and underscores, are named by PERSEUS_<COMMAND>_NAME instead:
+//
+//	PERSEUS_PAYMENTS_NAME=Payments-API.v2
+//	PERSEUS_PAYMENTS_TIMEOUT=500
+//
+// sets the timeout of the circuit "Payments-API.v2". Lists, such as TRIP_STRATEGIES, are separated by commas.
+//
+// Environment variables take precedence over config files and settings given in code, but not over flags.
+// Variables starting with EnvPrefix which name no setting are logged and skipped. It returns an error,
+// and changes nothing, if a value is invalid or if the settings of any circuit would be invalid.
+func LoadEnv() error {
+	l, err := parseEnv(os.Environ())
+	if err != nil {
+		return err
+	}
+	return applyLayer(sourceEnv, l)
+}
+
+// parseEnv reads the settings of the variables in environ, given as "NAME=value".
+func parseEnv(environ []string) (layer, error) {
+	// match the longest setting first, so that QUEUE_TIMEOUT is not read as TIMEOUT
+	keys := settingKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return len(keys[i]) > len(keys[j])
+	})
+
+	l := layer{commands: make(map[string]CommandConfig)}
+	names := make(map[string]string)
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, EnvPrefix)
+
+		if strings.HasSuffix(rest, envName) && len(rest) > len(envName) {
+			names[strings.ToLower(strings.TrimSuffix(rest, envName))] = value
+			continue
+		}
+
+		var command, key string
+		for _, k := range keys {
+			suffix := "_" + strings.ToUpper(k)
+			if strings.HasSuffix(rest, suffix) && len(rest) > len(suffix) {
+				command, key = strings.ToLower(strings.TrimSuffix(rest, suffix)), k
+				break
+			}
+		}
+		if key == "" {
+			logging.GetLogger().Warn("unknown setting in environment variable", "variable", name)
+			continue
+		}
+
+		if command == envDefault {
+			if err := setSetting(&l.defaults, key, value); err != nil {
+				return layer{}, fmt.Errorf("%s: %w", name, err)
+			}
+			continue
+		}
+		config := l.commands[command]
+		if err := setSetting(&config, key, value); err != nil {
+			return layer{}, fmt.Errorf("%s: %w", name, err)
+		}
+		l.commands[command] = config
+	}
+
+	if _, ok := names[envDefault]; ok {
+		logging.GetLogger().Warn("the defaults cannot be named", "variable", EnvPrefix+strings.ToUpper(envDefault)+envName)
+	}
+	commands := make(map[string]CommandConfig, len(l.commands))
+	for command, config := range l.commands {
+		name := command
+		if n, ok := names[command]; ok {
+			name = n
+		}
+		if _, ok := commands[name]; ok {
+			return layer{}, fmt.Errorf("circuit %q is configured under two names", name)
+		}
+		commands[name] = config
+	}
+	l.commands = commands
+	return l, nil
+}
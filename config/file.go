@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/xiaoyisha/Perseus/logging"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is the document read by LoadFile: settings for every circuit under "default",
+// and settings for single circuits under "commands", e.g. in YAML:
+//
+//	default:
+//	  timeout: 1000
+//	commands:
+//	  my_command:
+//	    max_concurrent_requests: 50
+//
+// Keys are those of the JSON tags of CommandConfig, in both formats.
+type File struct {
+	Default  CommandConfig            `json:"default"`
+	Commands map[string]CommandConfig `json:"commands"`
+}
+
+// LoadFile reads the JSON or YAML document at path, chosen by its extension, and applies it.
+// Nothing is applied if the document cannot be read, holds unknown keys or invalid settings.
+// Settings given by the file take precedence over those given in code, but not over environment variables or flags.
+func LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := parseFile(path, data)
+	if err != nil {
+		return err
+	}
+	return applyFile(f)
+}
+
+// parseFile decodes data in the format given by the extension of path.
+// YAML is converted to JSON first, so that both formats share the keys of the JSON tags.
+func parseFile(path string, data []byte) (*File, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown config file format %q", path, filepath.Ext(path))
+	}
+
+	f := &File{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// applyFile replaces the settings given by the previous file with those of f.
+// Circuits removed from the file go back to the settings given by the other sources.
+func applyFile(f *File) error {
+	return applyLayer(sourceFile, layer{defaults: f.Default, commands: f.Commands})
+}
+
+// FileWatcher reloads a config file whenever its content changes.
+type FileWatcher struct {
+	path     string
+	interval time.Duration
+	last     []byte
+
+	done chan struct{}
+	once sync.Once
+}
+
+// WatchFile loads the config file at path, then checks it every interval and applies it again when it changes.
+// A document which cannot be read is logged and skipped, leaving the config of the circuits as it was.
+func WatchFile(path string, interval time.Duration) (*FileWatcher, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyFile(f); err != nil {
+		return nil, err
+	}
+
+	w := &FileWatcher{
+		path:     path,
+		interval: interval,
+		last:     data,
+		done:     make(chan struct{}),
+	}
+	go w.watch()
+	return w, nil
+}
+
+func (w *FileWatcher) watch() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.reload()
+		}
+	}
+}
+
+func (w *FileWatcher) reload() {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		logging.GetLogger().Error("failed to read config file", "path", w.path, "error", err)
+		return
+	}
+	if bytes.Equal(data, w.last) {
+		return
+	}
+	w.last = data
+
+	f, err := parseFile(w.path, data)
+	if err == nil {
+		logging.GetLogger().Info("reloading config file", "path", w.path)
+		err = applyFile(f)
+	}
+	if err != nil {
+		logging.GetLogger().Error("rejected config file", "path", w.path, "error", err)
+	}
+}
+
+// Stop stops watching the file. The config already applied is kept.
+func (w *FileWatcher) Stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
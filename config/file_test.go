@@ -0,0 +1,152 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	defer applyFile(&File{})
+
+	Convey("given a JSON config file with a default section", t, func() {
+		path := filepath.Join(t.TempDir(), "perseus.json")
+		writeFile(t, path, `{
+			"default": {"timeout": 300, "sleep_window": 2000},
+			"commands": {"file_json": {"timeout": 100, "max_concurrent_requests": 7}}
+		}`)
+
+		So(LoadFile(path), ShouldBeNil)
+
+		Convey("the command should use its own settings", func() {
+			So(GetCircuitConfig("file_json").Timeout, ShouldEqual, 100*time.Millisecond)
+			So(GetCircuitConfig("file_json").MaxConcurrentRequests, ShouldEqual, 7)
+		})
+
+		Convey("settings it leaves unset should come from the default section", func() {
+			So(GetCircuitConfig("file_json").SleepWindow, ShouldEqual, 2*time.Second)
+			So(GetCircuitConfig("file_json_other").Timeout, ShouldEqual, 300*time.Millisecond)
+		})
+
+		Convey("settings unset in both should use the package defaults", func() {
+			So(GetCircuitConfig("file_json").ErrorPercentThreshold, ShouldEqual, DefaultErrorPercentThreshold)
+		})
+	})
+
+	Convey("given a YAML config file", t, func() {
+		// registered by the circuit package, which implements it
+		RegisterTripStrategyName("consecutive_failures")
+		path := filepath.Join(t.TempDir(), "perseus.yaml")
+		writeFile(t, path, `
+default:
+  request_volume_threshold: 5
+commands:
+  file_yaml:
+    timeout: 250
+    trip_strategies: [error_percent, consecutive_failures]
+`)
+
+		So(LoadFile(path), ShouldBeNil)
+
+		Convey("it should read the same keys as JSON", func() {
+			So(GetCircuitConfig("file_yaml").Timeout, ShouldEqual, 250*time.Millisecond)
+			So(GetCircuitConfig("file_yaml").TripStrategies, ShouldResemble, []string{"error_percent", "consecutive_failures"})
+			So(GetCircuitConfig("file_yaml").RequestVolumeThreshold, ShouldEqual, uint64(5))
+		})
+	})
+
+	Convey("given an invalid config file", t, func() {
+		ConfigureCommand("file_invalid", CommandConfig{Timeout: Int(400)})
+		dir := t.TempDir()
+
+		Convey("unknown keys should be rejected and nothing applied", func() {
+			path := filepath.Join(dir, "perseus.json")
+			writeFile(t, path, `{"commands": {"file_invalid": {"timeout": 10, "timeot": 20}}}`)
+
+			So(LoadFile(path), ShouldNotBeNil)
+			So(GetCircuitConfig("file_invalid").Timeout, ShouldEqual, 400*time.Millisecond)
+		})
+
+		Convey("malformed documents should be rejected", func() {
+			path := filepath.Join(dir, "perseus.yml")
+			writeFile(t, path, "commands: [")
+
+			So(LoadFile(path), ShouldNotBeNil)
+			So(GetCircuitConfig("file_invalid").Timeout, ShouldEqual, 400*time.Millisecond)
+		})
+
+		Convey("settings out of range should be rejected", func() {
+			path := filepath.Join(dir, "perseus.yaml")
+			writeFile(t, path, "default:\n  error_percent_threshold: 150\ncommands:\n  file_invalid:\n    timeout: 10\n")
+
+			err := LoadFile(path)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "error_percent_threshold")
+			So(GetCircuitConfig("file_invalid").Timeout, ShouldEqual, 400*time.Millisecond)
+		})
+
+		Convey("explicit zeros should be kept", func() {
+			path := filepath.Join(dir, "perseus.json")
+			writeFile(t, path, `{"commands": {"file_invalid": {"request_volume_threshold": 0}}}`)
+
+			So(LoadFile(path), ShouldBeNil)
+			So(GetCircuitConfig("file_invalid").RequestVolumeThreshold, ShouldEqual, uint64(0))
+		})
+
+		Convey("unknown formats should be rejected", func() {
+			path := filepath.Join(dir, "perseus.toml")
+			writeFile(t, path, "")
+
+			So(LoadFile(path), ShouldNotBeNil)
+		})
+	})
+}
+
+func TestWatchFile(t *testing.T) {
+	defer applyFile(&File{})
+
+	Convey("given a watched config file", t, func() {
+		retryable := func(error) bool { return false }
+		ConfigureCommand("file_watched", CommandConfig{Retryable: retryable})
+
+		path := filepath.Join(t.TempDir(), "perseus.json")
+		writeFile(t, path, `{"commands": {"file_watched": {"timeout": 100}, "file_removed": {"timeout": 200}}}`)
+
+		w, err := WatchFile(path, 10*time.Millisecond)
+		So(err, ShouldBeNil)
+		defer w.Stop()
+
+		So(GetCircuitConfig("file_watched").Timeout, ShouldEqual, 100*time.Millisecond)
+
+		Convey("changes to the file should be applied", func() {
+			writeFile(t, path, `{"commands": {"file_watched": {"timeout": 150}}}`)
+			time.Sleep(100 * time.Millisecond)
+
+			So(GetCircuitConfig("file_watched").Timeout, ShouldEqual, 150*time.Millisecond)
+
+			Convey("settings which cannot be written in the file should be kept", func() {
+				So(GetCircuitConfig("file_watched").Retryable, ShouldNotBeNil)
+			})
+
+			Convey("commands removed from the file should go back to the defaults", func() {
+				So(GetCircuitConfig("file_removed").Timeout, ShouldEqual, time.Duration(DefaultTimeout)*time.Millisecond)
+			})
+		})
+
+		Convey("an invalid document should leave the config as it was", func() {
+			writeFile(t, path, `{"commands": {"file_watched": {"timeout": "fast"}}}`)
+			time.Sleep(100 * time.Millisecond)
+
+			So(GetCircuitConfig("file_watched").Timeout, ShouldEqual, 100*time.Millisecond)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+// Flags holds the settings given by the flags defined with RegisterFlags, until they are applied.
+type Flags struct {
+	mutex *sync.Mutex
+	layer layer
+}
+
+// RegisterFlags defines on fs a flag for each setting of the defaults and of the given commands,
+// named after the JSON keys of CommandConfig:
+//
+//	-perseus.default.max_concurrent_requests=50 -perseus.my_command.timeout=500
+//
+// Only the flags given on the command line are applied, by calling Apply once fs is parsed.
+// Flags take precedence over every other source of settings.
+func RegisterFlags(fs *flag.FlagSet, commands ...string) *Flags {
+	f := &Flags{
+		mutex: &sync.Mutex{},
+		layer: layer{commands: make(map[string]CommandConfig)},
+	}
+
+	for _, key := range settingKeys() {
+		fs.Var(&settingFlag{flags: f, key: key, isDefault: true}, "perseus.default."+key,
+			fmt.Sprintf("%s of every circuit", key))
+		for _, command := range commands {
+			fs.Var(&settingFlag{flags: f, command: command, key: key}, "perseus."+command+"."+key,
+				fmt.Sprintf("%s of the circuit %q", key, command))
+		}
+	}
+	return f
+}
+
+// Apply applies the settings given by the flags, replacing those applied before.
+// It returns an error, and changes nothing, if the settings of any circuit would be invalid.
+func (f *Flags) Apply() error {
+	f.mutex.Lock()
+	l := layer{defaults: f.layer.defaults, commands: make(map[string]CommandConfig, len(f.layer.commands))}
+	for name, config := range f.layer.commands {
+		l.commands[name] = config
+	}
+	f.mutex.Unlock()
+
+	return applyLayer(sourceFlags, l)
+}
+
+// settingFlag is the flag.Value of one setting, parsed into the settings held by Flags.
+type settingFlag struct {
+	flags     *Flags
+	command   string
+	isDefault bool
+	key       string
+	value     string
+}
+
+func (s *settingFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.value
+}
+
+func (s *settingFlag) Set(value string) error {
+	s.flags.mutex.Lock()
+	defer s.flags.mutex.Unlock()
+
+	if s.isDefault {
+		if err := setSetting(&s.flags.layer.defaults, s.key, value); err != nil {
+			return err
+		}
+	} else {
+		config := s.flags.layer.commands[s.command]
+		if err := setSetting(&config, s.key, value); err != nil {
+			return err
+		}
+		s.flags.layer.commands[s.command] = config
+	}
+	s.value = value
+	return nil
+}
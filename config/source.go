@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"github.com/xiaoyisha/Perseus/logging"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sources of settings, from the lowest precedence to the highest.
+const (
+	sourceCode = iota
+	sourceFile
+	sourceEnv
+	sourceFlags
+	numSources
+)
+
+// A layer holds the settings given by one source: for every circuit, and for single circuits.
+type layer struct {
+	defaults CommandConfig
+	commands map[string]CommandConfig
+}
+
+// layers holds the settings of every source, guarded by configMutex. The settings of a circuit are
+// those it is given by any source, in order of precedence, then the defaults given by any source.
+var layers [numSources]layer
+
+// withCommand returns a copy of the layer with the settings of a circuit replaced.
+func (l layer) withCommand(name string, config CommandConfig) layer {
+	commands := make(map[string]CommandConfig, len(l.commands)+1)
+	for k, v := range l.commands {
+		commands[k] = v
+	}
+	commands[name] = config
+	l.commands = commands
+	return l
+}
+
+// settingsOf merges the settings of a circuit, and the defaults, given by the sources.
+func settingsOf(name string, ls *[numSources]layer) (CommandConfig, CommandConfig) {
+	var command, defaults CommandConfig
+	for source := numSources - 1; source >= 0; source-- {
+		command = withDefaults(command, ls[source].commands[name])
+		defaults = withDefaults(defaults, ls[source].defaults)
+	}
+	return command, defaults
+}
+
+// resolveLayers validates and computes the config of a circuit from the settings of the sources.
+func resolveLayers(name string, ls *[numSources]layer) (*Config, error) {
+	command, defaults := settingsOf(name, ls)
+	return resolve(name, command, defaults)
+}
+
+// resolveAll computes the config of every circuit known so far, or named by a source.
+// It must be called with configMutex held.
+func resolveAll(ls *[numSources]layer) (map[string]*Config, error) {
+	configs := make(map[string]*Config, len(circuitConfig))
+	add := func(name string) error {
+		if _, ok := configs[name]; ok {
+			return nil
+		}
+		c, err := resolveLayers(name, ls)
+		if err != nil {
+			return err
+		}
+		configs[name] = c
+		return nil
+	}
+
+	for name := range circuitConfig {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range ls {
+		for name := range l.commands {
+			if err := add(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return configs, nil
+}
+
+// applyLayer replaces the settings given by a source in one step, then logs the settings which changed
+// and notifies the OnChange hooks. It returns an error, and changes nothing, if the settings of any
+// circuit would be invalid.
+func applyLayer(source int, l layer) error {
+	added, replaced, changes, err := swapLayer(source, l)
+	if err != nil {
+		return err
+	}
+	notifyChange(replaced)
+
+	sort.Strings(added)
+	for _, name := range added {
+		logging.GetLogger().Info("circuit configured", "circuit", name)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return fmt.Sprint(changes[i]) < fmt.Sprint(changes[j])
+	})
+	for _, change := range changes {
+		logging.GetLogger().Info("config changed", change...)
+	}
+	return nil
+}
+
+// swapLayer computes the configs of all circuits with the settings of the source replaced and,
+// if they are all valid, replaces the current ones. It returns the circuits added, those whose config
+// was replaced, and the settings changed.
+func swapLayer(source int, l layer) ([]string, []string, [][]interface{}, error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	if err := l.defaults.Validate(); err != nil {
+		return nil, nil, nil, fmt.Errorf("default config: %w", err)
+	}
+	next := layers
+	next[source] = l
+	configs, err := resolveAll(&next)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var added []string
+	var changes [][]interface{}
+	for name, config := range configs {
+		if circuitConfig[name] == nil {
+			added = append(added, name)
+			continue
+		}
+		for _, change := range diffConfig(circuitConfig[name], config) {
+			changes = append(changes, append([]interface{}{"circuit", name}, change...))
+		}
+	}
+
+	replaced := changedNames(configs)
+	layers = next
+	circuitConfig = configs
+	lookedUpConfig = make(map[string]*Config)
+	return added, replaced, changes, nil
+}
+
+// diffConfig lists the settings which differ between before and after as key value pairs.
+// Functions and loggers are not compared.
+func diffConfig(before *Config, after *Config) [][]interface{} {
+	b := reflect.ValueOf(before).Elem()
+	a := reflect.ValueOf(after).Elem()
+
+	var changes [][]interface{}
+	for i := 0; i < a.NumField(); i++ {
+		switch a.Field(i).Kind() {
+		case reflect.Func, reflect.Interface:
+			continue
+		}
+		if !reflect.DeepEqual(b.Field(i).Interface(), a.Field(i).Interface()) {
+			changes = append(changes, []interface{}{
+				"setting", a.Type().Field(i).Name,
+				"from", b.Field(i).Interface(),
+				"to", a.Field(i).Interface(),
+			})
+		}
+	}
+	return changes
+}
+
+// settingKeys returns the JSON keys of the settings of a CommandConfig which can be given as text.
+func settingKeys() []string {
+	t := reflect.TypeOf(CommandConfig{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("json"); key != "-" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// setSetting parses value into the setting of config with the given JSON key.
+// Lists are separated by commas.
+func setSetting(config *CommandConfig, key string, value string) error {
+	c := reflect.ValueOf(config).Elem()
+	for i := 0; i < c.NumField(); i++ {
+		if c.Type().Field(i).Tag.Get("json") != key || key == "-" {
+			continue
+		}
+
+		field := c.Field(i)
+		switch field.Interface().(type) {
+		case *int:
+			v, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", key, value, err)
+			}
+			field.Set(reflect.ValueOf(&v))
+		case *float64:
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", key, value, err)
+			}
+			field.Set(reflect.ValueOf(&v))
+		case string:
+			field.SetString(value)
+		case []string:
+			field.Set(reflect.ValueOf(strings.Split(value, ",")))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %q", key)
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"github.com/xiaoyisha/Perseus/logging"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLoadEnv(t *testing.T) {
+	defer applyLayer(sourceEnv, layer{})
+
+	Convey("given settings in environment variables", t, func() {
+		// registered by the circuit package, which implements it
+		RegisterTripStrategyName("slow_call_rate")
+		t.Setenv("PERSEUS_DEFAULT_MAX_CONCURRENT_REQUESTS", "30")
+		t.Setenv("PERSEUS_ENV_COMMAND_TIMEOUT", "250")
+		t.Setenv("PERSEUS_ENV_COMMAND_QUEUE_TIMEOUT", "20")
+		t.Setenv("PERSEUS_ENV_COMMAND_TRIP_STRATEGIES", "error_percent,slow_call_rate")
+		So(LoadEnv(), ShouldBeNil)
+
+		Convey("the settings of the command should be applied to its lower-cased name", func() {
+			So(GetCircuitConfig("env_command").Timeout, ShouldEqual, 250*time.Millisecond)
+			So(GetCircuitConfig("env_command").QueueTimeout, ShouldEqual, 20*time.Millisecond)
+			So(GetCircuitConfig("env_command").TripStrategies, ShouldResemble, []string{"error_percent", "slow_call_rate"})
+		})
+
+		Convey("the default settings should be applied to every circuit", func() {
+			So(GetCircuitConfig("env_command").MaxConcurrentRequests, ShouldEqual, 30)
+			So(GetCircuitConfig("env_other").MaxConcurrentRequests, ShouldEqual, 30)
+		})
+	})
+
+	Convey("given invalid environment variables", t, func() {
+		So(ConfigureCommand("env_invalid", CommandConfig{Timeout: Int(400)}), ShouldBeNil)
+
+		Convey("unknown settings should be logged and skipped", func() {
+			var buf bytes.Buffer
+			logging.SetLogger(logging.NewSlogHandlerLogger(slog.NewTextHandler(&buf, nil)))
+			defer logging.SetLogger(nil)
+
+			t.Setenv("PERSEUS_ENV_INVALID_TIMEOT", "10")
+			t.Setenv("PERSEUS_ENV_INVALID_SLEEP_WINDOW", "300")
+			So(LoadEnv(), ShouldBeNil)
+			So(buf.String(), ShouldContainSubstring, "PERSEUS_ENV_INVALID_TIMEOT")
+			So(GetCircuitConfig("env_invalid").SleepWindow, ShouldEqual, 300*time.Millisecond)
+		})
+
+		Convey("values which are not numbers should be rejected", func() {
+			t.Setenv("PERSEUS_ENV_INVALID_TIMEOUT", "fast")
+			So(LoadEnv(), ShouldNotBeNil)
+			So(GetCircuitConfig("env_invalid").Timeout, ShouldEqual, 400*time.Millisecond)
+		})
+
+		Convey("values out of range should be rejected", func() {
+			t.Setenv("PERSEUS_ENV_INVALID_TIMEOUT", "-10")
+			So(LoadEnv(), ShouldNotBeNil)
+			So(GetCircuitConfig("env_invalid").Timeout, ShouldEqual, 400*time.Millisecond)
+		})
+	})
+}
+
+func TestLoadEnvNames(t *testing.T) {
+	defer applyLayer(sourceEnv, layer{})
+
+	Convey("given settings for a command named by a variable", t, func() {
+		t.Setenv("PERSEUS_PAYMENTS_NAME", "Payments-API.v2")
+		t.Setenv("PERSEUS_PAYMENTS_TIMEOUT", "300")
+		So(LoadEnv(), ShouldBeNil)
+
+		Convey("the settings should be applied to the circuit with that exact name", func() {
+			So(GetCircuitConfig("Payments-API.v2").Timeout, ShouldEqual, 300*time.Millisecond)
+			So(GetCircuitConfig("payments").Timeout, ShouldEqual, time.Duration(DefaultTimeout)*time.Millisecond)
+		})
+
+		Convey("naming another command the same should be rejected", func() {
+			t.Setenv("PERSEUS_PAYMENTS_V2_NAME", "Payments-API.v2")
+			t.Setenv("PERSEUS_PAYMENTS_V2_TIMEOUT", "400")
+			So(LoadEnv(), ShouldNotBeNil)
+			So(GetCircuitConfig("Payments-API.v2").Timeout, ShouldEqual, 300*time.Millisecond)
+		})
+	})
+
+	Convey("the command of a variable should end before the longest setting it ends with", t, func() {
+		l, err := parseEnv([]string{"PERSEUS_SEARCH_QUEUE_TIMEOUT=20", "PERSEUS_SEARCH_TIMEOUT=30"})
+		So(err, ShouldBeNil)
+		So(l.commands, ShouldHaveLength, 1)
+		So(*l.commands["search"].QueueTimeout, ShouldEqual, 20)
+		So(*l.commands["search"].Timeout, ShouldEqual, 30)
+	})
+}
+
+func TestRegisterFlags(t *testing.T) {
+	defer applyLayer(sourceFlags, layer{})
+
+	Convey("given flags for a command", t, func() {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterFlags(fs, "flag_command")
+
+		So(fs.Parse([]string{"-perseus.flag_command.timeout=150", "-perseus.default.sleep_window=700"}), ShouldBeNil)
+		So(flags.Apply(), ShouldBeNil)
+
+		Convey("the flags given should be applied", func() {
+			So(GetCircuitConfig("flag_command").Timeout, ShouldEqual, 150*time.Millisecond)
+			So(GetCircuitConfig("flag_command").SleepWindow, ShouldEqual, 700*time.Millisecond)
+		})
+
+		Convey("the flags not given should leave the settings unset", func() {
+			So(GetCircuitConfig("flag_command").MaxConcurrentRequests, ShouldEqual, DefaultMaxConcurrent)
+		})
+	})
+
+	Convey("values which are not numbers should be rejected by the flag set", t, func() {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		RegisterFlags(fs, "flag_command")
+
+		So(fs.Parse([]string{"-perseus.flag_command.timeout=fast"}), ShouldNotBeNil)
+	})
+}
+
+func TestSourcePrecedence(t *testing.T) {
+	defer applyFile(&File{})
+	defer applyLayer(sourceEnv, layer{})
+	defer applyLayer(sourceFlags, layer{})
+	defer ConfigureCommand("layered", CommandConfig{})
+
+	Convey("given settings for a command in code, a file, the environment and flags", t, func() {
+		So(ConfigureCommand("layered", CommandConfig{
+			Timeout:               Int(100),
+			SleepWindow:           Int(100),
+			ErrorPercentThreshold: Int(10),
+			QueueSize:             Int(1),
+		}), ShouldBeNil)
+
+		path := filepath.Join(t.TempDir(), "perseus.json")
+		writeFile(t, path, `{"commands": {"layered": {"timeout": 200, "sleep_window": 200, "error_percent_threshold": 20}}}`)
+		So(LoadFile(path), ShouldBeNil)
+
+		t.Setenv("PERSEUS_LAYERED_TIMEOUT", "300")
+		t.Setenv("PERSEUS_LAYERED_SLEEP_WINDOW", "300")
+		So(LoadEnv(), ShouldBeNil)
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterFlags(fs, "layered")
+		So(fs.Parse([]string{"-perseus.layered.timeout=400"}), ShouldBeNil)
+		So(flags.Apply(), ShouldBeNil)
+
+		Convey("each setting should come from the source with the highest precedence setting it", func() {
+			So(GetCircuitConfig("layered").Timeout, ShouldEqual, 400*time.Millisecond)
+			So(GetCircuitConfig("layered").SleepWindow, ShouldEqual, 300*time.Millisecond)
+			So(GetCircuitConfig("layered").ErrorPercentThreshold, ShouldEqual, 20)
+			So(GetCircuitConfig("layered").QueueSize, ShouldEqual, 1)
+		})
+
+		Convey("configuring the command in code should not override the other sources", func() {
+			So(ConfigureCommand("layered", CommandConfig{Timeout: Int(50), HalfOpenMaxRequests: Int(3)}), ShouldBeNil)
+			So(GetCircuitConfig("layered").Timeout, ShouldEqual, 400*time.Millisecond)
+			So(GetCircuitConfig("layered").HalfOpenMaxRequests, ShouldEqual, 3)
+		})
+
+		Convey("removing the command from the file should fall back to its settings in code", func() {
+			writeFile(t, path, `{}`)
+			So(LoadFile(path), ShouldBeNil)
+			So(GetCircuitConfig("layered").ErrorPercentThreshold, ShouldEqual, 10)
+		})
+	})
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A nameSet holds the names accepted by Validate for a setting, registered by the package implementing them.
+type nameSet struct {
+	mutex *sync.RWMutex
+	names map[string]bool
+}
+
+func newNameSet(names ...string) *nameSet {
+	s := &nameSet{mutex: &sync.RWMutex{}, names: make(map[string]bool)}
+	for _, name := range names {
+		s.add(name)
+	}
+	return s
+}
+
+func (s *nameSet) add(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.names[name] = true
+}
+
+func (s *nameSet) has(name string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.names[name]
+}
+
+func (s *nameSet) list() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	return names
+}
+
+var (
+	// tripStrategyNames holds the trip strategies accepted by Validate: the default one, those registered
+	// by the circuit package, which implements them, and those registered with circuit.RegisterTripStrategy.
+	tripStrategyNames = newNameSet(DefaultTripStrategy)
+	// concurrencyLimiterNames holds the concurrency limiters accepted by Validate: the default one,
+	// and those registered by the circuit package, which implements them.
+	concurrencyLimiterNames = newNameSet(DefaultConcurrencyLimiter)
+	// rateLimiterNames holds the rate limiters accepted by Validate: the default one,
+	// and those registered by the circuit package, which implements them.
+	rateLimiterNames = newNameSet(DefaultRateLimiter)
+)
+
+// RegisterTripStrategyName makes Validate accept kind as a trip strategy.
+// It is called by the circuit package for each trip strategy it implements, and by circuit.RegisterTripStrategy.
+func RegisterTripStrategyName(kind string) {
+	tripStrategyNames.add(kind)
+}
+
+// RegisterConcurrencyLimiterName makes Validate accept kind as a concurrency limiter.
+// It is called by the circuit package for each concurrency limiter it implements.
+func RegisterConcurrencyLimiterName(kind string) {
+	concurrencyLimiterNames.add(kind)
+}
+
+// RegisterRateLimiterName makes Validate accept kind as a rate limiter.
+// It is called by the circuit package for each rate limiter it implements.
+func RegisterRateLimiterName(kind string) {
+	rateLimiterNames.add(kind)
+}
+
+// isComposite reports whether the trip strategy combines those listed in TripStrategies.
+func isComposite(kind string) bool {
+	return kind == "any" || kind == "all"
+}
+
+// A ValidationError describes a setting of a CommandConfig which is out of range.
+type ValidationError struct {
+	// Setting is the JSON key of the setting
+	Setting string
+	Value   interface{}
+	// Reason tells which values are accepted
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s %v: must be %s", e.Setting, e.Value, e.Reason)
+}
+
+// Validate checks the settings which are set, and returns a ValidationError for each one out of range,
+// joined into a single error.
+func (config CommandConfig) Validate() error {
+	var errs []error
+	check := func(setting string, value *int, min int, max int, reason string) {
+		if value != nil && (*value < min || *value > max) {
+			errs = append(errs, &ValidationError{Setting: setting, Value: *value, Reason: reason})
+		}
+	}
+	const (
+		maxInt   = int(^uint(0) >> 1)
+		positive = "greater than 0"
+		natural  = "0 or greater"
+		percent  = "between 0 and 100"
+		// a circuit is healthy while its error percent is below the threshold, so none is healthy below 1
+		positivePercent = "between 1 and 100"
+	)
+
+	check("timeout", config.Timeout, 1, maxInt, positive)
+	check("max_concurrent_requests", config.MaxConcurrentRequests, 1, maxInt, positive)
+	check("min_concurrent_requests", config.MinConcurrentRequests, 1, maxInt, positive)
+	check("request_volume_threshold", config.RequestVolumeThreshold, 0, maxInt, natural)
+	check("sleep_window", config.SleepWindow, 0, maxInt, natural)
+	check("error_percent_threshold", config.ErrorPercentThreshold, 1, 100, positivePercent)
+	check("half_open_max_requests", config.HalfOpenMaxRequests, 1, maxInt, positive)
+	check("half_open_success_threshold", config.HalfOpenSuccessThreshold, 1, maxInt, positive)
+	check("consecutive_failure_threshold", config.ConsecutiveFailureThreshold, 1, maxInt, positive)
+	check("slow_call_duration", config.SlowCallDuration, 0, maxInt, natural)
+	check("slow_call_rate_threshold", config.SlowCallRateThreshold, 0, 100, percent)
+	check("retry_max_attempts", config.RetryMaxAttempts, 1, maxInt, positive)
+	check("retry_backoff", config.RetryBackoff, 0, maxInt, natural)
+	check("retry_max_backoff", config.RetryMaxBackoff, 0, maxInt, natural)
+	check("queue_size", config.QueueSize, 0, maxInt, natural)
+	check("queue_timeout", config.QueueTimeout, 0, maxInt, natural)
+	check("rate_limit", config.RateLimit, 1, maxInt, positive)
+	check("rate_limit_window", config.RateLimitWindow, 1, maxInt, positive)
+	check("rate_limit_burst", config.RateLimitBurst, 0, maxInt, natural)
+	check("hedge_delay", config.HedgeDelay, 0, maxInt, natural)
+	check("hedge_percent", config.HedgePercent, 0, 100, percent)
+	check("batch_window", config.BatchWindow, 0, maxInt, natural)
+	check("max_batch_size", config.MaxBatchSize, 1, maxInt, positive)
+	check("rolling_window", config.RollingWindow, 1, maxInt, positive)
+	check("rolling_window_buckets", config.RollingWindowBuckets, 1, maxInt, positive)
+	check("rolling_percentile_window", config.RollingPercentileWindow, 1, maxInt, positive)
+	check("rolling_percentile_window_buckets", config.RollingPercentileWindowBuckets, 1, maxInt, positive)
+
+	if kind := config.TripStrategy; kind != "" && !tripStrategyNames.has(kind) {
+		errs = append(errs, &ValidationError{Setting: "trip_strategy", Value: kind, Reason: oneOf(tripStrategyNames.list())})
+	}
+	for _, kind := range config.TripStrategies {
+		if !tripStrategyNames.has(kind) || isComposite(kind) {
+			errs = append(errs, &ValidationError{Setting: "trip_strategies", Value: kind, Reason: "a strategy other than any and all, " + oneOf(tripStrategyNames.list())})
+		}
+	}
+
+	if kind := config.ConcurrencyLimiter; kind != "" && !concurrencyLimiterNames.has(kind) {
+		errs = append(errs, &ValidationError{Setting: "concurrency_limiter", Value: kind, Reason: oneOf(concurrencyLimiterNames.list())})
+	}
+	if kind := config.RateLimiter; kind != "" && !rateLimiterNames.has(kind) {
+		errs = append(errs, &ValidationError{Setting: "rate_limiter", Value: kind, Reason: oneOf(rateLimiterNames.list())})
+	}
+
+	if m := config.RetryBackoffMultiplier; m != nil && !(*m >= 1) {
+		errs = append(errs, &ValidationError{Setting: "retry_backoff_multiplier", Value: *m, Reason: "1 or greater"})
+	}
+	if min, max := config.MinConcurrentRequests, config.MaxConcurrentRequests; min != nil && max != nil && *max > 0 && *min > *max {
+		errs = append(errs, &ValidationError{Setting: "min_concurrent_requests", Value: *min, Reason: "at most max_concurrent_requests"})
+	}
+	if w, b := config.RollingWindow, config.RollingWindowBuckets; w != nil && b != nil && *b > 0 && *w < *b {
+		errs = append(errs, &ValidationError{Setting: "rolling_window_buckets", Value: *b, Reason: "at most one per millisecond of rolling_window"})
+	}
+	if w, b := config.RollingPercentileWindow, config.RollingPercentileWindowBuckets; w != nil && b != nil && *b > 0 && *w < *b {
+		errs = append(errs, &ValidationError{Setting: "rolling_percentile_window_buckets", Value: *b, Reason: "at most one per millisecond of rolling_percentile_window"})
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateResolved checks the settings of a circuit once its defaults are applied: on top of Validate,
+// a composite trip strategy must list the strategies it combines, lest the circuit never trips.
+func (config CommandConfig) validateResolved() error {
+	err := config.Validate()
+	if isComposite(config.TripStrategy) && len(config.TripStrategies) == 0 {
+		err = errors.Join(err, &ValidationError{Setting: "trip_strategies", Value: config.TripStrategies,
+			Reason: fmt.Sprintf("set when trip_strategy is %q", config.TripStrategy)})
+	}
+	return err
+}
+
+// oneOf tells which of the given names are accepted.
+func oneOf(names []string) string {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return "one of " + strings.Join(names, ", ")
+}
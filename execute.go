@@ -0,0 +1,69 @@
+package Perseus
+
+import (
+	"context"
+)
+
+// Future is the pending result of a command started with ExecuteAsync.
+type Future[T any] struct {
+	done  chan struct{}
+	value T
+	err   error
+}
+
+// Execute runs your function like DoC, blocking until it returns, and hands its result back to you.
+// When the run function fails, times out or is rejected, the result of the fallback is returned instead.
+//
+// Metrics, timeouts, concurrency limits and retries are those of GoC: the value returned by a run
+// function which completes after the command timed out is discarded.
+func Execute[T any](ctx context.Context, name string, run func(context.Context) (T, error), fallback func(context.Context, error) (T, error), opts ...Option) (T, error) {
+	return ExecuteAsync(ctx, name, run, fallback, opts...).Get()
+}
+
+// ExecuteAsync runs your function like GoC and returns a Future for its result.
+func ExecuteAsync[T any](ctx context.Context, name string, run func(context.Context) (T, error), fallback func(context.Context, error) (T, error), opts ...Option) *Future[T] {
+	o := newOptions(opts)
+	if o.fallback != nil {
+		fallback = func(ctx context.Context, err error) (T, error) {
+			var zero T
+			return zero, o.fallback(ctx, err)
+		}
+	}
+
+	r := func(ctx context.Context) (interface{}, error) {
+		return run(ctx)
+	}
+	var f fallbackFunc
+	if fallback != nil {
+		f = func(ctx context.Context, err error) (interface{}, error) {
+			return fallback(ctx, err)
+		}
+	}
+
+	results := make(chan interface{}, 1)
+	errChan := goCommand(ctx, name, r, f, results, o)
+
+	future := &Future[T]{done: make(chan struct{})}
+	go func() {
+		select {
+		case result := <-results:
+			// a nil interface holds no T, leaving the zero value
+			future.value, _ = result.(T)
+		case err := <-errChan:
+			future.err = err
+		}
+		close(future.done)
+	}()
+	return future
+}
+
+// Get blocks until the command has finished and returns its result.
+func (f *Future[T]) Get() (T, error) {
+	<-f.done
+	return f.value, f.err
+}
+
+// Done returns a channel closed once the command has finished, for use in a select statement.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
@@ -0,0 +1,111 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExecute(t *testing.T) {
+	Convey("with a command which returns a value", t, func() {
+		defer circuit.Flush()
+
+		value, err := Execute(context.Background(), "execute", func(ctx context.Context) (int, error) {
+			return 42, nil
+		}, nil)
+
+		Convey("the value is returned", func() {
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, 42)
+
+			Convey("metrics are recorded", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("execute")
+				So(cb.Metrics.DefaultCollector().Successes().Sum(time.Now()), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("with a command which fails and whose fallback returns a value", t, func() {
+		defer circuit.Flush()
+
+		value, err := Execute(context.Background(), "execute", func(ctx context.Context) (string, error) {
+			return "", fmt.Errorf("run failed")
+		}, func(ctx context.Context, err error) (string, error) {
+			return "fallback after " + err.Error(), nil
+		})
+
+		Convey("the value of the fallback is returned", func() {
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, "fallback after run failed")
+		})
+	})
+
+	Convey("with a command which times out", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("execute", config.CommandConfig{Timeout: config.Int(10)})
+		defer config.ConfigureCommand("execute", config.CommandConfig{})
+
+		value, err := Execute(context.Background(), "execute", func(ctx context.Context) (*int, error) {
+			time.Sleep(50 * time.Millisecond)
+			v := 1
+			return &v, nil
+		}, nil)
+
+		Convey("the timeout error is returned without a value", func() {
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(value, ShouldBeNil)
+		})
+	})
+}
+
+func TestExecuteAsync(t *testing.T) {
+	Convey("with a command started asynchronously", t, func() {
+		defer circuit.Flush()
+		release := make(chan struct{})
+
+		future := ExecuteAsync(context.Background(), "execute", func(ctx context.Context) ([]int, error) {
+			<-release
+			return []int{1, 2}, nil
+		}, nil)
+
+		Convey("the future is pending until the run returns", func() {
+			select {
+			case <-future.Done():
+				t.Fatal("future done before the run returned")
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			close(release)
+			value, err := future.Get()
+			So(err, ShouldBeNil)
+			So(value, ShouldResemble, []int{1, 2})
+		})
+	})
+
+	Convey("with a command retried until it succeeds", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("execute", config.CommandConfig{RetryMaxAttempts: config.Int(3), RetryBackoff: config.Int(1)})
+		defer config.ConfigureCommand("execute", config.CommandConfig{})
+
+		attempts := 0
+		value, err := ExecuteAsync(context.Background(), "execute", func(ctx context.Context) (int, error) {
+			attempts++
+			if attempts < 3 {
+				return 0, fmt.Errorf("attempt %d failed", attempts)
+			}
+			return attempts, nil
+		}, nil).Get()
+
+		Convey("the value of the last attempt is returned", func() {
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, 3)
+		})
+	})
+}
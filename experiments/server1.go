@@ -64,7 +64,7 @@ func connectServer12() error {
 // handleRequest1 the server1 handles a request from clients
 func handleRequest1(conn net.Conn, num int) {
 	// default timeout limit is 1 second, or you can configure by yourself as following
-	pconfig.ConfigureCommand("my_command", pconfig.CommandConfig{Timeout: 1000})
+	pconfig.ConfigureCommand("my_command", pconfig.CommandConfig{Timeout: pconfig.Int(1000)})
 	time.Sleep(10 * time.Second)
 	fmt.Println("accept num:", num)
 	clientInfo := make([]byte, 2048)
@@ -64,7 +64,7 @@ func main() {
 	fmt.Println("start time: ", beforeRun)
 
 	pconfig.ConfigureCommand("user", pconfig.CommandConfig{
-		MaxConcurrentRequests: userMaxReq,
+		MaxConcurrentRequests: pconfig.Int(userMaxReq),
 	})
 	for i := 0; i < userCurReq; i++ {
 		errors3 = perseus.Go("user", func() error {
@@ -102,7 +102,7 @@ func main() {
 	fmt.Println("start time: ", beforeRun)
 
 	pconfig.ConfigureCommand("order", pconfig.CommandConfig{
-		MaxConcurrentRequests: orderMaxReq,
+		MaxConcurrentRequests: pconfig.Int(orderMaxReq),
 	})
 	for i := 0; i < orderCurReq; i++ {
 		errors31 = perseus.Go("order", func() error {
@@ -57,7 +57,7 @@ func main() {
 	fmt.Println("start time: ", beforeRun)
 
 	pconfig.ConfigureCommand("order", pconfig.CommandConfig{
-		RequestVolumeThreshold: 6,
+		RequestVolumeThreshold: pconfig.Int(6),
 	})
 	for i := 0; i < orderCurReq; i++ {
 		errors5 = perseus.Go("order", func() error {
@@ -1,5 +1,13 @@
 module github.com/xiaoyisha/Perseus
 
-go 1.16
+go 1.21
 
-require github.com/smartystreets/goconvey v1.7.2
+require (
+	github.com/smartystreets/goconvey v1.7.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/smartystreets/assertions v1.2.0 // indirect
+)
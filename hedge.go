@@ -0,0 +1,125 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"Perseus/metrics"
+	"context"
+	"sync"
+	"time"
+)
+
+// attempt is what a run of a hedged command returned.
+type attempt struct {
+	result interface{}
+	err    error
+}
+
+// hedgedRun tracks the attempts of a hedged command. The command gives its own ticket back as usual
+// once it returns, and the ticket of the hedge is given back once both attempts have returned,
+// so that the pool counts every attempt still running.
+type hedgedRun struct {
+	sync.Mutex
+
+	pool     *circuit.ExecutorPool
+	running  int
+	ticket   *struct{}
+	attempts chan attempt
+}
+
+// start runs an attempt in its own goroutine, and sends what it returned to attempts.
+func (h *hedgedRun) start(ctx context.Context, run runFunc) {
+	go func() {
+		result, err := run(ctx)
+
+		h.Lock()
+		h.running--
+		if h.running == 0 && h.ticket != nil {
+			h.pool.ReturnTicket(h.ticket)
+		}
+		h.Unlock()
+		h.attempts <- attempt{result: result, err: err}
+	}()
+}
+
+// runHedged runs the command and, if it has not returned after the hedge delay, starts a second attempt.
+// A first attempt which fails before the delay is hedged at once. It returns the result of the first
+// attempt to succeed, cancelling the context of the other one, or the error of the last attempt once
+// every attempt started has failed.
+func (c *Command) runHedged(ctx context.Context) (interface{}, error) {
+	delay := c.hedgeDelay()
+	if delay <= 0 {
+		return c.run(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	h := &hedgedRun{pool: c.pool, running: 1, attempts: make(chan attempt, 2)}
+	h.start(ctx, c.run)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	hedged := false
+	var a attempt
+	for pending > 0 {
+		select {
+		case a = <-h.attempts:
+			pending--
+			if a.err == nil {
+				return a.result, nil
+			}
+		case <-timer.C:
+		}
+		if !hedged {
+			hedged = true
+			if c.hedge(ctx, h) {
+				pending++
+			}
+		}
+	}
+	return a.result, a.err
+}
+
+// hedge starts the second attempt of the command, if the pool has a ticket left for it and
+// the circuit allows one more hedge. It reports whether the attempt was started.
+func (c *Command) hedge(ctx context.Context, h *hedgedRun) bool {
+	ticket := c.pool.TryAcquireTicket()
+	if ticket == nil {
+		return false
+	}
+	if !c.circuitBreaker.AllowHedge() {
+		c.pool.ReturnTicket(ticket)
+		return false
+	}
+
+	h.Lock()
+	h.running++
+	h.ticket = ticket
+	h.Unlock()
+
+	config.GetLogger(c.name).Debug("hedging command", "circuit", c.name)
+	c.reportHedgeEvent()
+	h.start(ctx, c.run)
+	return true
+}
+
+// hedgeDelay returns how long the first attempt runs before the command is hedged, or 0 if the
+// circuit has measured no run duration to hedge after yet.
+func (c *Command) hedgeDelay() time.Duration {
+	if c.options.hedgeDelay > 0 {
+		return c.options.hedgeDelay
+	}
+	if delay := config.GetCircuitConfig(c.name).HedgeDelay; delay > 0 {
+		return delay
+	}
+	return c.circuitBreaker.Metrics.DefaultCollector().RunDuration().PercentileDuration(95)
+}
+
+// reportHedgeEvent records that a hedged attempt was started alongside the run.
+func (c *Command) reportHedgeEvent() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.outcome.Hedge = metrics.EventHedged
+}
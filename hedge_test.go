@@ -0,0 +1,179 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"context"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// slowFirst returns a run function whose first attempt blocks until its context is canceled,
+// and whose next attempts return at once.
+func slowFirst(attempts *int32, canceled chan struct{}) RunFuncC {
+	return func(ctx context.Context) error {
+		if atomic.AddInt32(attempts, 1) == 1 {
+			<-ctx.Done()
+			close(canceled)
+			return ctx.Err()
+		}
+		return nil
+	}
+}
+
+func TestHedging(t *testing.T) {
+	Convey("with a circuit allowing a hedge for every request", t, func() {
+		defer circuit.Flush()
+		defer config.ConfigureCommand("hedged", config.CommandConfig{})
+		config.ConfigureCommand("hedged", config.CommandConfig{HedgePercent: config.Int(100), MaxConcurrentRequests: config.Int(2)})
+		var attempts int32
+		canceled := make(chan struct{})
+
+		Convey("a slow command should return the result of its hedge", func() {
+			start := time.Now()
+			err := DoC(context.Background(), "hedged", slowFirst(&attempts, canceled), nil, WithHedging(20*time.Millisecond))
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, 500*time.Millisecond)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 2)
+
+			Convey("and cancel its first attempt", func() {
+				select {
+				case <-canceled:
+				case <-time.After(time.Second):
+					t.Fatal("first attempt was not canceled")
+				}
+			})
+
+			Convey("and give back the tickets of both attempts", func() {
+				<-canceled
+				time.Sleep(10 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("hedged")
+				So(cb.ExecutorPool.ActiveCount(), ShouldEqual, 0)
+			})
+
+			Convey("and be recorded as hedged", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("hedged")
+				So(cb.Metrics.DefaultCollector().Hedges().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().Successes().Sum(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("a command whose first attempt fails fast should return the result of its hedge", func() {
+			start := time.Now()
+			err := DoC(context.Background(), "hedged", func(ctx context.Context) error {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					return errors.New("foo")
+				}
+				return nil
+			}, nil, WithHedging(50*time.Millisecond))
+			So(err, ShouldBeNil)
+			So(time.Since(start), ShouldBeLessThan, 50*time.Millisecond)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 2)
+
+			Convey("and be recorded as a hedged success", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("hedged")
+				So(cb.Metrics.DefaultCollector().Hedges().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().Successes().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 0)
+				So(cb.ExecutorPool.ActiveCount(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("a command whose attempts both fail should fail", func() {
+			errFoo := errors.New("foo")
+			err := DoC(context.Background(), "hedged", func(ctx context.Context) error {
+				atomic.AddInt32(&attempts, 1)
+				return errFoo
+			}, nil, WithHedging(20*time.Millisecond))
+			So(errors.Is(err, errFoo), ShouldBeTrue)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 2)
+		})
+
+		Convey("a command returning before the delay should not be hedged", func() {
+			err := DoC(context.Background(), "hedged", func(ctx context.Context) error {
+				atomic.AddInt32(&attempts, 1)
+				return nil
+			}, nil, WithHedging(100*time.Millisecond))
+			So(err, ShouldBeNil)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+		})
+
+		Convey("a command whose first attempt succeeds after the timeout while its hedge fails should fail", func() {
+			cb, _, _ := circuit.GetCircuitBreaker("hedged")
+			goroutines := runtime.NumGoroutine()
+			errFoo := errors.New("foo")
+			errBar := errors.New("bar")
+			err := DoC(context.Background(), "hedged", func(ctx context.Context) error {
+				if atomic.AddInt32(&attempts, 1) == 1 {
+					time.Sleep(50 * time.Millisecond)
+					return nil
+				}
+				time.Sleep(30 * time.Millisecond)
+				return errFoo
+			}, func(ctx context.Context, err error) error {
+				// still running when the first attempt succeeds
+				time.Sleep(50 * time.Millisecond)
+				return errBar
+			}, WithHedging(10*time.Millisecond), WithTimeout(30*time.Millisecond))
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(errors.Is(err, errBar), ShouldBeTrue)
+
+			Convey("and record only the timeout", func() {
+				time.Sleep(100 * time.Millisecond)
+				So(atomic.LoadInt32(&attempts), ShouldEqual, 2)
+				So(cb.Metrics.DefaultCollector().Timeouts().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().FallbackFailures().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().Successes().Sum(time.Now()), ShouldEqual, 0)
+				So(cb.Metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 0)
+				So(cb.ExecutorPool.ActiveCount(), ShouldEqual, 0)
+			})
+
+			Convey("and leave no goroutine behind", func() {
+				So(waitForGoroutines(goroutines, time.Second), ShouldBeLessThanOrEqualTo, goroutines)
+			})
+		})
+
+		Convey("a command should not be hedged when the pool has no ticket left for it", func() {
+			config.ConfigureCommand("hedged", config.CommandConfig{HedgePercent: config.Int(100), MaxConcurrentRequests: config.Int(1)})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := DoC(ctx, "hedged", slowFirst(&attempts, canceled), nil,
+				WithHedging(20*time.Millisecond), WithTimeout(100*time.Millisecond))
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+		})
+
+		Convey("a command should not be hedged past the hedge percent of the circuit", func() {
+			config.ConfigureCommand("hedged", config.CommandConfig{HedgePercent: config.Int(0), MaxConcurrentRequests: config.Int(2)})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err := DoC(ctx, "hedged", slowFirst(&attempts, canceled), nil,
+				WithHedging(20*time.Millisecond), WithTimeout(100*time.Millisecond))
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+		})
+	})
+
+	Convey("hedges should be capped to a percent of the requests of the circuit", t, func() {
+		defer circuit.Flush()
+		defer config.ConfigureCommand("hedge_budget", config.CommandConfig{})
+		config.ConfigureCommand("hedge_budget", config.CommandConfig{HedgePercent: config.Int(50)})
+		cb, _, _ := circuit.GetCircuitBreaker("hedge_budget")
+
+		So(cb.AllowHedge(), ShouldBeFalse)
+		for i := 0; i < 3; i++ {
+			So(Do("hedge_budget", func() error { return nil }, nil), ShouldBeNil)
+		}
+		time.Sleep(100 * time.Millisecond)
+		So(cb.AllowHedge(), ShouldBeTrue)
+		So(cb.AllowHedge(), ShouldBeTrue)
+		So(cb.AllowHedge(), ShouldBeFalse)
+	})
+}
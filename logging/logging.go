@@ -0,0 +1,52 @@
+// Package logging defines the Logger used by circuits and commands to report what they do.
+//
+// Nothing is logged by default. Install a logger for every circuit with SetLogger, or for a single
+// command through the Logger field of config.CommandConfig:
+//
+//	logging.SetLogger(logging.NewSlogLogger(slog.Default()))
+package logging
+
+import (
+	"sync/atomic"
+)
+
+// Logger is a leveled logger taking a message and alternating key/value pairs, e.g.
+//
+//	logger.Warn("opening circuit", "circuit", name, "error_percent", 60)
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// NoopLogger discards everything. It is the default Logger.
+type NoopLogger struct{}
+
+func (NoopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (NoopLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (NoopLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (NoopLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+type loggerHolder struct {
+	logger Logger
+}
+
+var globalLogger atomic.Value
+
+func init() {
+	globalLogger.Store(loggerHolder{NoopLogger{}})
+}
+
+// SetLogger sets the logger used by circuits without a logger of their own. A nil logger restores the NoopLogger.
+func SetLogger(logger Logger) {
+	if logger == nil {
+		logger = NoopLogger{}
+	}
+	globalLogger.Store(loggerHolder{logger})
+}
+
+// GetLogger returns the logger set with SetLogger.
+func GetLogger() Logger {
+	return globalLogger.Load().(loggerHolder).logger
+}
@@ -0,0 +1,47 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGlobalLogger(t *testing.T) {
+	Convey("when no logger was set", t, func() {
+		Convey("the NoopLogger is used", func() {
+			So(GetLogger(), ShouldHaveSameTypeAs, NoopLogger{})
+		})
+	})
+
+	Convey("when a logger is set", t, func() {
+		logger := NewSlogLogger(slog.Default())
+		SetLogger(logger)
+		defer SetLogger(nil)
+
+		Convey("it is returned by GetLogger", func() {
+			So(GetLogger(), ShouldEqual, logger)
+		})
+	})
+}
+
+func TestSlogLogger(t *testing.T) {
+	Convey("given a Logger adapting a slog text handler at info level", t, func() {
+		var buf bytes.Buffer
+		logger := NewSlogHandlerLogger(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+		Convey("messages below the level are dropped", func() {
+			logger.Debug("run failed", "circuit", "foo")
+			So(buf.String(), ShouldBeEmpty)
+		})
+
+		Convey("messages carry their level and key/value pairs", func() {
+			logger.Warn("opening circuit", "circuit", "foo", "error_percent", 60)
+			So(buf.String(), ShouldContainSubstring, "level=WARN")
+			So(buf.String(), ShouldContainSubstring, `msg="opening circuit"`)
+			So(buf.String(), ShouldContainSubstring, "circuit=foo")
+			So(buf.String(), ShouldContainSubstring, "error_percent=60")
+		})
+	})
+}
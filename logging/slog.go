@@ -0,0 +1,36 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger adapts a *slog.Logger to the Logger interface. Key/value pairs become slog attributes.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger: logger}
+}
+
+// NewSlogHandlerLogger adapts a slog.Handler to the Logger interface.
+func NewSlogHandlerLogger(handler slog.Handler) Logger {
+	return NewSlogLogger(slog.New(handler))
+}
+
+func (l *slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelDebug, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelInfo, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelWarn, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(context.Background(), slog.LevelError, msg, keysAndValues...)
+}
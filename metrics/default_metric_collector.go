@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"github.com/xiaoyisha/Perseus/config"
 	"github.com/xiaoyisha/Perseus/rolling"
 	"sync"
 )
@@ -12,6 +13,7 @@ import (
 //
 // Metric Collectors do not need Mutexes as they are updated by circuits within a locked context.
 type DefaultMetricCollector struct {
+	name  string
 	mutex *sync.RWMutex
 
 	numRequests *rolling.Number
@@ -24,6 +26,8 @@ type DefaultMetricCollector struct {
 	timeouts                *rolling.Number
 	contextCanceled         *rolling.Number
 	contextDeadlineExceeded *rolling.Number
+	rateLimited             *rolling.Number
+	hedges                  *rolling.Number
 
 	fallbackSuccesses *rolling.Number
 	fallbackFailures  *rolling.Number
@@ -31,8 +35,8 @@ type DefaultMetricCollector struct {
 	runDuration       *rolling.Timing
 }
 
-func newDefaultMetricCollector() MetricCollector {
-	m := &DefaultMetricCollector{}
+func newDefaultMetricCollector(name string) MetricCollector {
+	m := &DefaultMetricCollector{name: name}
 	m.mutex = &sync.RWMutex{}
 	m.Reset()
 	return m
@@ -106,6 +110,20 @@ func (d *DefaultMetricCollector) ContextDeadlineExceeded() *rolling.Number {
 	return d.contextDeadlineExceeded
 }
 
+// RateLimited returns the rolling number of executions rejected by the rate limiter
+func (d *DefaultMetricCollector) RateLimited() *rolling.Number {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.rateLimited
+}
+
+// Hedges returns the rolling number of hedged attempts
+func (d *DefaultMetricCollector) Hedges() *rolling.Number {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.hedges
+}
+
 // FallbackFailures returns the rolling number of fallback failures
 func (d *DefaultMetricCollector) FallbackFailures() *rolling.Number {
 	d.mutex.RLock()
@@ -142,27 +160,36 @@ func (d *DefaultMetricCollector) Update(r MetricResult) {
 	d.fallbackFailures.Increment(r.FallbackFailures)
 	d.contextCanceled.Increment(r.ContextCanceled)
 	d.contextDeadlineExceeded.Increment(r.ContextDeadlineExceeded)
+	d.rateLimited.Increment(r.RateLimited)
+	d.hedges.Increment(r.Hedges)
 
-	d.totalDuration.Add(r.TotalDuration)
-	d.runDuration.Add(r.RunDuration)
+	if r.Attempts > 0 {
+		d.totalDuration.Add(r.TotalDuration)
+		d.runDuration.Add(r.RunDuration)
+	}
 }
 
-// Reset resets all metrics in this collector to 0.
+// Reset resets all metrics in this collector to 0. The counters roll over the RollingWindow of the circuit,
+// and the durations over its RollingPercentileWindow.
 func (d *DefaultMetricCollector) Reset() {
+	cfg := config.GetCircuitConfig(d.name)
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	d.numRequests = rolling.NewNumber()
-	d.errors = rolling.NewNumber()
-	d.successes = rolling.NewNumber()
-	d.rejects = rolling.NewNumber()
-	d.shortCircuits = rolling.NewNumber()
-	d.failures = rolling.NewNumber()
-	d.timeouts = rolling.NewNumber()
-	d.fallbackSuccesses = rolling.NewNumber()
-	d.fallbackFailures = rolling.NewNumber()
-	d.contextCanceled = rolling.NewNumber()
-	d.contextDeadlineExceeded = rolling.NewNumber()
-	d.totalDuration = rolling.NewTiming()
-	d.runDuration = rolling.NewTiming()
+	d.numRequests = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.errors = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.successes = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.rejects = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.shortCircuits = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.failures = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.timeouts = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.fallbackSuccesses = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.fallbackFailures = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.contextCanceled = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.contextDeadlineExceeded = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.rateLimited = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.hedges = rolling.NewNumberWindow(cfg.RollingWindow, cfg.RollingWindowBuckets)
+	d.totalDuration = rolling.NewTimingWindow(cfg.RollingPercentileWindow, cfg.RollingPercentileWindowBuckets)
+	d.runDuration = rolling.NewTimingWindow(cfg.RollingPercentileWindow, cfg.RollingPercentileWindowBuckets)
 }
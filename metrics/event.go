@@ -0,0 +1,89 @@
+package metrics
+
+// EventType is what happened to a command execution, as reported to the metrics.
+type EventType int
+
+const (
+	// EventNone is the zero EventType, used for the fallback event of executions which did not run a fallback.
+	EventNone EventType = iota
+	// EventSuccess means the run function returned without error.
+	EventSuccess
+	// EventFailure means the run function returned an error.
+	EventFailure
+	// EventRejected means the executor pool had no ticket left.
+	EventRejected
+	// EventShortCircuit means the circuit was open.
+	EventShortCircuit
+	// EventTimeout means the run function took longer than the timeout of the command.
+	EventTimeout
+	// EventContextCanceled means the context of the command was canceled.
+	EventContextCanceled
+	// EventContextDeadlineExceeded means the deadline of the context of the command passed.
+	EventContextDeadlineExceeded
+	// EventFallbackSuccess means the fallback function returned without error.
+	EventFallbackSuccess
+	// EventFallbackFailure means the fallback function returned an error.
+	EventFallbackFailure
+	// EventRateLimited means more commands of the circuit started than its rate limiter allows.
+	EventRateLimited
+	// EventHedged means the command started a second, hedged attempt because the first one was slow.
+	EventHedged
+)
+
+var eventTypeNames = map[EventType]string{
+	EventNone:                    "none",
+	EventSuccess:                 "success",
+	EventFailure:                 "failure",
+	EventRejected:                "rejected",
+	EventShortCircuit:            "short-circuit",
+	EventTimeout:                 "timeout",
+	EventContextCanceled:         "context_canceled",
+	EventContextDeadlineExceeded: "context_deadline_exceeded",
+	EventFallbackSuccess:         "fallback-success",
+	EventFallbackFailure:         "fallback-failure",
+	EventRateLimited:             "rate-limited",
+	EventHedged:                  "hedged",
+}
+
+func (e EventType) String() string {
+	if name, ok := eventTypeNames[e]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the event under its name, e.g. "short-circuit".
+func (e EventType) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// IsError reports whether the event counts towards the error percent of the circuit.
+// Rate limited executions do not: they tell about our own rate, not the health of the downstream.
+func (e EventType) IsError() bool {
+	switch e {
+	case EventFailure, EventRejected, EventShortCircuit, EventTimeout:
+		return true
+	}
+	return false
+}
+
+// Outcome is the structured result of a command execution.
+type Outcome struct {
+	// Event is what happened to the run function, or EventNone for an outcome which only records
+	// the fallback of a command whose last attempt was already recorded.
+	Event EventType `json:"event"`
+	// Fallback is what happened to the fallback function, or EventNone if it did not run.
+	Fallback EventType `json:"fallback"`
+	// Hedge is EventHedged if a hedged attempt was started alongside the run, or EventNone.
+	Hedge EventType `json:"hedge"`
+	// Trial is set when the command ran as a trial request of a half-open circuit.
+	Trial bool `json:"trial"`
+	// Pool is the key of the executor pool the command took its ticket from, when not that of its circuit.
+	Pool string `json:"pool,omitempty"`
+	// Error is the error which ended the run, nil on success.
+	Error error `json:"-"`
+	// FallbackError is the error returned by the fallback function, if any.
+	FallbackError error `json:"-"`
+	// Tags are the tags the command was run with.
+	Tags map[string]string `json:"tags,omitempty"`
+}
@@ -9,15 +9,23 @@ import (
 // collect statistics about the health of the circuit.
 var Registry = metricCollectorRegistry{
 	lock: &sync.RWMutex{},
-	registry: []func(name string) MetricCollector{
+	registry: []registeredCollector{
 		// register a metric collector
-		newDefaultMetricCollector,
+		{id: 0, init: newDefaultMetricCollector},
 	},
+	nextID: 1,
 }
 
 type metricCollectorRegistry struct {
 	lock     *sync.RWMutex
-	registry []func(name string) MetricCollector
+	registry []registeredCollector
+	nextID   int
+}
+
+// registeredCollector is a MetricCollector Initializer, along with the id it is removed by.
+type registeredCollector struct {
+	id   int
+	init func(name string) MetricCollector
 }
 
 // InitializeMetricCollectors runs the registried MetricCollector Initializers to create an array of MetricCollectors.
@@ -27,17 +35,32 @@ func (m *metricCollectorRegistry) InitializeMetricCollectors(name string) []Metr
 
 	metrics := make([]MetricCollector, len(m.registry))
 	for i, metricCollectorInitializer := range m.registry {
-		metrics[i] = metricCollectorInitializer(name)
+		metrics[i] = metricCollectorInitializer.init(name)
 	}
 	return metrics
 }
 
 // Register places a MetricCollector Initializer in the registry maintained by this metricCollectorRegistry.
-func (m *metricCollectorRegistry) Register(initMetricCollector func(string) MetricCollector) {
+// The returned function removes it, so that circuits created afterwards no longer get its collector.
+func (m *metricCollectorRegistry) Register(initMetricCollector func(string) MetricCollector) func() {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	m.registry = append(m.registry, initMetricCollector)
+	id := m.nextID
+	m.nextID++
+	m.registry = append(m.registry, registeredCollector{id: id, init: initMetricCollector})
+
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		for i, c := range m.registry {
+			if c.id == id {
+				m.registry = append(m.registry[:i:i], m.registry[i+1:]...)
+				return
+			}
+		}
+	}
 }
 
 type MetricResult struct {
@@ -52,9 +75,13 @@ type MetricResult struct {
 	FallbackFailures        float64
 	ContextCanceled         float64
 	ContextDeadlineExceeded float64
+	RateLimited             float64
+	Hedges                  float64
 	TotalDuration           time.Duration
 	RunDuration             time.Duration
 	ConcurrencyInUse        float64
+	// Outcome is the execution the counters above were computed from, including its errors.
+	Outcome Outcome
 }
 
 // MetricCollector represents the contract that all collectors must fulfill to gather circuit statistics.
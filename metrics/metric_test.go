@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"errors"
 	"github.com/xiaoyisha/Perseus/config"
 	"testing"
 	"time"
@@ -19,7 +20,7 @@ func TestErrorPercent(t *testing.T) {
 		})
 
 		Convey("and a error threshold set to 39", func() {
-			config.ConfigureCommand("", config.CommandConfig{ErrorPercentThreshold: 39})
+			config.ConfigureCommand("", config.CommandConfig{ErrorPercentThreshold: config.Int(39)})
 
 			Convey("the metrics should be unhealthy", func() {
 				So(m.IsHealthy(now), ShouldBeFalse)
@@ -28,3 +29,99 @@ func TestErrorPercent(t *testing.T) {
 		})
 	})
 }
+
+func TestRollingWindow(t *testing.T) {
+	Convey("with a circuit configured with a 30 second window of 500ms buckets", t, func() {
+		config.ConfigureCommand("windowed", config.CommandConfig{RollingWindow: config.Int(30000), RollingWindowBuckets: config.Int(60)})
+		defer config.ConfigureCommand("windowed", config.CommandConfig{})
+
+		m := NewMetricExchange("windowed")
+		m.Updates <- &CommandExecution{Outcome: Outcome{Event: EventFailure}}
+		time.Sleep(100 * time.Millisecond)
+
+		Convey("the health check counts over 30 seconds", func() {
+			So(m.Requests().Window(), ShouldEqual, 30*time.Second)
+			So(m.ErrorPercent(time.Now().Add(20*time.Second)), ShouldEqual, 100)
+			So(m.ErrorPercent(time.Now().Add(31*time.Second)), ShouldEqual, 0)
+		})
+	})
+}
+
+type outcomeCollector struct {
+	results chan MetricResult
+}
+
+func (c *outcomeCollector) Update(r MetricResult) { c.results <- r }
+func (c *outcomeCollector) Reset()                {}
+
+func TestOutcome(t *testing.T) {
+	Convey("with a custom collector", t, func() {
+		m := NewMetricExchange("outcome")
+		c := &outcomeCollector{results: make(chan MetricResult, 1)}
+		m.Mutex.Lock()
+		m.metricCollectors = append(m.metricCollectors, c)
+		m.Mutex.Unlock()
+
+		Convey("a timeout whose fallback failed is counted as both", func() {
+			runErr := errors.New("timeout")
+			fallbackErr := errors.New("fallback")
+			m.Updates <- &CommandExecution{Outcome: Outcome{
+				Event:         EventTimeout,
+				Fallback:      EventFallbackFailure,
+				Error:         runErr,
+				FallbackError: fallbackErr,
+			}}
+			r := <-c.results
+
+			So(r.Timeouts, ShouldEqual, 1)
+			So(r.Errors, ShouldEqual, 1)
+			So(r.FallbackFailures, ShouldEqual, 1)
+
+			Convey("and the collector sees the actual errors", func() {
+				So(r.Outcome.Error, ShouldEqual, runErr)
+				So(r.Outcome.FallbackError, ShouldEqual, fallbackErr)
+			})
+		})
+	})
+}
+
+func TestEventType(t *testing.T) {
+	Convey("event types are named as in the stream", t, func() {
+		So(EventShortCircuit.String(), ShouldEqual, "short-circuit")
+		So(EventContextCanceled.String(), ShouldEqual, "context_canceled")
+		So(EventType(100).String(), ShouldEqual, "unknown")
+	})
+
+	Convey("only executions which did not get a result count as errors", t, func() {
+		So(EventFailure.IsError(), ShouldBeTrue)
+		So(EventShortCircuit.IsError(), ShouldBeTrue)
+		So(EventSuccess.IsError(), ShouldBeFalse)
+		So(EventContextCanceled.IsError(), ShouldBeFalse)
+	})
+}
+
+type nopCollector struct{}
+
+func (nopCollector) Update(MetricResult) {}
+func (nopCollector) Reset()              {}
+
+func TestRegistry(t *testing.T) {
+	Convey("with a collector registered", t, func() {
+		remove := Registry.Register(func(name string) MetricCollector { return nopCollector{} })
+		Reset(remove)
+
+		Convey("circuits should get it along with the default collector", func() {
+			collectors := Registry.InitializeMetricCollectors("registered")
+			So(collectors, ShouldHaveLength, 2)
+			So(collectors[1], ShouldHaveSameTypeAs, nopCollector{})
+		})
+
+		Convey("once removed, even twice, circuits should only get the default collector", func() {
+			remove()
+			remove()
+			collectors := Registry.InitializeMetricCollectors("registered")
+			So(collectors, ShouldHaveLength, 1)
+			So(collectors[0], ShouldHaveSameTypeAs, &DefaultMetricCollector{})
+		})
+	})
+}
@@ -8,7 +8,7 @@ import (
 )
 
 type CommandExecution struct {
-	Types            []string      `json:"types"`
+	Outcome          Outcome       `json:"outcome"`
 	Start            time.Time     `json:"start_time"`
 	RunDuration      time.Duration `json:"run_duration"`
 	ConcurrencyInUse float64       `json:"concurrency_inuse"`
@@ -56,6 +56,8 @@ func (m *MetricExchange) Monitor() {
 		totalDuration := time.Since(update.Start)
 		wg := &sync.WaitGroup{}
 		for _, collector := range m.metricCollectors {
+			// each goroutine needs its own copy of the loop variable
+			collector := collector
 			wg.Add(1)
 			go m.IncrementMetrics(wg, &collector, update, totalDuration)
 		}
@@ -68,41 +70,48 @@ func (m *MetricExchange) Monitor() {
 func (m *MetricExchange) IncrementMetrics(wg *sync.WaitGroup, collector *MetricCollector, update *CommandExecution, totalDuration time.Duration) {
 	// granular metrics
 	r := MetricResult{
-		Attempts:         1,
-		TotalDuration:    totalDuration,
-		RunDuration:      update.RunDuration,
 		ConcurrencyInUse: update.ConcurrencyInUse,
+		Outcome:          update.Outcome,
+	}
+	// an outcome recording only a fallback adds no attempt, nor durations, to those already recorded
+	if update.Outcome.Event != EventNone {
+		r.Attempts = 1
+		r.TotalDuration = totalDuration
+		r.RunDuration = update.RunDuration
 	}
 
-	switch update.Types[0] {
-	case "success":
+	switch update.Outcome.Event {
+	case EventSuccess:
 		r.Successes = 1
-	case "failure":
+	case EventFailure:
 		r.Failures = 1
-		r.Errors = 1
-	case "rejected":
+	case EventRejected:
 		r.Rejects = 1
-		r.Errors = 1
-	case "short-circuit":
+	case EventShortCircuit:
 		r.ShortCircuits = 1
-		r.Errors = 1
-	case "timeout":
+	case EventTimeout:
 		r.Timeouts = 1
-		r.Errors = 1
-	case "context_canceled":
+	case EventContextCanceled:
 		r.ContextCanceled = 1
-	case "context_deadline_exceeded":
+	case EventContextDeadlineExceeded:
 		r.ContextDeadlineExceeded = 1
+	case EventRateLimited:
+		r.RateLimited = 1
+	}
+	if update.Outcome.Event.IsError() {
+		r.Errors = 1
 	}
 
-	if len(update.Types) > 1 {
-		// fallback metrics
-		if update.Types[1] == "fallback-success" {
-			r.FallbackSuccesses = 1
-		}
-		if update.Types[1] == "fallback-failure" {
-			r.FallbackFailures = 1
-		}
+	if update.Outcome.Hedge == EventHedged {
+		r.Hedges = 1
+	}
+
+	// fallback metrics
+	switch update.Outcome.Fallback {
+	case EventFallbackSuccess:
+		r.FallbackSuccesses = 1
+	case EventFallbackFailure:
+		r.FallbackFailures = 1
 	}
 
 	(*collector).Update(r)
@@ -151,11 +160,11 @@ func (m *MetricExchange) IsHealthy(now time.Time) bool {
 func MetricFailingPercent(p int) *MetricExchange {
 	m := NewMetricExchange("")
 	for i := 0; i < 100; i++ {
-		t := "success"
+		t := EventSuccess
 		if i < p {
-			t = "failure"
+			t = EventFailure
 		}
-		m.Updates <- &CommandExecution{Types: []string{t}}
+		m.Updates <- &CommandExecution{Outcome: Outcome{Event: t}}
 	}
 
 	// Updates needs to be flushed
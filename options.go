@@ -0,0 +1,80 @@
+package Perseus
+
+import (
+	"time"
+)
+
+// An Option overrides the settings of the circuit for a single command, while the command
+// still reports into the metrics of its circuit:
+//
+//	err := DoC(ctx, "my_command", run, nil, WithTimeout(100*time.Millisecond))
+type Option func(*options)
+
+type options struct {
+	timeout  time.Duration
+	fallback FallbackFuncC
+	pool     string
+	tags     map[string]string
+	// hedge is set by WithHedging, along with the delay overriding the HedgeDelay of the circuit
+	hedge      bool
+	hedgeDelay time.Duration
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTimeout sets how long to wait for the command to complete instead of the Timeout of the circuit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithFallback sets the fallback of the command, replacing the one passed to DoC or GoC.
+// Used with Execute, a fallback which succeeds returns the zero value.
+func WithFallback(fallback FallbackFuncC) Option {
+	return func(o *options) {
+		o.fallback = fallback
+	}
+}
+
+// WithPool makes the command take its ticket from the executor pool with the given key
+// rather than from the pool of its circuit. See config.CommandConfig.PoolKey.
+func WithPool(key string) Option {
+	return func(o *options) {
+		o.pool = key
+	}
+}
+
+// WithTags attaches tags to the command, which are passed on to the metric collectors in the outcome
+// of its execution. Tags given by several options are merged.
+func WithTags(tags map[string]string) Option {
+	return func(o *options) {
+		if o.tags == nil {
+			o.tags = make(map[string]string, len(tags))
+		}
+		for k, v := range tags {
+			o.tags[k] = v
+		}
+	}
+}
+
+// WithHedging starts a second attempt of the command if the first one has not returned after delay,
+// or after the HedgeDelay of the circuit if delay is 0, itself defaulting to the 95th percentile
+// run duration of the circuit, or at once if the first attempt fails before. The first attempt
+// to succeed is the result of the command, and the other one has its context canceled; the command
+// fails once both attempts have failed.
+//
+// Both attempts hold a ticket of the executor pool, and hedged attempts are capped to the HedgePercent
+// of the circuit. Only hedge commands which may safely run twice, such as idempotent reads.
+func WithHedging(delay time.Duration) Option {
+	return func(o *options) {
+		o.hedge = true
+		o.hedgeDelay = delay
+	}
+}
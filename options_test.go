@@ -0,0 +1,146 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"Perseus/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type tagsCollector struct {
+	tags chan map[string]string
+}
+
+func (c *tagsCollector) Update(r metrics.MetricResult) {
+	if c.tags != nil {
+		c.tags <- r.Outcome.Tags
+	}
+}
+
+func (c *tagsCollector) Reset() {}
+
+func TestWithTimeout(t *testing.T) {
+	Convey("with a command given a timeout tighter than its circuit", t, func() {
+		defer circuit.Flush()
+
+		err := DoC(context.Background(), "options", func(ctx context.Context) error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		}, nil, WithTimeout(10*time.Millisecond))
+
+		Convey("the command times out", func() {
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+
+			Convey("and the timeout is recorded in the metrics of the circuit", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("options")
+				So(cb.Metrics.DefaultCollector().Timeouts().Sum(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("the circuit keeps its timeout for other commands", func() {
+			So(config.GetCircuitConfig("options").Timeout, ShouldEqual, time.Duration(config.DefaultTimeout)*time.Millisecond)
+		})
+	})
+}
+
+func TestWithFallback(t *testing.T) {
+	Convey("with a failing command given a fallback option", t, func() {
+		defer circuit.Flush()
+		run := func(ctx context.Context) error {
+			return fmt.Errorf("run failed")
+		}
+		used := make(chan string, 1)
+		fallback := WithFallback(func(ctx context.Context, err error) error {
+			used <- "option"
+			return nil
+		})
+
+		Convey("the option replaces the fallback passed to DoC", func() {
+			err := DoC(context.Background(), "options", run, func(ctx context.Context, err error) error {
+				used <- "argument"
+				return nil
+			}, fallback)
+			So(err, ShouldBeNil)
+			So(<-used, ShouldEqual, "option")
+		})
+
+		Convey("Execute returns the zero value", func() {
+			value, err := Execute(context.Background(), "options", func(ctx context.Context) (int, error) {
+				return 1, fmt.Errorf("run failed")
+			}, nil, fallback)
+			So(err, ShouldBeNil)
+			So(value, ShouldEqual, 0)
+			So(<-used, ShouldEqual, "option")
+		})
+	})
+}
+
+func TestWithPool(t *testing.T) {
+	Convey("with two commands sharing a pool of one ticket", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("shared", config.CommandConfig{MaxConcurrentRequests: config.Int(1)})
+		defer config.ConfigureCommand("shared", config.CommandConfig{})
+
+		release := make(chan struct{})
+		first := GoC(context.Background(), "options", func(ctx context.Context) error {
+			<-release
+			return nil
+		}, nil, WithPool("shared"))
+		time.Sleep(10 * time.Millisecond)
+
+		Convey("the first command holds the ticket of the shared pool, not of its circuit", func() {
+			cb, _, _ := circuit.GetCircuitBreaker("options")
+			So(circuit.GetExecutorPool("shared").ActiveCount(), ShouldEqual, 1)
+			So(cb.ExecutorPool.ActiveCount(), ShouldEqual, 0)
+			close(release)
+		})
+
+		Convey("the second command is rejected while the first one runs", func() {
+			err := DoC(context.Background(), "options_other", func(ctx context.Context) error {
+				return nil
+			}, nil, WithPool("shared"))
+			So(errors.Is(err, ErrMaxConcurrency), ShouldBeTrue)
+
+			Convey("and runs once the first one gave the ticket back", func() {
+				close(release)
+				time.Sleep(10 * time.Millisecond)
+				So(len(first), ShouldEqual, 0)
+				So(circuit.GetExecutorPool("shared").ActiveCount(), ShouldEqual, 0)
+				So(DoC(context.Background(), "options_other", func(ctx context.Context) error {
+					return nil
+				}, nil, WithPool("shared")), ShouldBeNil)
+			})
+		})
+	})
+}
+
+func TestWithTags(t *testing.T) {
+	taggedCollector := &tagsCollector{tags: make(chan map[string]string, 10)}
+	remove := metrics.Registry.Register(func(name string) metrics.MetricCollector {
+		if name == "tagged" {
+			return taggedCollector
+		}
+		return &tagsCollector{}
+	})
+	defer remove()
+
+	Convey("with a command run with tags", t, func() {
+		defer circuit.Flush()
+
+		err := DoC(context.Background(), "tagged", func(ctx context.Context) error {
+			return nil
+		}, nil, WithTags(map[string]string{"route": "/a"}), WithTags(map[string]string{"tenant": "b"}))
+		So(err, ShouldBeNil)
+
+		Convey("the collectors receive the merged tags", func() {
+			So(<-taggedCollector.tags, ShouldResemble, map[string]string{"route": "/a", "tenant": "b"})
+		})
+	})
+}
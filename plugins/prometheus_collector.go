@@ -0,0 +1,224 @@
+package plugins
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/xiaoyisha/Perseus/metrics"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultPrometheusBuckets are the upper bounds, in seconds, of the duration histogram buckets.
+var DefaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusRegistry keeps the metrics of every circuit and serves them over HTTP
+// in the Prometheus text exposition format.
+//
+// Register its collectors and expose it with:
+//
+//	registry := plugins.NewPrometheusRegistry("perseus")
+//	metrics.Registry.Register(registry.NewPrometheusCollector)
+//	http.Handle("/metrics", registry)
+type PrometheusRegistry struct {
+	namespace string
+	buckets   []float64
+
+	mutex    *sync.RWMutex
+	circuits map[string]*PrometheusCollector
+}
+
+// PrometheusCollector implements the metrics.MetricCollector interface for a single circuit.
+// Counters are cumulative as Prometheus expects, so Reset leaves them untouched.
+type PrometheusCollector struct {
+	mutex   *sync.Mutex
+	buckets []float64
+
+	counters         []float64
+	runDuration      *prometheusHistogram
+	totalDuration    *prometheusHistogram
+	concurrencyInUse float64
+}
+
+type prometheusHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type prometheusCounter struct {
+	name  string
+	help  string
+	value func(r metrics.MetricResult) float64
+}
+
+var prometheusCounters = []prometheusCounter{
+	{"attempts_total", "Number of command executions attempted.", func(r metrics.MetricResult) float64 { return r.Attempts }},
+	{"errors_total", "Number of command executions counting towards the error percent.", func(r metrics.MetricResult) float64 { return r.Errors }},
+	{"successes_total", "Number of successful command executions.", func(r metrics.MetricResult) float64 { return r.Successes }},
+	{"failures_total", "Number of command executions whose run function failed.", func(r metrics.MetricResult) float64 { return r.Failures }},
+	{"rejects_total", "Number of command executions rejected by the executor pool.", func(r metrics.MetricResult) float64 { return r.Rejects }},
+	{"short_circuits_total", "Number of command executions short-circuited by an open circuit.", func(r metrics.MetricResult) float64 { return r.ShortCircuits }},
+	{"timeouts_total", "Number of command executions which timed out.", func(r metrics.MetricResult) float64 { return r.Timeouts }},
+	{"fallback_successes_total", "Number of successful fallback executions.", func(r metrics.MetricResult) float64 { return r.FallbackSuccesses }},
+	{"fallback_failures_total", "Number of failed fallback executions.", func(r metrics.MetricResult) float64 { return r.FallbackFailures }},
+	{"context_canceled_total", "Number of command executions whose context was canceled.", func(r metrics.MetricResult) float64 { return r.ContextCanceled }},
+	{"context_deadline_exceeded_total", "Number of command executions whose context deadline was exceeded.", func(r metrics.MetricResult) float64 { return r.ContextDeadlineExceeded }},
+	{"rate_limited_total", "Number of command executions rejected by the rate limiter.", func(r metrics.MetricResult) float64 { return r.RateLimited }},
+	{"hedges_total", "Number of hedged attempts started alongside slow command executions.", func(r metrics.MetricResult) float64 { return r.Hedges }},
+}
+
+// NewPrometheusRegistry creates a registry whose metric names are prefixed with namespace.
+func NewPrometheusRegistry(namespace string) *PrometheusRegistry {
+	return &PrometheusRegistry{
+		namespace: namespace,
+		buckets:   DefaultPrometheusBuckets,
+		mutex:     &sync.RWMutex{},
+		circuits:  make(map[string]*PrometheusCollector),
+	}
+}
+
+// NewPrometheusCollector creates the collector of a circuit. It is meant to be registered
+// with metrics.Registry.Register.
+func (p *PrometheusRegistry) NewPrometheusCollector(name string) metrics.MetricCollector {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if c, ok := p.circuits[name]; ok {
+		// a circuit recreated after circuit.Flush keeps counting where it left off
+		return c
+	}
+
+	c := &PrometheusCollector{
+		mutex:         &sync.Mutex{},
+		buckets:       p.buckets,
+		counters:      make([]float64, len(prometheusCounters)),
+		runDuration:   newPrometheusHistogram(len(p.buckets)),
+		totalDuration: newPrometheusHistogram(len(p.buckets)),
+	}
+	p.circuits[name] = c
+	return c
+}
+
+func newPrometheusHistogram(buckets int) *prometheusHistogram {
+	return &prometheusHistogram{counts: make([]uint64, buckets)}
+}
+
+func (h *prometheusHistogram) observe(buckets []float64, v float64) {
+	for i, upper := range buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Update accepts a set of metrics from a command execution
+func (c *PrometheusCollector) Update(r metrics.MetricResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, counter := range prometheusCounters {
+		c.counters[i] += counter.value(r)
+	}
+	if r.RunDuration > 0 {
+		c.runDuration.observe(c.buckets, r.RunDuration.Seconds())
+	}
+	if r.Attempts > 0 {
+		c.totalDuration.observe(c.buckets, r.TotalDuration.Seconds())
+	}
+	c.concurrencyInUse = r.ConcurrencyInUse
+}
+
+// Reset is a noop operation in this collector.
+func (c *PrometheusCollector) Reset() {}
+
+// ServeHTTP writes the metrics of all circuits in the Prometheus text exposition format.
+func (p *PrometheusRegistry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	p.mutex.RLock()
+	names := make([]string, 0, len(p.circuits))
+	collectors := make(map[string]*PrometheusCollector, len(p.circuits))
+	for name, c := range p.circuits {
+		names = append(names, name)
+		collectors[name] = c
+	}
+	p.mutex.RUnlock()
+	sort.Strings(names)
+
+	for i, counter := range prometheusCounters {
+		p.writeHeader(w, counter.name, counter.help, "counter")
+		for _, name := range names {
+			c := collectors[name]
+			c.mutex.Lock()
+			v := c.counters[i]
+			c.mutex.Unlock()
+			fmt.Fprintf(w, "%s{circuit=\"%s\"} %s\n", p.metricName(counter.name), escapeLabelValue(name), formatFloat(v))
+		}
+	}
+
+	p.writeHistograms(w, names, collectors, "run_duration_seconds", "Duration of the run function.",
+		func(c *PrometheusCollector) *prometheusHistogram { return c.runDuration })
+	p.writeHistograms(w, names, collectors, "total_duration_seconds", "Duration of the whole command, including fallbacks.",
+		func(c *PrometheusCollector) *prometheusHistogram { return c.totalDuration })
+
+	p.writeHeader(w, "concurrency_in_use", "Share of the executor pool in use at the last execution.", "gauge")
+	for _, name := range names {
+		c := collectors[name]
+		c.mutex.Lock()
+		v := c.concurrencyInUse
+		c.mutex.Unlock()
+		fmt.Fprintf(w, "%s{circuit=\"%s\"} %s\n", p.metricName("concurrency_in_use"), escapeLabelValue(name), formatFloat(v))
+	}
+}
+
+func (p *PrometheusRegistry) writeHistograms(w *bufio.Writer, names []string, collectors map[string]*PrometheusCollector,
+	metric, help string, histogram func(c *PrometheusCollector) *prometheusHistogram) {
+	p.writeHeader(w, metric, help, "histogram")
+	name := p.metricName(metric)
+
+	for _, circuitName := range names {
+		c := collectors[circuitName]
+		label := escapeLabelValue(circuitName)
+
+		c.mutex.Lock()
+		h := histogram(c)
+		for i, upper := range c.buckets {
+			fmt.Fprintf(w, "%s_bucket{circuit=\"%s\",le=\"%s\"} %d\n", name, label, formatFloat(upper), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{circuit=\"%s\",le=\"+Inf\"} %d\n", name, label, h.count)
+		fmt.Fprintf(w, "%s_sum{circuit=\"%s\"} %s\n", name, label, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{circuit=\"%s\"} %d\n", name, label, h.count)
+		c.mutex.Unlock()
+	}
+}
+
+func (p *PrometheusRegistry) writeHeader(w *bufio.Writer, metric, help, metricType string) {
+	name := p.metricName(metric)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+func (p *PrometheusRegistry) metricName(metric string) string {
+	if p.namespace == "" {
+		return metric
+	}
+	return p.namespace + "_" + metric
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,59 @@
+package plugins
+
+import (
+	"github.com/xiaoyisha/Perseus/metrics"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	Convey("with a Prometheus registry collecting two executions of a circuit", t, func() {
+		registry := NewPrometheusRegistry("perseus")
+		collector := registry.NewPrometheusCollector(`with "quotes"`)
+		collector.Update(metrics.MetricResult{
+			Attempts:         1,
+			Successes:        1,
+			RunDuration:      20 * time.Millisecond,
+			TotalDuration:    30 * time.Millisecond,
+			ConcurrencyInUse: 0.5,
+		})
+		collector.Update(metrics.MetricResult{
+			Attempts:          1,
+			Errors:            1,
+			Timeouts:          1,
+			FallbackSuccesses: 1,
+			TotalDuration:     2 * time.Second,
+		})
+		collector.Reset()
+
+		rec := httptest.NewRecorder()
+		registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body := rec.Body.String()
+
+		Convey("it exposes cumulative counters labeled by circuit", func() {
+			So(rec.Header().Get("Content-Type"), ShouldStartWith, "text/plain; version=0.0.4")
+			So(body, ShouldContainSubstring, "# TYPE perseus_attempts_total counter\n")
+			So(body, ShouldContainSubstring, `perseus_attempts_total{circuit="with \"quotes\""} 2`+"\n")
+			So(body, ShouldContainSubstring, `perseus_successes_total{circuit="with \"quotes\""} 1`+"\n")
+			So(body, ShouldContainSubstring, `perseus_timeouts_total{circuit="with \"quotes\""} 1`+"\n")
+			So(body, ShouldContainSubstring, `perseus_fallback_successes_total{circuit="with \"quotes\""} 1`+"\n")
+			So(body, ShouldContainSubstring, `perseus_rejects_total{circuit="with \"quotes\""} 0`+"\n")
+		})
+
+		Convey("it exposes duration histograms", func() {
+			So(body, ShouldContainSubstring, "# TYPE perseus_run_duration_seconds histogram\n")
+			So(body, ShouldContainSubstring, `perseus_run_duration_seconds_bucket{circuit="with \"quotes\"",le="0.025"} 1`+"\n")
+			So(body, ShouldContainSubstring, `perseus_run_duration_seconds_count{circuit="with \"quotes\""} 1`+"\n")
+			So(body, ShouldContainSubstring, `perseus_total_duration_seconds_bucket{circuit="with \"quotes\"",le="1"} 1`+"\n")
+			So(body, ShouldContainSubstring, `perseus_total_duration_seconds_bucket{circuit="with \"quotes\"",le="+Inf"} 2`+"\n")
+			So(body, ShouldContainSubstring, `perseus_total_duration_seconds_sum{circuit="with \"quotes\""} 2.03`+"\n")
+		})
+
+		Convey("it exposes the concurrency in use", func() {
+			So(body, ShouldContainSubstring, `perseus_concurrency_in_use{circuit="with \"quotes\""} 0`+"\n")
+		})
+	})
+}
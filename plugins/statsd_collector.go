@@ -0,0 +1,231 @@
+package plugins
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/xiaoyisha/Perseus/metrics"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStatsdFlushInterval is how often buffered metrics are sent when no interval is configured.
+	DefaultStatsdFlushInterval = time.Second
+	// DefaultStatsdFlushBytes keeps packets below the MTU of most networks.
+	DefaultStatsdFlushBytes = 1432
+)
+
+// StatsdCollectorConfig provides configuration that the StatsD client will need.
+type StatsdCollectorConfig struct {
+	// StatsdAddr is the UDP address of the StatsD server, e.g. "localhost:8125"
+	StatsdAddr string
+	// Prefix is prepended to every metric name
+	Prefix string
+	// SampleRate is the share of metrics actually sent, between 0 and 1. Defaults to 1.
+	SampleRate float32
+	// FlushInterval is how often buffered metrics are sent. Defaults to DefaultStatsdFlushInterval.
+	FlushInterval time.Duration
+	// FlushBytes is the largest packet sent; a fuller buffer is flushed early. Defaults to DefaultStatsdFlushBytes.
+	FlushBytes int
+	// DogStatsd sends the circuit name as a "circuit" tag instead of in the metric name.
+	DogStatsd bool
+	// Tags are extra DogStatsD tags, e.g. "env:prod", added to every metric when DogStatsd is set.
+	Tags []string
+}
+
+// StatsdCollectorClient buffers the metrics of every circuit and flushes them over UDP.
+// Register its collectors with:
+//
+//	client, err := plugins.InitializeStatsdCollector(&plugins.StatsdCollectorConfig{StatsdAddr: "localhost:8125"})
+//	metrics.Registry.Register(client.NewStatsdCollector)
+type StatsdCollectorClient struct {
+	config StatsdCollectorConfig
+	conn   net.Conn
+
+	mutex  *sync.Mutex
+	buffer bytes.Buffer
+	rand   *rand.Rand
+	done   chan struct{}
+
+	closeOnce *sync.Once
+	closeErr  error
+}
+
+// StatsdCollector fulfills the metrics.MetricCollector interface allowing users to ship circuit
+// stats to a StatsD backend. Counters and timings are sent as they are reported, so Reset is a noop.
+type StatsdCollector struct {
+	client *StatsdCollectorClient
+	prefix string
+	tags   string
+}
+
+// InitializeStatsdCollector creates the connection to the StatsD server and starts flushing
+// buffered metrics every FlushInterval.
+func InitializeStatsdCollector(config *StatsdCollectorConfig) (*StatsdCollectorClient, error) {
+	c := *config
+	if c.SampleRate <= 0 || c.SampleRate > 1 {
+		c.SampleRate = 1
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = DefaultStatsdFlushInterval
+	}
+	if c.FlushBytes <= 0 {
+		c.FlushBytes = DefaultStatsdFlushBytes
+	}
+
+	conn, err := net.Dial("udp", c.StatsdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("could not initiate statsd client: %v", err)
+	}
+
+	s := &StatsdCollectorClient{
+		config: c,
+		conn:   conn,
+		mutex:  &sync.Mutex{},
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:   make(chan struct{}),
+
+		closeOnce: &sync.Once{},
+	}
+	go s.loop()
+
+	return s, nil
+}
+
+// NewStatsdCollector creates a collector for a specific circuit. It is meant to be registered
+// with metrics.Registry.Register.
+func (s *StatsdCollectorClient) NewStatsdCollector(name string) metrics.MetricCollector {
+	c := &StatsdCollector{client: s}
+
+	var prefix []string
+	if s.config.Prefix != "" {
+		prefix = append(prefix, s.config.Prefix)
+	}
+	if s.config.DogStatsd {
+		tags := append([]string{"circuit:" + statsdSanitizer.Replace(name)}, s.config.Tags...)
+		c.tags = "|#" + strings.Join(tags, ",")
+	} else {
+		prefix = append(prefix, statsdSanitizer.Replace(name))
+	}
+	if len(prefix) > 0 {
+		c.prefix = strings.Join(prefix, ".") + "."
+	}
+
+	return c
+}
+
+// Flush sends the buffered metrics right away.
+func (s *StatsdCollectorClient) Flush() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.flushLocked()
+}
+
+// Close flushes the buffered metrics and closes the connection. Later calls return the result of the first one.
+func (s *StatsdCollectorClient) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if err := s.Flush(); err != nil {
+			s.conn.Close()
+			s.closeErr = err
+			return
+		}
+		s.closeErr = s.conn.Close()
+	})
+	return s.closeErr
+}
+
+func (s *StatsdCollectorClient) loop() {
+	tick := time.NewTicker(s.config.FlushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			s.Flush()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *StatsdCollectorClient) flushLocked() error {
+	if s.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buffer.Bytes())
+	s.buffer.Reset()
+	return err
+}
+
+// send buffers a metric line unless it was left out by sampling.
+func (s *StatsdCollectorClient) send(name, value, metricType, tags string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	line := name + ":" + value + "|" + metricType
+	if s.config.SampleRate < 1 {
+		if s.rand.Float32() >= s.config.SampleRate {
+			return
+		}
+		line += "|@" + strconv.FormatFloat(float64(s.config.SampleRate), 'f', -1, 32)
+	}
+	line += tags
+
+	if s.buffer.Len() > 0 && s.buffer.Len()+1+len(line) > s.config.FlushBytes {
+		s.flushLocked()
+	}
+	if s.buffer.Len() > 0 {
+		s.buffer.WriteByte('\n')
+	}
+	s.buffer.WriteString(line)
+}
+
+var statsdSanitizer = strings.NewReplacer(".", "-", ":", "-", "|", "-", "@", "-", "#", "-", ",", "-", " ", "_", "\n", "_")
+
+func (c *StatsdCollector) incrementCounterMetric(metric string, i float64) {
+	if i == 0 {
+		return
+	}
+	c.client.send(c.prefix+metric, strconv.FormatFloat(i, 'f', -1, 64), "c", c.tags)
+}
+
+func (c *StatsdCollector) updateTimerMetric(metric string, dur time.Duration) {
+	c.client.send(c.prefix+metric, strconv.FormatInt(dur.Nanoseconds()/1000000, 10), "ms", c.tags)
+}
+
+func (c *StatsdCollector) setGauge(metric string, value float64) {
+	c.client.send(c.prefix+metric, strconv.FormatFloat(value, 'f', -1, 64), "g", c.tags)
+}
+
+// Update accepts a set of metrics from a command execution
+func (c *StatsdCollector) Update(r metrics.MetricResult) {
+	c.incrementCounterMetric("attempts", r.Attempts)
+	c.incrementCounterMetric("errors", r.Errors)
+	c.incrementCounterMetric("successes", r.Successes)
+	c.incrementCounterMetric("failures", r.Failures)
+	c.incrementCounterMetric("rejects", r.Rejects)
+	c.incrementCounterMetric("shortCircuits", r.ShortCircuits)
+	c.incrementCounterMetric("timeouts", r.Timeouts)
+	c.incrementCounterMetric("fallbackSuccesses", r.FallbackSuccesses)
+	c.incrementCounterMetric("fallbackFailures", r.FallbackFailures)
+	c.incrementCounterMetric("contextCanceled", r.ContextCanceled)
+	c.incrementCounterMetric("contextDeadlineExceeded", r.ContextDeadlineExceeded)
+	c.incrementCounterMetric("rateLimited", r.RateLimited)
+	c.incrementCounterMetric("hedges", r.Hedges)
+	if r.Attempts > 0 {
+		c.updateTimerMetric("totalDuration", r.TotalDuration)
+	}
+	if r.RunDuration > 0 {
+		c.updateTimerMetric("runDuration", r.RunDuration)
+	}
+	c.setGauge("concurrencyInUse", 100*r.ConcurrencyInUse)
+}
+
+// Reset is a noop operation in this collector.
+func (c *StatsdCollector) Reset() {}
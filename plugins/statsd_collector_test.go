@@ -0,0 +1,125 @@
+package plugins
+
+import (
+	"github.com/xiaoyisha/Perseus/metrics"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func listenStatsd(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func readStatsdLines(t *testing.T, conn net.PacketConn) []string {
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestStatsdCollector(t *testing.T) {
+	Convey("with a StatsD collector sending to a local listener", t, func() {
+		conn := listenStatsd(t)
+		defer conn.Close()
+
+		result := metrics.MetricResult{
+			Attempts:         1,
+			Successes:        1,
+			RunDuration:      20 * time.Millisecond,
+			TotalDuration:    30 * time.Millisecond,
+			ConcurrencyInUse: 0.5,
+		}
+
+		Convey("metrics are prefixed with the circuit name", func() {
+			client, err := InitializeStatsdCollector(&StatsdCollectorConfig{
+				StatsdAddr:    conn.LocalAddr().String(),
+				Prefix:        "perseus",
+				FlushInterval: time.Hour,
+			})
+			So(err, ShouldBeNil)
+			defer client.Close()
+
+			client.NewStatsdCollector("my.circuit").Update(result)
+			So(client.Flush(), ShouldBeNil)
+
+			So(readStatsdLines(t, conn), ShouldResemble, []string{
+				"perseus.my-circuit.attempts:1|c",
+				"perseus.my-circuit.successes:1|c",
+				"perseus.my-circuit.totalDuration:30|ms",
+				"perseus.my-circuit.runDuration:20|ms",
+				"perseus.my-circuit.concurrencyInUse:50|g",
+			})
+		})
+
+		Convey("DogStatsD metrics are tagged with the circuit name", func() {
+			client, err := InitializeStatsdCollector(&StatsdCollectorConfig{
+				StatsdAddr:    conn.LocalAddr().String(),
+				Prefix:        "perseus",
+				FlushInterval: 10 * time.Millisecond,
+				DogStatsd:     true,
+				Tags:          []string{"env:test"},
+			})
+			So(err, ShouldBeNil)
+			defer client.Close()
+
+			client.NewStatsdCollector("foo").Update(metrics.MetricResult{Attempts: 1, Timeouts: 1})
+
+			lines := readStatsdLines(t, conn)
+			So(lines, ShouldContain, "perseus.attempts:1|c|#circuit:foo,env:test")
+			So(lines, ShouldContain, "perseus.timeouts:1|c|#circuit:foo,env:test")
+		})
+
+		Convey("a full buffer is flushed before exceeding FlushBytes", func() {
+			client, err := InitializeStatsdCollector(&StatsdCollectorConfig{
+				StatsdAddr:    conn.LocalAddr().String(),
+				FlushInterval: time.Hour,
+				FlushBytes:    20,
+			})
+			So(err, ShouldBeNil)
+			defer client.Close()
+
+			client.NewStatsdCollector("foo").Update(result)
+
+			So(readStatsdLines(t, conn), ShouldResemble, []string{"foo.attempts:1|c"})
+		})
+
+		Convey("sampled metrics carry the sample rate", func() {
+			client, err := InitializeStatsdCollector(&StatsdCollectorConfig{
+				StatsdAddr:    conn.LocalAddr().String(),
+				FlushInterval: time.Hour,
+				SampleRate:    0.999999,
+			})
+			So(err, ShouldBeNil)
+			defer client.Close()
+
+			collector := client.NewStatsdCollector("foo")
+			for i := 0; i < 10; i++ {
+				collector.Update(metrics.MetricResult{Attempts: 1})
+			}
+			So(client.Flush(), ShouldBeNil)
+
+			for _, line := range readStatsdLines(t, conn) {
+				So(line, ShouldEndWith, "|@0.999999")
+			}
+		})
+
+		Convey("closing the client twice returns the result of the first close", func() {
+			client, err := InitializeStatsdCollector(&StatsdCollectorConfig{StatsdAddr: conn.LocalAddr().String()})
+			So(err, ShouldBeNil)
+
+			So(client.Close(), ShouldBeNil)
+			So(client.Close(), ShouldBeNil)
+		})
+	})
+}
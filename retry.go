@@ -0,0 +1,153 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A *RetryError is returned when every attempt of a command with retries enabled has failed.
+// It holds the error of each attempt in order, the last one being the error that ended the retries.
+type RetryError struct {
+	Errors []error
+}
+
+func (e *RetryError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "Perseus: all attempts failed: " + strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the errors of all attempts, so errors.Is and errors.As can match any of them.
+func (e *RetryError) Unwrap() []error {
+	return e.Errors
+}
+
+// retrier carries the retry state shared by all attempts of a single command.
+type retrier struct {
+	sync.Mutex
+
+	name        string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	multiplier  float64
+	retryable   func(error) bool
+	errs        []error
+}
+
+func newRetrier(name string) *retrier {
+	cfg := config.GetCircuitConfig(name)
+	return &retrier{
+		name:        name,
+		maxAttempts: cfg.RetryMaxAttempts,
+		backoff:     cfg.RetryBackoff,
+		maxBackoff:  cfg.RetryMaxBackoff,
+		multiplier:  cfg.RetryBackoffMultiplier,
+		retryable:   cfg.Retryable,
+	}
+}
+
+// shouldRetry records the error of a failed attempt and reports whether another attempt should follow.
+// Retries stop once the attempts are used up, the error is not retryable, the context is done
+// or the circuit is no longer closed.
+func (r *retrier) shouldRetry(ctx context.Context, circuitBreaker *circuit.CircuitBreaker, err error) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	r.errs = append(r.errs, err)
+	if len(r.errs) >= r.maxAttempts {
+		return false
+	}
+	if err == ErrCircuitOpen || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if r.retryable != nil && !r.retryable(err) {
+		return false
+	}
+
+	return ctx.Err() == nil && !circuitBreaker.IsOpen()
+}
+
+// wrap returns the error to report once retries have stopped. A single failed attempt
+// is reported as is, more attempts are combined into a RetryError.
+func (r *retrier) wrap(err error) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.errs) <= 1 {
+		return err
+	}
+	errs := make([]error, len(r.errs))
+	copy(errs, r.errs)
+	return &RetryError{Errors: errs}
+}
+
+// nextBackoff computes the wait before the next attempt: the backoff grows exponentially
+// with every failed attempt up to maxBackoff, and half of it is randomized to spread retries out.
+func (r *retrier) nextBackoff() time.Duration {
+	r.Lock()
+	retries := len(r.errs)
+	r.Unlock()
+
+	backoff := float64(r.backoff) * math.Pow(r.multiplier, float64(retries-1))
+	if backoff > float64(r.maxBackoff) {
+		backoff = float64(r.maxBackoff)
+	}
+	half := backoff / 2
+	return time.Duration(half + rand.Float64()*half)
+}
+
+// retry waits for the backoff and then starts the next attempt of prev. If the context is done
+// or the circuit opened in the meantime, no attempt is started and the retries stop.
+func (r *retrier) retry(ctx context.Context, prev *Command) {
+	timer := time.NewTimer(r.nextBackoff())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		r.stop(ctx, prev, ctx.Err())
+		return
+	}
+	if prev.circuitBreaker.IsOpen() {
+		// the next attempt would only be short-circuited
+		r.stop(ctx, prev, ErrCircuitOpen)
+		return
+	}
+
+	next := newCommand(prev.name, prev.run, prev.fallback, prev.errChan)
+	next.retrier = r
+	next.results = prev.results
+	next.options = prev.options
+	next.execute(ctx)
+}
+
+// stop ends the command when the retries stop during the backoff, for the reason given by cause.
+// Nothing ran since prev, whose attempt is already recorded, so only the outcome of the fallback
+// is: it gets the error of the last attempt wrapped with cause.
+func (r *retrier) stop(ctx context.Context, prev *Command, cause error) {
+	prev.Lock()
+	outcome := prev.outcome
+	prev.Unlock()
+
+	err := fmt.Errorf("%w: %w", cause, r.wrap(outcome.Error))
+	result, fallbackErr := prev.tryFallback(ctx, outcome.Event, err)
+	if fallbackErr != nil {
+		config.GetLogger(prev.name).Debug("command failed", "circuit", prev.name, "error", fallbackErr)
+		prev.errChan <- fallbackErr
+	} else {
+		prev.sendResult(result)
+	}
+	prev.reportFallbackOutcome()
+}
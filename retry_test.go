@@ -0,0 +1,214 @@
+package Perseus
+
+import (
+	"Perseus/circuit"
+	"Perseus/config"
+	"Perseus/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRetry(t *testing.T) {
+	Convey("with a command allowing 3 attempts", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("retry", config.CommandConfig{RetryMaxAttempts: config.Int(3), RetryBackoff: config.Int(1)})
+		errFoo := fmt.Errorf("foo")
+
+		Convey("which fails twice and then succeeds", func() {
+			var attempts int32
+			err := DoC(context.Background(), "retry", func(ctx context.Context) error {
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					return errFoo
+				}
+				return nil
+			}, nil)
+
+			Convey("no error is returned", func() {
+				So(err, ShouldBeNil)
+				So(atomic.LoadInt32(&attempts), ShouldEqual, 3)
+			})
+
+			Convey("every attempt is recorded", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("retry")
+				So(cb.Metrics.DefaultCollector().NumRequests().Sum(time.Now()), ShouldEqual, 3)
+				So(cb.Metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 2)
+				So(cb.Metrics.DefaultCollector().Successes().Sum(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("which always fails", func() {
+			var attempts int32
+			fallbackErrs := make(chan error, 3)
+			err := DoC(context.Background(), "retry", func(ctx context.Context) error {
+				atomic.AddInt32(&attempts, 1)
+				return errFoo
+			}, func(ctx context.Context, err error) error {
+				fallbackErrs <- err
+				return nil
+			})
+
+			Convey("the fallback runs once with all attempt errors", func() {
+				So(err, ShouldBeNil)
+				So(atomic.LoadInt32(&attempts), ShouldEqual, 3)
+				So(len(fallbackErrs), ShouldEqual, 1)
+
+				var retryErr *RetryError
+				So(errors.As(<-fallbackErrs, &retryErr), ShouldBeTrue)
+				So(retryErr.Errors, ShouldResemble, []error{errFoo, errFoo, errFoo})
+			})
+
+			Convey("the fallback outcome is recorded once", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("retry")
+				So(cb.Metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 3)
+				So(cb.Metrics.DefaultCollector().FallbackSuccesses().Sum(time.Now()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("which times out", func() {
+			config.ConfigureCommand("retry", config.CommandConfig{RetryMaxAttempts: config.Int(2), RetryBackoff: config.Int(1), Timeout: config.Int(10)})
+			err := DoC(context.Background(), "retry", func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}, nil)
+
+			Convey("the returned error wraps every timeout", func() {
+				var retryErr *RetryError
+				So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+				So(errors.As(err, &retryErr), ShouldBeTrue)
+				So(retryErr.Errors, ShouldHaveLength, 2)
+			})
+		})
+
+		Convey("which succeeds only after every attempt timed out", func() {
+			config.ConfigureCommand("retry", config.CommandConfig{RetryMaxAttempts: config.Int(3), RetryBackoff: config.Int(1), Timeout: config.Int(10)})
+			cb, _, _ := circuit.GetCircuitBreaker("retry")
+			goroutines := runtime.NumGoroutine()
+			err := DoC(context.Background(), "retry", func(ctx context.Context) error {
+				time.Sleep(30 * time.Millisecond)
+				return nil
+			}, nil)
+
+			Convey("the timeouts are returned", func() {
+				var retryErr *RetryError
+				So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+				So(errors.As(err, &retryErr), ShouldBeTrue)
+				So(retryErr.Errors, ShouldHaveLength, 3)
+			})
+
+			Convey("only the timeouts are recorded", func() {
+				time.Sleep(100 * time.Millisecond)
+				So(cb.Metrics.DefaultCollector().Timeouts().Sum(time.Now()), ShouldEqual, 3)
+				So(cb.Metrics.DefaultCollector().Successes().Sum(time.Now()), ShouldEqual, 0)
+			})
+
+			Convey("no goroutine is left behind", func() {
+				So(waitForGoroutines(goroutines, time.Second), ShouldBeLessThanOrEqualTo, goroutines)
+			})
+		})
+	})
+}
+
+func TestRetryStops(t *testing.T) {
+	Convey("with a command allowing 5 attempts", t, func() {
+		defer circuit.Flush()
+		errFoo := fmt.Errorf("foo")
+		var attempts int32
+		run := func(ctx context.Context) error {
+			atomic.AddInt32(&attempts, 1)
+			return errFoo
+		}
+
+		Convey("an error which is not retryable is returned without retries", func() {
+			config.ConfigureCommand("retry", config.CommandConfig{
+				RetryMaxAttempts: config.Int(5),
+				RetryBackoff:     config.Int(1),
+				Retryable:        func(err error) bool { return err != errFoo },
+			})
+			err := DoC(context.Background(), "retry", run, nil)
+			var retryErr *RetryError
+			So(errors.Is(err, errFoo), ShouldBeTrue)
+			So(errors.As(err, &retryErr), ShouldBeFalse)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+		})
+
+		Convey("retries stop once the circuit opens", func() {
+			config.ConfigureCommand("retry", config.CommandConfig{
+				RetryMaxAttempts:            config.Int(5),
+				RetryBackoff:                config.Int(1),
+				TripStrategy:                circuit.TripConsecutiveFailures,
+				ConsecutiveFailureThreshold: config.Int(2),
+			})
+			err := DoC(context.Background(), "retry", run, nil)
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+			So(errors.Is(err, errFoo), ShouldBeTrue)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 2)
+
+			Convey("and no short-circuited attempt is recorded", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("retry")
+				So(cb.Metrics.DefaultCollector().NumRequests().Sum(time.Now()), ShouldEqual, 2)
+				So(cb.Metrics.DefaultCollector().ShortCircuits().Sum(time.Now()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("retries stop once the context is canceled", func() {
+			config.ConfigureCommand("retry", config.CommandConfig{RetryMaxAttempts: config.Int(5), RetryBackoff: config.Int(1000)})
+			ctx, cancel := context.WithCancel(context.Background())
+			errChan := GoC(ctx, "retry", run, nil)
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			err := <-errChan
+			So(errors.Is(err, errFoo), ShouldBeTrue)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+			So(atomic.LoadInt32(&attempts), ShouldEqual, 1)
+
+			var circuitErr *CircuitError
+			So(errors.As(err, &circuitErr), ShouldBeTrue)
+			So(circuitErr.Event, ShouldEqual, metrics.EventFailure)
+
+			Convey("and no attempt is recorded for the backoff", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("retry")
+				So(cb.Metrics.DefaultCollector().NumRequests().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().ContextCanceled().Sum(time.Now()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("the fallback run once the context is canceled is recorded", func() {
+			config.ConfigureCommand("retry", config.CommandConfig{RetryMaxAttempts: config.Int(5), RetryBackoff: config.Int(1000)})
+			ctx, cancel := context.WithCancel(context.Background())
+			errChan := GoC(ctx, "retry", run, func(ctx context.Context, err error) error {
+				return err
+			})
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			So(errors.Is(<-errChan, context.Canceled), ShouldBeTrue)
+
+			time.Sleep(100 * time.Millisecond)
+			cb, _, _ := circuit.GetCircuitBreaker("retry")
+			So(cb.Metrics.DefaultCollector().NumRequests().Sum(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics.DefaultCollector().Failures().Sum(time.Now()), ShouldEqual, 1)
+			So(cb.Metrics.DefaultCollector().FallbackFailures().Sum(time.Now()), ShouldEqual, 1)
+		})
+	})
+}
+
+// waitForGoroutines waits until at most n goroutines are running, or until the timeout,
+// and returns how many are running.
+func waitForGoroutines(n int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
@@ -1,116 +1,182 @@
 package rolling
 
 import (
-	"sync"
+	"math"
+	"runtime"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// DefaultNumberWindow is the window of a Number created with NewNumber.
+	DefaultNumberWindow = 10 * time.Second
+	// DefaultNumberBuckets is how many buckets a Number created with NewNumber splits its window into.
+	DefaultNumberBuckets = 10
+)
+
+// resettingBucket marks a bucket being recycled for a newer time slot.
+const resettingBucket = -1
+
 // Number tracks a numberBucket over a bounded number of
-// time buckets. Currently the buckets are one second long and only the last 10 seconds are kept.
+// time buckets. Only the buckets within the rolling window are kept.
+//
+// The buckets form a fixed-size ring indexed by time slot, so recording a value never allocates
+// nor takes a lock: a bucket left behind by the window is recycled by the first write to its
+// next time slot.
 type Number struct {
-	Buckets map[int64]*numberBucket
-	Mutex   *sync.RWMutex
+	buckets    []numberBucket
+	bucketSize time.Duration
+	numBuckets int64
 }
 
 type numberBucket struct {
-	Value float64
+	// key is the time slot the bucket currently holds, or resettingBucket while it is recycled
+	key int64
+	// value holds the bits of a float64
+	value uint64
 }
 
-// NewNumber initializes a RollingNumber struct.
+// NewNumber initializes a RollingNumber struct keeping the last 10 seconds in one second buckets.
 func NewNumber() *Number {
+	return NewNumberWindow(DefaultNumberWindow, DefaultNumberBuckets)
+}
+
+// NewNumberWindow initializes a RollingNumber struct keeping the last window split into the given number of buckets,
+// e.g. 30 seconds in 60 buckets of 500 milliseconds. Zero values use the defaults of NewNumber.
+func NewNumberWindow(window time.Duration, buckets int) *Number {
+	bucketSize, numBuckets := bucketsOf(window, buckets, DefaultNumberWindow, DefaultNumberBuckets)
 	r := &Number{
-		Buckets: make(map[int64]*numberBucket),
-		Mutex:   &sync.RWMutex{},
+		buckets:    make([]numberBucket, numBuckets),
+		bucketSize: bucketSize,
+		numBuckets: numBuckets,
 	}
 	return r
 }
 
-func (r *Number) getCurrentBucket() *numberBucket {
-	now := time.Now().Unix()
-	var bucket *numberBucket
-	var ok bool
-
-	if bucket, ok = r.Buckets[now]; !ok {
-		bucket = &numberBucket{}
-		r.Buckets[now] = bucket
+// bucketsOf splits window into buckets, falling back to the defaults for values which are not positive.
+func bucketsOf(window time.Duration, buckets int, defaultWindow time.Duration, defaultBuckets int) (time.Duration, int64) {
+	if window <= 0 {
+		window = defaultWindow
 	}
+	if buckets <= 0 {
+		buckets = defaultBuckets
+	}
+	bucketSize := window / time.Duration(buckets)
+	if bucketSize <= 0 {
+		bucketSize = 1
+	}
+	return bucketSize, int64(buckets)
+}
 
-	return bucket
+// Window returns the duration covered by the buckets of the Number.
+func (r *Number) Window() time.Duration {
+	return r.bucketSize * time.Duration(r.numBuckets)
 }
 
-func (r *Number) removeOldBuckets() {
-	now := time.Now().Unix() - 10
+// bucketKey returns the key of the bucket t falls into.
+func (r *Number) bucketKey(t time.Time) int64 {
+	return t.UnixNano() / int64(r.bucketSize)
+}
 
-	for timestamp := range r.Buckets {
-		// TODO: configurable rolling window
-		if timestamp <= now {
-			delete(r.Buckets, timestamp)
+// getCurrentBucket returns the bucket of the current time slot, recycling it if it still holds an older slot.
+// It returns nil if the bucket has already moved on to a newer slot, which only happens to a caller
+// delayed by a whole window.
+func (r *Number) getCurrentBucket() *numberBucket {
+	now := r.bucketKey(time.Now())
+	bucket := &r.buckets[now%r.numBuckets]
+
+	for {
+		key := atomic.LoadInt64(&bucket.key)
+		switch {
+		case key == now:
+			return bucket
+		case key == resettingBucket:
+			runtime.Gosched()
+		case key > now:
+			return nil
+		case atomic.CompareAndSwapInt64(&bucket.key, key, resettingBucket):
+			atomic.StoreUint64(&bucket.value, 0)
+			atomic.StoreInt64(&bucket.key, now)
+			return bucket
 		}
 	}
 }
 
+// load returns the value of the bucket if it holds a time slot after oldest, or false.
+func (b *numberBucket) load(oldest int64) (float64, bool) {
+	key := atomic.LoadInt64(&b.key)
+	if key <= oldest {
+		return 0, false
+	}
+	value := math.Float64frombits(atomic.LoadUint64(&b.value))
+	if atomic.LoadInt64(&b.key) != key {
+		// recycled while reading
+		return 0, false
+	}
+	return value, true
+}
+
 // Increment increments the number in current timeBucket.
 func (r *Number) Increment(i float64) {
 	if i == 0 {
 		return
 	}
 
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
-
 	b := r.getCurrentBucket()
-	b.Value += i
-	r.removeOldBuckets()
+	if b == nil {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&b.value)
+		if atomic.CompareAndSwapUint64(&b.value, old, math.Float64bits(math.Float64frombits(old)+i)) {
+			return
+		}
+	}
 }
 
 // UpdateMax updates the maximum value in the current bucket.
 func (r *Number) UpdateMax(n float64) {
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
-
 	b := r.getCurrentBucket()
-	if n > b.Value {
-		b.Value = n
+	if b == nil {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&b.value)
+		if n <= math.Float64frombits(old) || atomic.CompareAndSwapUint64(&b.value, old, math.Float64bits(n)) {
+			return
+		}
 	}
-	r.removeOldBuckets()
 }
 
-// Sum sums the values over the buckets in the last 10 seconds.
+// Sum sums the values over the buckets in the rolling window.
 func (r *Number) Sum(now time.Time) float64 {
 	sum := float64(0)
+	oldest := r.bucketKey(now) - r.numBuckets
 
-	r.Mutex.RLock()
-	defer r.Mutex.RUnlock()
-
-	for timestamp, bucket := range r.Buckets {
-		// TODO: configurable rolling window
-		if timestamp >= now.Unix()-10 {
-			sum += bucket.Value
+	for i := range r.buckets {
+		if value, ok := r.buckets[i].load(oldest); ok {
+			sum += value
 		}
 	}
 
 	return sum
 }
 
-// Max returns the maximum value seen in the last 10 seconds.
+// Max returns the maximum value seen in the rolling window.
 func (r *Number) Max(now time.Time) float64 {
 	var max float64
+	oldest := r.bucketKey(now) - r.numBuckets
 
-	r.Mutex.RLock()
-	defer r.Mutex.RUnlock()
-
-	for timestamp, bucket := range r.Buckets {
-		// TODO: configurable rolling window
-		if timestamp >= now.Unix()-10 {
-			if bucket.Value > max {
-				max = bucket.Value
-			}
+	for i := range r.buckets {
+		if value, ok := r.buckets[i].load(oldest); ok && value > max {
+			max = value
 		}
 	}
 
 	return max
 }
 
+// Avg returns the average value per second over the rolling window.
 func (r *Number) Avg(now time.Time) float64 {
-	return r.Sum(now) / 10
+	return r.Sum(now) / r.Window().Seconds()
 }
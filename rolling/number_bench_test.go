@@ -0,0 +1,110 @@
+package rolling
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapNumber is the map based implementation Number used to have, kept to compare against the ring buffer.
+type mapNumber struct {
+	Buckets map[int64]*mapNumberBucket
+	Mutex   *sync.RWMutex
+}
+
+type mapNumberBucket struct {
+	Value float64
+}
+
+func newMapNumber() *mapNumber {
+	return &mapNumber{
+		Buckets: make(map[int64]*mapNumberBucket),
+		Mutex:   &sync.RWMutex{},
+	}
+}
+
+func (r *mapNumber) getCurrentBucket() *mapNumberBucket {
+	now := time.Now().Unix()
+	bucket, ok := r.Buckets[now]
+	if !ok {
+		bucket = &mapNumberBucket{}
+		r.Buckets[now] = bucket
+	}
+	return bucket
+}
+
+func (r *mapNumber) removeOldBuckets() {
+	now := time.Now().Unix() - 10
+	for timestamp := range r.Buckets {
+		if timestamp <= now {
+			delete(r.Buckets, timestamp)
+		}
+	}
+}
+
+func (r *mapNumber) Increment(i float64) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+
+	r.getCurrentBucket().Value += i
+	r.removeOldBuckets()
+}
+
+func (r *mapNumber) Sum(now time.Time) float64 {
+	sum := float64(0)
+
+	r.Mutex.RLock()
+	defer r.Mutex.RUnlock()
+
+	for timestamp, bucket := range r.Buckets {
+		if timestamp >= now.Unix()-10 {
+			sum += bucket.Value
+		}
+	}
+	return sum
+}
+
+func BenchmarkNumberIncrementParallel(b *testing.B) {
+	n := NewNumber()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n.Increment(1)
+		}
+	})
+}
+
+func BenchmarkMapNumberIncrementParallel(b *testing.B) {
+	n := newMapNumber()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n.Increment(1)
+		}
+	})
+}
+
+// the mixed benchmarks read the sum once every 10 increments, as a health check would
+func BenchmarkNumberMixedParallel(b *testing.B) {
+	n := NewNumber()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				n.Sum(time.Now())
+			} else {
+				n.Increment(1)
+			}
+		}
+	})
+}
+
+func BenchmarkMapNumberMixedParallel(b *testing.B) {
+	n := newMapNumber()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				n.Sum(time.Now())
+			} else {
+				n.Increment(1)
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package rolling
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNumberWindow(t *testing.T) {
+	Convey("given a Number keeping 100ms in 10ms buckets", t, func() {
+		n := NewNumberWindow(100*time.Millisecond, 10)
+		So(n.Window(), ShouldEqual, 100*time.Millisecond)
+
+		n.Increment(1)
+		n.Increment(2)
+
+		Convey("values within the window are summed", func() {
+			So(n.Sum(time.Now()), ShouldEqual, 3)
+			So(n.Avg(time.Now()), ShouldEqual, 30)
+		})
+
+		Convey("values older than the window are dropped", func() {
+			So(n.Sum(time.Now().Add(110*time.Millisecond)), ShouldEqual, 0)
+
+			time.Sleep(110 * time.Millisecond)
+			n.Increment(4)
+			So(n.Sum(time.Now()), ShouldEqual, 4)
+			So(n.Max(time.Now()), ShouldEqual, 4)
+		})
+	})
+
+	Convey("NewNumber keeps 10 seconds", t, func() {
+		So(NewNumber().Window(), ShouldEqual, 10*time.Second)
+	})
+}
+
+func TestNumberConcurrentUpdates(t *testing.T) {
+	Convey("when Numbers are updated from many goroutines", t, func() {
+		sum := NewNumber()
+		max := NewNumber()
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					sum.Increment(1)
+					max.UpdateMax(float64(i*100 + j))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		Convey("no increment is lost", func() {
+			So(sum.Sum(time.Now()), ShouldEqual, 5000)
+		})
+		Convey("the largest value is kept", func() {
+			So(max.Max(time.Now()), ShouldEqual, 4999)
+		})
+	})
+}
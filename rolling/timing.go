@@ -2,147 +2,253 @@ package rolling
 
 import (
 	"math"
-	"sort"
+	"math/bits"
 	"sync"
 	"time"
 )
 
-// Timing maintains time Durations for each time bucket.
-// The Durations are kept in an array to allow for a variety of
-// statistics to be calculated from the source data.
+const (
+	// DefaultTimingWindow is the window of a Timing created with NewTiming.
+	DefaultTimingWindow = 60 * time.Second
+	// DefaultTimingBuckets is how many buckets a Timing created with NewTiming splits its window into.
+	DefaultTimingBuckets = 60
+
+	// MaxTimingDuration is the longest duration a Timing tells apart; longer durations are recorded as MaxTimingDuration.
+	MaxTimingDuration = time.Hour
+)
+
+// histogramSubBuckets is how many linear sub-buckets each power of two is split into,
+// which bounds the relative error of a percentile to 1/histogramSubBuckets.
+const (
+	histogramSubBucketBits = 6
+	histogramSubBuckets    = 1 << histogramSubBucketBits
+)
+
+// Timing maintains a histogram of time Durations for each time bucket.
+//
+// Durations are counted in log-linear buckets with microsecond resolution, in the fashion of
+// HdrHistogram: durations below 128µs are exact and longer ones fall into one of 64 buckets per power
+// of two. The memory used is therefore bounded whatever the throughput, while percentiles stay
+// within 1.6% of the recorded durations.
 type Timing struct {
-	Buckets map[int64]*timingBucket
-	Mutex   *sync.RWMutex
+	buckets map[int64]*timingBucket
+	mutex   *sync.RWMutex
+
+	bucketSize time.Duration
+	numBuckets int64
 
-	CachedSortedDurations []time.Duration
-	LastCachedTime        int64
+	cachedCounts   []uint64
+	cachedTotal    uint64
+	cachedSum      time.Duration
+	lastCachedTime int64
 }
 
 type timingBucket struct {
-	Durations []time.Duration
+	// counts holds the number of durations in each histogram bucket, up to the longest one seen
+	counts []uint64
+	total  uint64
+	sum    time.Duration
 }
 
-// NewTiming creates a RollingTiming struct.
+// NewTiming creates a RollingTiming struct keeping the last 60 seconds in one second buckets.
 func NewTiming() *Timing {
+	return NewTimingWindow(DefaultTimingWindow, DefaultTimingBuckets)
+}
+
+// NewTimingWindow creates a RollingTiming struct keeping the last window split into the given number of buckets.
+// Zero values use the defaults of NewTiming.
+func NewTimingWindow(window time.Duration, buckets int) *Timing {
+	bucketSize, numBuckets := bucketsOf(window, buckets, DefaultTimingWindow, DefaultTimingBuckets)
 	r := &Timing{
-		Buckets: make(map[int64]*timingBucket),
-		Mutex:   &sync.RWMutex{},
+		buckets:    make(map[int64]*timingBucket),
+		mutex:      &sync.RWMutex{},
+		bucketSize: bucketSize,
+		numBuckets: numBuckets,
 	}
 	return r
 }
 
-type byDuration []time.Duration
+// Window returns the duration covered by the buckets of the Timing.
+func (r *Timing) Window() time.Duration {
+	return r.bucketSize * time.Duration(r.numBuckets)
+}
 
-func (c byDuration) Len() int           { return len(c) }
-func (c byDuration) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
-func (c byDuration) Less(i, j int) bool { return c[i] < c[j] }
+// bucketKey returns the key of the bucket t falls into.
+func (r *Timing) bucketKey(t time.Time) int64 {
+	return t.UnixNano() / int64(r.bucketSize)
+}
 
-// SortedDurations returns an array of time.Duration sorted from shortest
-// to longest that have occurred in the last 60 seconds.
-func (r *Timing) SortedDurations() []time.Duration {
-	r.Mutex.RLock()
-	t := r.LastCachedTime
-	r.Mutex.RUnlock()
+// histogramIndex returns the histogram bucket of a duration in microseconds.
+func histogramIndex(us uint64) int {
+	shift := bits.Len64(us) - histogramSubBucketBits - 1
+	if shift < 0 {
+		shift = 0
+	}
+	return shift*histogramSubBuckets + int(us>>uint(shift))
+}
+
+// histogramValue returns the duration, in microseconds, standing for the durations counted in a histogram bucket:
+// the middle of the range it covers.
+func histogramValue(index int) uint64 {
+	if index < 2*histogramSubBuckets {
+		return uint64(index)
+	}
+	shift := uint(index/histogramSubBuckets - 1)
+	lower := uint64(index-int(shift)*histogramSubBuckets) << shift
+	return lower + (uint64(1)<<shift)/2
+}
 
-	if t+time.Duration(1*time.Second).Nanoseconds() > time.Now().UnixNano() {
+// aggregate merges the histograms of the buckets in the rolling window, at most once per bucket.
+func (r *Timing) aggregate() ([]uint64, uint64, time.Duration) {
+	r.mutex.RLock()
+	t := r.lastCachedTime
+	if t+r.bucketSize.Nanoseconds() > time.Now().UnixNano() {
 		// don't recalculate if current cache is still fresh
-		return r.CachedSortedDurations
+		defer r.mutex.RUnlock()
+		return r.cachedCounts, r.cachedTotal, r.cachedSum
 	}
+	r.mutex.RUnlock()
 
-	var durations byDuration
+	var counts []uint64
+	var total uint64
+	var sum time.Duration
 	now := time.Now()
 
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	for timestamp, b := range r.Buckets {
-		// TODO: configurable rolling window
-		if timestamp >= now.Unix()-60 {
-			for _, d := range b.Durations {
-				durations = append(durations, d)
+	oldest := r.bucketKey(now) - r.numBuckets
+	for timestamp, b := range r.buckets {
+		if timestamp > oldest {
+			if len(b.counts) > len(counts) {
+				counts = append(counts, make([]uint64, len(b.counts)-len(counts))...)
+			}
+			for i, c := range b.counts {
+				counts[i] += c
 			}
+			total += b.total
+			sum += b.sum
 		}
 	}
 
-	sort.Sort(durations)
+	r.cachedCounts = counts
+	r.cachedTotal = total
+	r.cachedSum = sum
+	r.lastCachedTime = time.Now().UnixNano()
 
-	r.CachedSortedDurations = durations
-	r.LastCachedTime = time.Now().UnixNano()
-
-	return r.CachedSortedDurations
+	return counts, total, sum
 }
 
+// getCurrentBucket must be called with the mutex held.
 func (r *Timing) getCurrentBucket() *timingBucket {
-	r.Mutex.RLock()
-	now := time.Now()
-	bucket, exists := r.Buckets[now.Unix()]
-	r.Mutex.RUnlock()
-
+	now := r.bucketKey(time.Now())
+	bucket, exists := r.buckets[now]
 	if !exists {
-		r.Mutex.Lock()
-		defer r.Mutex.Unlock()
-
-		r.Buckets[now.Unix()] = &timingBucket{}
-		bucket = r.Buckets[now.Unix()]
+		bucket = &timingBucket{}
+		r.buckets[now] = bucket
 	}
 
 	return bucket
 }
 
 func (r *Timing) removeOldBuckets() {
-	now := time.Now()
+	oldest := r.bucketKey(time.Now()) - r.numBuckets
 
-	for timestamp := range r.Buckets {
-		// TODO: configurable rolling window
-		if timestamp <= now.Unix()-60 {
-			delete(r.Buckets, timestamp)
+	for timestamp := range r.buckets {
+		if timestamp <= oldest {
+			delete(r.buckets, timestamp)
 		}
 	}
 }
 
-// Add appends the time.Duration given to the current time bucket.
+// Add counts the time.Duration given in the current time bucket.
 func (r *Timing) Add(duration time.Duration) {
-	b := r.getCurrentBucket()
+	if duration < 0 {
+		duration = 0
+	}
+	if duration > MaxTimingDuration {
+		duration = MaxTimingDuration
+	}
+	index := histogramIndex(uint64(duration / time.Microsecond))
 
-	r.Mutex.Lock()
-	defer r.Mutex.Unlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	b.Durations = append(b.Durations, duration)
+	b := r.getCurrentBucket()
+	if index >= len(b.counts) {
+		b.counts = append(b.counts, make([]uint64, index+1-len(b.counts))...)
+	}
+	b.counts[index]++
+	b.total++
+	b.sum += duration
 	r.removeOldBuckets()
 }
 
-// Percentile computes the percentile given with a linear interpolation.
-func (r *Timing) Percentile(p float64) uint32 {
-	sortedDurations := r.SortedDurations()
-	length := len(sortedDurations)
-	if length <= 0 {
+// Count returns how many durations were added in the rolling window.
+func (r *Timing) Count() uint64 {
+	_, total, _ := r.aggregate()
+	return total
+}
+
+// PercentileDuration computes the duration below which the given percent of the durations in the rolling window fall.
+func (r *Timing) PercentileDuration(p float64) time.Duration {
+	counts, total, _ := r.aggregate()
+	if total == 0 {
 		return 0
 	}
 
-	pos := r.ordinal(len(sortedDurations), p) - 1
-	return uint32(sortedDurations[pos].Nanoseconds() / 1000000)
+	rank := r.ordinal(total, p)
+	var seen uint64
+	for i, c := range counts {
+		seen += c
+		if seen >= rank {
+			return time.Duration(histogramValue(i)) * time.Microsecond
+		}
+	}
+	return time.Duration(histogramValue(len(counts)-1)) * time.Microsecond
 }
 
-func (r *Timing) ordinal(length int, percentile float64) int64 {
-	if percentile == 0 && length > 0 {
+// Percentile computes the percentile given, in milliseconds.
+func (r *Timing) Percentile(p float64) uint32 {
+	return uint32(r.PercentileDuration(p) / time.Millisecond)
+}
+
+func (r *Timing) ordinal(length uint64, percentile float64) uint64 {
+	if percentile <= 0 {
 		return 1
 	}
 
-	return int64(math.Ceil((percentile / float64(100)) * float64(length)))
+	rank := uint64(math.Ceil((percentile / float64(100)) * float64(length)))
+	if rank > length {
+		return length
+	}
+	return rank
 }
 
-// Mean computes the average timing in the last 60 seconds.
+// Mean computes the average timing in the rolling window, in milliseconds.
 func (r *Timing) Mean() uint32 {
-	sortedDurations := r.SortedDurations()
-	var sum time.Duration
-	for _, d := range sortedDurations {
-		sum += d
-	}
-
-	length := int64(len(sortedDurations))
-	if length == 0 {
+	_, total, sum := r.aggregate()
+	if total == 0 {
 		return 0
 	}
 
-	return uint32(sum.Nanoseconds()/length) / 1000000
+	return uint32(sum / time.Duration(total) / time.Millisecond)
+}
+
+// SortedDurations returns the durations in the rolling window, from the shortest to the longest.
+// Each duration is the one standing for its histogram bucket, so it is within 1.6% of the duration added.
+//
+// Deprecated: the slice holds one duration per duration added, while the Timing itself only keeps
+// counts. Use PercentileDuration and Count instead.
+func (r *Timing) SortedDurations() []time.Duration {
+	counts, total, _ := r.aggregate()
+
+	durations := make([]time.Duration, 0, total)
+	for i, c := range counts {
+		d := time.Duration(histogramValue(i)) * time.Microsecond
+		for j := uint64(0); j < c; j++ {
+			durations = append(durations, d)
+		}
+	}
+	return durations
 }
@@ -0,0 +1,139 @@
+package rolling
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTimingWindow(t *testing.T) {
+	Convey("given a Timing keeping 100ms in 10ms buckets", t, func() {
+		r := NewTimingWindow(100*time.Millisecond, 10)
+		So(r.Window(), ShouldEqual, 100*time.Millisecond)
+
+		r.Add(10 * time.Millisecond)
+		r.Add(30 * time.Millisecond)
+
+		Convey("durations within the window are used", func() {
+			So(r.Mean(), ShouldEqual, 20)
+		})
+
+		Convey("durations older than the window are dropped", func() {
+			time.Sleep(110 * time.Millisecond)
+			r.Add(50 * time.Millisecond)
+			So(r.Mean(), ShouldEqual, 50)
+		})
+	})
+}
+
+func TestOrdinal(t *testing.T) {
+	r := NewTiming()
+	Convey("given a percentile and a number of durations", t, func() {
+		Convey("the ordinal is the rank of the duration at that percentile", func() {
+			So(r.ordinal(10, 0), ShouldEqual, 1)
+			So(r.ordinal(10, 50), ShouldEqual, 5)
+			So(r.ordinal(10, 99), ShouldEqual, 10)
+			So(r.ordinal(10, 100), ShouldEqual, 10)
+			So(r.ordinal(200, 99.5), ShouldEqual, 199)
+		})
+	})
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	Convey("durations below 128µs are counted exactly", t, func() {
+		for us := uint64(0); us < 128; us++ {
+			So(histogramValue(histogramIndex(us)), ShouldEqual, us)
+		}
+	})
+
+	Convey("longer durations are counted within 1/64 of their value", t, func() {
+		for _, us := range []uint64{128, 129, 1000, 12345, 999999, 3600000000} {
+			v := histogramValue(histogramIndex(us))
+			So(float64(v), ShouldAlmostEqual, float64(us), float64(us)/64)
+		}
+	})
+}
+
+func TestPercentileDuration(t *testing.T) {
+	Convey("given a Timing with 10000 random durations up to 2 seconds", t, func() {
+		r := NewTiming()
+		durations := make([]time.Duration, 10000)
+		rnd := rand.New(rand.NewSource(1))
+		for i := range durations {
+			durations[i] = time.Duration(rnd.Int63n(int64(2 * time.Second)))
+			r.Add(durations[i])
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+		Convey("every duration is counted", func() {
+			So(r.Count(), ShouldEqual, 10000)
+		})
+
+		Convey("percentiles are within 1.6% of the exact ones", func() {
+			for _, p := range []float64{50, 90, 99, 99.9} {
+				exact := durations[r.ordinal(10000, p)-1]
+				So(float64(r.PercentileDuration(p)), ShouldAlmostEqual, float64(exact), float64(exact)/64)
+			}
+		})
+
+		Convey("Percentile reports whole milliseconds", func() {
+			So(r.Percentile(50), ShouldEqual, uint32(r.PercentileDuration(50)/time.Millisecond))
+		})
+	})
+
+	Convey("given a Timing without durations", t, func() {
+		r := NewTiming()
+
+		Convey("percentiles are 0", func() {
+			So(r.PercentileDuration(99), ShouldEqual, 0)
+			So(r.Percentile(99), ShouldEqual, 0)
+		})
+	})
+
+	Convey("durations keep microsecond resolution", t, func() {
+		r := NewTiming()
+		r.Add(750 * time.Microsecond)
+
+		So(r.PercentileDuration(100), ShouldAlmostEqual, 750*time.Microsecond, 12*time.Microsecond)
+		So(r.Percentile(100), ShouldEqual, 0)
+	})
+}
+
+func TestMean(t *testing.T) {
+	Convey("means above 4.29 seconds do not wrap around", t, func() {
+		r := NewTiming()
+		r.Add(4 * time.Second)
+		r.Add(6 * time.Second)
+
+		So(r.Mean(), ShouldEqual, 5000)
+	})
+
+	Convey("a Timing without durations has a mean of 0", t, func() {
+		So(NewTiming().Mean(), ShouldEqual, 0)
+	})
+}
+
+func TestSortedDurations(t *testing.T) {
+	Convey("given a Timing with durations added out of order", t, func() {
+		r := NewTiming()
+		for _, d := range []time.Duration{300 * time.Millisecond, 20 * time.Microsecond, 5 * time.Second, 300 * time.Millisecond} {
+			r.Add(d)
+		}
+
+		Convey("every duration is returned from the shortest to the longest, within 1.6%", func() {
+			durations := r.SortedDurations()
+			So(durations, ShouldHaveLength, 4)
+			So(durations[0], ShouldEqual, 20*time.Microsecond)
+			So(durations[1], ShouldAlmostEqual, 300*time.Millisecond, 300*time.Millisecond/64)
+			So(durations[2], ShouldEqual, durations[1])
+			So(durations[3], ShouldAlmostEqual, 5*time.Second, 5*time.Second/64)
+		})
+	})
+
+	Convey("a Timing without durations has no sorted durations", t, func() {
+		So(NewTiming().SortedDurations(), ShouldBeEmpty)
+	})
+}
@@ -3,9 +3,8 @@ package Perseus
 import (
 	"Perseus/circuit"
 	"Perseus/config"
+	"Perseus/metrics"
 	"context"
-	"fmt"
-	"log"
 	"sync"
 	"time"
 )
@@ -15,15 +14,14 @@ type FallbackFunc func(error) error
 type RunFuncC func(context.Context) error
 type FallbackFuncC func(context.Context, error) error
 
-// A CircuitError is an error which models various failure states of execution,
-// such as the circuit being open or a timeout.
-type CircuitError struct {
-	Message string
-}
+// runFunc and fallbackFunc are the run and fallback functions of a Command, returning its result
+// along with the error.
+type runFunc func(context.Context) (interface{}, error)
+type fallbackFunc func(context.Context, error) (interface{}, error)
 
-func (e CircuitError) Error() string {
-	return "Perseus: " + e.Message
-}
+// A CircuitError is an error which models various failure states of execution,
+// such as the circuit being open or a timeout. See circuit.CircuitError.
+type CircuitError = circuit.CircuitError
 
 // Command models the state used for a single execution on a circuit. "Perseus command" is commonly
 // used to describe the pairing of your run/fallback functions with a circuit.
@@ -36,25 +34,31 @@ type Command struct {
 	ticketGot      bool
 	returnOnce     *sync.Once
 	circuitBreaker *circuit.CircuitBreaker
-	run            RunFuncC
-	fallback       FallbackFuncC
+	run            runFunc
+	fallback       fallbackFunc
 	start          time.Time
 	errChan        chan error
+	results        chan interface{}
+	options        *options
+	pool           *circuit.ExecutorPool
 	finished       chan bool
 	runDuration    time.Duration
-	events         []string
+	outcome        metrics.Outcome
+	retrier        *retrier
 }
 
 var (
 	// ErrMaxConcurrency occurs when too many of the same named command are executed at the same time.
-	ErrMaxConcurrency = CircuitError{Message: "max concurrency"}
+	ErrMaxConcurrency = &CircuitError{Event: metrics.EventRejected, Message: "max concurrency"}
 	// ErrCircuitOpen returns when an execution attempt "short circuits". This happens due to the circuit being measured as unhealthy.
-	ErrCircuitOpen = CircuitError{Message: "circuit open"}
+	ErrCircuitOpen = &CircuitError{Event: metrics.EventShortCircuit, Message: "circuit open"}
 	// ErrTimeout occurs when the provided function takes too long to execute.
-	ErrTimeout = CircuitError{Message: "timeout"}
+	ErrTimeout = &CircuitError{Event: metrics.EventTimeout, Message: "timeout"}
+	// ErrRateLimited occurs when more commands of the same name start than the rate limiter of the circuit allows.
+	ErrRateLimited = &CircuitError{Event: metrics.EventRateLimited, Message: "rate limited"}
 )
 
-func Go(name string, run RunFunc, fallback FallbackFunc) chan error {
+func Go(name string, run RunFunc, fallback FallbackFunc, opts ...Option) chan error {
 	runC := func(context.Context) error {
 		return run()
 	}
@@ -64,7 +68,7 @@ func Go(name string, run RunFunc, fallback FallbackFunc) chan error {
 			return fallback(err)
 		}
 	}
-	return GoC(context.Background(), name, runC, fallbackC)
+	return GoC(context.Background(), name, runC, fallbackC, opts...)
 }
 
 // GoC runs your function while tracking the health of previous calls to it.
@@ -72,66 +76,171 @@ func Go(name string, run RunFunc, fallback FallbackFunc) chan error {
 // new calls to it for you to give the dependent service time to repair.
 //
 // Define a fallback function if you want to define some code to execute during outages.
-func GoC(ctx context.Context, name string, run RunFuncC, fallback FallbackFuncC) chan error {
+// Options override the settings of the circuit for this command only.
+func GoC(ctx context.Context, name string, run RunFuncC, fallback FallbackFuncC, opts ...Option) chan error {
+	o := newOptions(opts)
+	if o.fallback != nil {
+		fallback = o.fallback
+	}
+	return goC(ctx, name, run, fallback, nil, o)
+}
+
+// goC starts a command whose run and fallback functions only return an error. If results is set,
+// nil is sent to it once the command succeeds.
+func goC(ctx context.Context, name string, run RunFuncC, fallback FallbackFuncC, results chan interface{}, o *options) chan error {
+	r := func(ctx context.Context) (interface{}, error) {
+		return nil, run(ctx)
+	}
+	var f fallbackFunc
+	if fallback != nil {
+		f = func(ctx context.Context, err error) (interface{}, error) {
+			return nil, fallback(ctx, err)
+		}
+	}
+	return goCommand(ctx, name, r, f, results, o)
+}
+
+// goCommand starts a command and returns the channel its error is sent to. If results is set,
+// the result of the run or fallback function is sent to it once the command succeeds.
+func goCommand(ctx context.Context, name string, run runFunc, fallback fallbackFunc, results chan interface{}, o *options) chan error {
+	cmd := newCommand(name, run, fallback, make(chan error, 1))
+	cmd.results = results
+	cmd.options = o
+	if config.GetCircuitConfig(name).RetryMaxAttempts > 1 {
+		cmd.retrier = newRetrier(name)
+	}
+	cmd.execute(ctx)
+	return cmd.errChan
+}
+
+func newCommand(name string, run runFunc, fallback fallbackFunc, errChan chan error) *Command {
 	cmd := &Command{
 		name:       name,
 		run:        run,
 		ticketGot:  false,
 		fallback:   fallback,
 		start:      time.Now(),
-		errChan:    make(chan error, 1),
+		errChan:    errChan,
 		finished:   make(chan bool, 1),
 		returnOnce: &sync.Once{},
 	}
 	cmd.ticketCond = sync.NewCond(cmd)
+	return cmd
+}
+
+// timeout returns how long to wait for the command to complete.
+func (c *Command) timeout() time.Duration {
+	if c.options.timeout > 0 {
+		return c.options.timeout
+	}
+	return config.GetCircuitConfig(c.name).Timeout
+}
 
-	circuitBreaker, _, err := circuit.GetCircuitBreaker(name)
+// execute starts a single attempt of the command on its circuit.
+func (c *Command) execute(ctx context.Context) {
+	circuitBreaker, _, err := circuit.GetCircuitBreaker(c.name)
 	if err != nil {
-		cmd.errChan <- err
-		return cmd.errChan
+		c.errChan <- err
+		return
 	}
-	cmd.circuitBreaker = circuitBreaker
-	go cmd.firstGoroutine(ctx)
-	go cmd.secondGoroutine(ctx)
-	return cmd.errChan
+	c.circuitBreaker = circuitBreaker
+	c.pool = circuitBreaker.Pool()
+	if c.options.pool != "" {
+		c.pool = circuit.GetExecutorPool(c.options.pool)
+	}
+	go c.firstGoroutine(ctx)
+	go c.secondGoroutine(ctx)
 }
 
-func (c *Command) returnTicket() {
+// reject ends the command without running it, e.g. because the circuit is open.
+func (c *Command) reject(ctx context.Context, err error) {
+	c.Lock()
+	// It's safe for another goroutine to go ahead releasing a nil ticket.
+	c.ticketGot = true
+	c.ticketCond.Signal()
+	c.Unlock()
+	c.returnOnce.Do(func() {
+		c.returnTicket(0, false)
+		c.errorWithFallback(ctx, err)
+	})
+}
+
+// returnTicket gives the ticket of the command back to its pool. When the run duration is known,
+// or the command timed out, it is reported to the pool first so that an adaptive pool adjusts its limit.
+func (c *Command) returnTicket(rtt time.Duration, dropped bool) {
 	c.Lock()
 	// Avoid releasing before a ticket is acquired.
 	for !c.ticketGot {
 		c.ticketCond.Wait()
 	}
-	c.circuitBreaker.ExecutorPool.ReturnTicket(c.ticket)
+	if c.ticket != nil && (rtt > 0 || dropped) {
+		c.pool.Observe(rtt, dropped)
+	}
+	c.pool.ReturnTicket(c.ticket)
 	c.Unlock()
 }
 
-func (c *Command) reportEvent(eventType string) {
+// reportEvent records what happened to the run function, and the error which ended it.
+func (c *Command) reportEvent(eventType metrics.EventType, err error) {
 	c.Lock()
 	defer c.Unlock()
 
-	c.events = append(c.events, eventType)
+	c.outcome.Event = eventType
+	c.outcome.Error = err
+}
+
+// reportFallbackEvent records what happened to the fallback function.
+func (c *Command) reportFallbackEvent(eventType metrics.EventType, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.outcome.Fallback = eventType
+	c.outcome.FallbackError = err
 }
 
 func (c *Command) reportAllEvents() {
-	err := c.circuitBreaker.ReportEvent(c.events, c.start, c.runDuration)
+	c.Lock()
+	outcome := c.outcome
+	c.Unlock()
+	c.report(outcome)
+}
+
+// reportFallbackOutcome records only what happened to the fallback function, for a command whose
+// run event was already recorded. Nothing is recorded if no fallback ran.
+func (c *Command) reportFallbackOutcome() {
+	c.Lock()
+	outcome := metrics.Outcome{Fallback: c.outcome.Fallback, FallbackError: c.outcome.FallbackError}
+	c.Unlock()
+	if outcome.Fallback == metrics.EventNone {
+		return
+	}
+	c.report(outcome)
+}
+
+func (c *Command) report(outcome metrics.Outcome) {
+	outcome.Tags = c.options.tags
+	outcome.Pool = c.options.pool
+
+	err := c.circuitBreaker.ReportEvent(outcome, c.start, c.runDuration)
 	if err != nil {
-		log.Printf(err.Error())
+		config.GetLogger(c.name).Error("failed to report events", "circuit", c.name, "error", err)
 	}
 }
 
 func (c *Command) firstGoroutine(ctx context.Context) {
 	defer func() { c.finished <- true }()
-	if !c.circuitBreaker.AllowRequest() {
-		c.Lock()
-		// It's safe for another goroutine to go ahead releasing a nil ticket.
-		c.ticketGot = true
-		c.ticketCond.Signal()
-		c.Unlock()
-		c.returnOnce.Do(func() {
-			c.returnTicket()
-			c.errorWithFallback(ctx, ErrCircuitOpen)
-		})
+	allowed, trial := c.circuitBreaker.AllowTrialRequest()
+	if !allowed {
+		c.reject(ctx, ErrCircuitOpen)
+		return
+	}
+	c.Lock()
+	c.outcome.Trial = trial
+	c.Unlock()
+	// Commands over the rate limit are rejected before they take a ticket, so that they hold none
+	// of the concurrency of the pool.
+	if !c.circuitBreaker.AllowRate() {
+		c.reject(ctx, ErrRateLimited)
 		return
 	}
 	// As backends falter, requests take longer but don't always fail.
@@ -139,41 +248,68 @@ func (c *Command) firstGoroutine(ctx context.Context) {
 	// When requests slow down but the incoming rate of requests stays the same, you have to
 	// run more at a time to keep up. By controlling concurrency during these situations, you can
 	// shed load which accumulates due to the increasing ratio of active commands to incoming requests.
+	//
+	// Commands may wait in the pool's queue for a ticket, but never past their own timeout.
+	deadline := c.start.Add(c.timeout())
+	queueCtx, cancel := context.WithDeadline(ctx, deadline)
+	ticket := c.pool.AcquireTicket(queueCtx)
+	cancel()
+
+	// A command which timed out or was canceled while queued ends as secondGoroutine ends it,
+	// even if a ticket came in the meantime: the run function must not start once the command ended.
+	err := ctx.Err()
+	if err == nil && !time.Now().Before(deadline) {
+		err = ErrTimeout
+	}
+	if err == nil && ticket == nil {
+		err = ErrMaxConcurrency
+	}
+
 	c.Lock()
-	select {
-	case c.ticket = <-c.circuitBreaker.ExecutorPool.Tickets:
-		c.ticketGot = true
-		c.ticketCond.Signal()
-		c.Unlock()
-	default:
-		c.ticketGot = true
-		c.ticketCond.Signal()
-		c.Unlock()
+	if err != nil {
+		c.pool.ReturnTicket(ticket)
+		ticket = nil
+	}
+	c.ticket = ticket
+	c.ticketGot = true
+	c.ticketCond.Signal()
+	c.Unlock()
+	if ticket == nil {
 		c.returnOnce.Do(func() {
-			c.returnTicket()
-			c.errorWithFallback(ctx, ErrMaxConcurrency)
+			c.returnTicket(0, false)
+			c.errorWithFallback(ctx, err)
 		})
 		return
 	}
+	run := c.run
+	if c.options.hedge {
+		run = c.runHedged
+	}
 	runStart := time.Now()
-	runErr := c.run(ctx)
-	log.Printf("runErr: %v", runErr)
+	result, runErr := run(ctx)
 
 	c.returnOnce.Do(func() {
 		c.runDuration = time.Since(runStart)
-		c.returnTicket()
-		log.Printf("runErr: %v", runErr)
+		c.returnTicket(c.runDuration, false)
 		if runErr != nil {
+			config.GetLogger(c.name).Debug("run failed", "circuit", c.name, "error", runErr)
 			c.errorWithFallback(ctx, runErr)
 			return
 		}
-		c.reportEvent("success")
+		c.reportEvent(metrics.EventSuccess, nil)
+		c.sendResult(result)
 		c.reportAllEvents()
 	})
 }
 
+func (c *Command) sendResult(result interface{}) {
+	if c.results != nil {
+		c.results <- result
+	}
+}
+
 func (c *Command) secondGoroutine(ctx context.Context) {
-	timer := time.NewTimer(config.GetCircuitConfig(c.name).Timeout)
+	timer := time.NewTimer(c.timeout())
 	defer timer.Stop()
 
 	select {
@@ -181,14 +317,14 @@ func (c *Command) secondGoroutine(ctx context.Context) {
 		// returnOnce has been executed in another goroutine
 	case <-ctx.Done():
 		c.returnOnce.Do(func() {
-			c.returnTicket()
+			c.returnTicket(0, false)
 			c.errorWithFallback(ctx, ctx.Err())
 		})
 		return
 	case <-timer.C:
 		c.returnOnce.Do(func() {
-			log.Printf("runErr: timeout")
-			c.returnTicket()
+			config.GetLogger(c.name).Debug("run timed out", "circuit", c.name, "timeout", c.timeout())
+			c.returnTicket(c.timeout(), true)
 			c.errorWithFallback(ctx, ErrTimeout)
 		})
 		return
@@ -196,46 +332,62 @@ func (c *Command) secondGoroutine(ctx context.Context) {
 }
 
 func (c *Command) errorWithFallback(ctx context.Context, err error) {
-	eventType := "failure"
+	eventType := metrics.EventFailure
 	if err == ErrCircuitOpen {
-		eventType = "short-circuit"
+		eventType = metrics.EventShortCircuit
 	} else if err == ErrMaxConcurrency {
-		eventType = "rejected"
+		eventType = metrics.EventRejected
 	} else if err == ErrTimeout {
-		eventType = "timeout"
+		eventType = metrics.EventTimeout
+	} else if err == ErrRateLimited {
+		eventType = metrics.EventRateLimited
 	} else if err == context.Canceled {
-		eventType = "context_canceled"
+		eventType = metrics.EventContextCanceled
 	} else if err == context.DeadlineExceeded {
-		eventType = "context_deadline_exceeded"
+		eventType = metrics.EventContextDeadlineExceeded
 	}
 
-	c.reportEvent(eventType)
-	fallbackErr := c.tryFallback(ctx, err)
+	c.reportEvent(eventType, err)
+	if c.retrier != nil {
+		if c.retrier.shouldRetry(ctx, c.circuitBreaker, err) {
+			config.GetLogger(c.name).Debug("retrying command", "circuit", c.name, "error", err)
+			c.reportAllEvents()
+			go c.retrier.retry(ctx, c)
+			return
+		}
+		err = c.retrier.wrap(err)
+	}
+	result, fallbackErr := c.tryFallback(ctx, eventType, err)
 	if fallbackErr != nil {
-		log.Printf("fallbackErr: %v", fallbackErr)
+		config.GetLogger(c.name).Debug("command failed", "circuit", c.name, "error", fallbackErr)
 		c.errChan <- fallbackErr
+	} else {
+		c.sendResult(result)
 	}
 	c.reportAllEvents()
 }
 
-func (c *Command) tryFallback(ctx context.Context, err error) error {
+// tryFallback runs the fallback of the command, if any. The error returned when there is no fallback,
+// or when the fallback fails too, is a CircuitError holding the error which ended the run and the error
+// of the fallback, if any.
+func (c *Command) tryFallback(ctx context.Context, eventType metrics.EventType, err error) (interface{}, error) {
 	if c.fallback == nil {
-		return err
+		return nil, &CircuitError{Name: c.name, Event: eventType, RunErr: err}
 	}
 
-	fallbackErr := c.fallback(ctx, err)
+	result, fallbackErr := c.fallback(ctx, err)
 	if fallbackErr != nil {
-		c.reportEvent("fallback-failure")
-		return fmt.Errorf("fallback err: %v, run err: %v", fallbackErr, err)
+		c.reportFallbackEvent(metrics.EventFallbackFailure, fallbackErr)
+		return nil, &CircuitError{Name: c.name, Event: eventType, RunErr: err, FallbackErr: fallbackErr}
 	}
-	c.reportEvent("fallback-success")
+	c.reportFallbackEvent(metrics.EventFallbackSuccess, nil)
 
-	return nil
+	return result, nil
 }
 
 // Do runs your function in a synchronous manner, blocking until either your function succeeds
 // or an error is returned, including Perseus circuit errors
-func Do(name string, run RunFunc, fallback FallbackFunc) error {
+func Do(name string, run RunFunc, fallback FallbackFunc, opts ...Option) error {
 	runC := func(ctx context.Context) error {
 		return run()
 	}
@@ -245,43 +397,23 @@ func Do(name string, run RunFunc, fallback FallbackFunc) error {
 			return fallback(err)
 		}
 	}
-	return DoC(context.Background(), name, runC, fallbackC)
+	return DoC(context.Background(), name, runC, fallbackC, opts...)
 }
 
 // DoC runs your function in a synchronous manner, blocking until either your function succeeds
 // or an error is returned, including Perseus circuit errors
-func DoC(ctx context.Context, name string, run RunFuncC, fallback FallbackFuncC) error {
-	done := make(chan struct{}, 1)
-
-	r := func(ctx context.Context) error {
-		err := run(ctx)
-		if err != nil {
-			return err
-		}
-
-		done <- struct{}{}
-		return nil
-	}
-
-	f := func(ctx context.Context, e error) error {
-		err := fallback(ctx, e)
-		if err != nil {
-			return err
-		}
-
-		done <- struct{}{}
-		return nil
-	}
-
-	var errChan chan error
-	if fallback == nil {
-		errChan = GoC(ctx, name, r, nil)
-	} else {
-		errChan = GoC(ctx, name, r, f)
+func DoC(ctx context.Context, name string, run RunFuncC, fallback FallbackFuncC, opts ...Option) error {
+	o := newOptions(opts)
+	if o.fallback != nil {
+		fallback = o.fallback
 	}
+	// The command sends exactly one of its result or its error, once it has finished: the result
+	// of an attempt which returns after the command timed out, or after it was retried, is discarded.
+	results := make(chan interface{}, 1)
+	errChan := goC(ctx, name, run, fallback, results, o)
 
 	select {
-	case <-done:
+	case <-results:
 		return nil
 	case err := <-errChan:
 		return err
@@ -3,8 +3,12 @@ package Perseus
 import (
 	"Perseus/circuit"
 	"Perseus/config"
+	"Perseus/metrics"
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -71,7 +75,7 @@ func TestFallback(t *testing.T) {
 func TestTimeout(t *testing.T) {
 	Convey("with a command which times out, and whose fallback sends to a channel", t, func() {
 		defer circuit.Flush()
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 100})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(100)})
 
 		resultChan := make(chan int)
 		errChan := GoC(context.Background(), "", func(ctx context.Context) error {
@@ -79,7 +83,7 @@ func TestTimeout(t *testing.T) {
 			resultChan <- 1
 			return nil
 		}, func(ctx context.Context, err error) error {
-			if err == ErrTimeout {
+			if errors.Is(err, ErrTimeout) {
 				resultChan <- 2
 			}
 			return nil
@@ -97,7 +101,7 @@ func TestTimeout(t *testing.T) {
 func TestTimeoutEmptyFallback(t *testing.T) {
 	Convey("with a command which times out, and has no fallback", t, func() {
 		defer circuit.Flush()
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 100})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(100)})
 
 		resultChan := make(chan int)
 		errChan := GoC(context.Background(), "", func(ctx context.Context) error {
@@ -107,7 +111,7 @@ func TestTimeoutEmptyFallback(t *testing.T) {
 		}, nil)
 
 		Convey("a timeout error should be returned", func() {
-			So(<-errChan, ShouldResemble, ErrTimeout)
+			So(errors.Is(<-errChan, ErrTimeout), ShouldBeTrue)
 
 			Convey("metrics are recorded", func() {
 				time.Sleep(10 * time.Millisecond)
@@ -124,7 +128,7 @@ func TestTimeoutEmptyFallback(t *testing.T) {
 func TestMaxConcurrent(t *testing.T) {
 	Convey("if a command has max concurrency set to 2", t, func() {
 		defer circuit.Flush()
-		config.ConfigureCommand("", config.CommandConfig{MaxConcurrentRequests: 2})
+		config.ConfigureCommand("", config.CommandConfig{MaxConcurrentRequests: config.Int(2)})
 		resultChan := make(chan int)
 
 		run := func(ctx context.Context) error {
@@ -142,7 +146,7 @@ func TestMaxConcurrent(t *testing.T) {
 
 				select {
 				case err := <-errChan:
-					if err == ErrMaxConcurrency {
+					if errors.Is(err, ErrMaxConcurrency) {
 						bad++
 					}
 				default:
@@ -175,7 +179,7 @@ func TestForceOpenCircuit(t *testing.T) {
 		}, nil)
 
 		Convey("a 'circuit open' error is returned", func() {
-			So(<-errChan, ShouldResemble, ErrCircuitOpen)
+			So(errors.Is(<-errChan, ErrCircuitOpen), ShouldBeTrue)
 
 			Convey("metrics are recorded", func() {
 				time.Sleep(10 * time.Millisecond)
@@ -232,7 +236,7 @@ func TestCloseCircuitAfterSuccess(t *testing.T) {
 				return nil
 			}, nil)
 
-			So(<-errChan, ShouldResemble, ErrCircuitOpen)
+			So(errors.Is(<-errChan, ErrCircuitOpen), ShouldBeTrue)
 		})
 
 		Convey("and a successful command is run after the sleep window", func() {
@@ -256,7 +260,7 @@ func TestCloseCircuitAfterSuccess(t *testing.T) {
 func TestFailAfterTimeout(t *testing.T) {
 	Convey("when a slow command fails after the timeout fires", t, func() {
 		defer circuit.Flush()
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 10})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(10)})
 
 		out := make(chan struct{}, 2)
 		errChan := GoC(context.Background(), "", func(ctx context.Context) error {
@@ -284,7 +288,7 @@ func TestSlowFallbackOpenCircuit(t *testing.T) {
 	Convey("with an open circuit and a slow fallback", t, func() {
 		defer circuit.Flush()
 
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 10})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(10)})
 
 		cb, _, err := circuit.GetCircuitBreaker("")
 		So(err, ShouldEqual, nil)
@@ -318,7 +322,7 @@ func TestSlowFallbackOpenCircuit(t *testing.T) {
 func TestFallbackAfterRejected(t *testing.T) {
 	Convey("with a circuit whose pool is full", t, func() {
 		defer circuit.Flush()
-		config.ConfigureCommand("", config.CommandConfig{MaxConcurrentRequests: 1})
+		config.ConfigureCommand("", config.CommandConfig{MaxConcurrentRequests: config.Int(1)})
 		cb, _, err := circuit.GetCircuitBreaker("")
 		if err != nil {
 			t.Fatal(err)
@@ -349,14 +353,14 @@ func TestFallbackAfterRejected(t *testing.T) {
 func TestReturnTicket_QuickCheck(t *testing.T) {
 	compareTicket := func() bool {
 		defer circuit.Flush()
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 2})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(2)})
 		errChan := GoC(context.Background(), "", func(ctx context.Context) error {
 			c := make(chan struct{})
 			<-c // should block
 			return nil
 		}, nil)
 		err := <-errChan
-		So(err, ShouldResemble, ErrTimeout)
+		So(errors.Is(err, ErrTimeout), ShouldBeTrue)
 		cb, _, err := circuit.GetCircuitBreaker("")
 		So(err, ShouldBeNil)
 		return cb.ExecutorPool.ActiveCount() == 0
@@ -374,7 +378,7 @@ func TestReturnTicket(t *testing.T) {
 	Convey("with a run command that doesn't return", t, func() {
 		defer circuit.Flush()
 
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 10})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(10)})
 
 		errChan := GoC(context.Background(), "", func(ctx context.Context) error {
 			c := make(chan struct{})
@@ -384,7 +388,7 @@ func TestReturnTicket(t *testing.T) {
 
 		Convey("after GoC(context.Background(), ), the ticket returns to the pool after the timeout", func() {
 			err := <-errChan
-			So(err, ShouldResemble, ErrTimeout)
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
 
 			cb, _, err := circuit.GetCircuitBreaker("")
 			So(err, ShouldBeNil)
@@ -397,7 +401,7 @@ func TestContextHandling(t *testing.T) {
 	Convey("with a run command which times out", t, func() {
 		defer circuit.Flush()
 
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 15})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(15)})
 		cb, _, err := circuit.GetCircuitBreaker("")
 		if err != nil {
 			t.Fatal(err)
@@ -558,7 +562,7 @@ func TestDoC(t *testing.T) {
 	Convey("with a command which times out", t, func() {
 		defer circuit.Flush()
 
-		config.ConfigureCommand("", config.CommandConfig{Timeout: 10})
+		config.ConfigureCommand("", config.CommandConfig{Timeout: config.Int(10)})
 
 		err := DoC(context.Background(), "", func(ctx context.Context) error {
 			time.Sleep(100 * time.Millisecond)
@@ -570,3 +574,313 @@ func TestDoC(t *testing.T) {
 		})
 	})
 }
+
+func TestQueuedCommand(t *testing.T) {
+	Convey("if a command has max concurrency set to 1 and queues 1 caller", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("queued", config.CommandConfig{MaxConcurrentRequests: config.Int(1), QueueSize: config.Int(1), QueueTimeout: config.Int(500)})
+
+		run := func(ctx context.Context) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		}
+
+		Convey("and 3 of those commands try to execute at the same time", func() {
+			errs := make(chan error, 3)
+			for i := 0; i < 3; i++ {
+				go func() { errs <- DoC(context.Background(), "queued", run, nil) }()
+			}
+
+			var good, bad int
+			for i := 0; i < 3; i++ {
+				if err := <-errs; errors.Is(err, ErrMaxConcurrency) {
+					bad++
+				} else if err == nil {
+					good++
+				}
+			}
+
+			Convey("the queued one waits for a ticket and only one is rejected", func() {
+				So(good, ShouldEqual, 2)
+				So(bad, ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("with a command queued for longer than its timeout on an exhausted pool", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("queued_timeout", config.CommandConfig{Timeout: config.Int(20), MaxConcurrentRequests: config.Int(1), QueueSize: config.Int(1), QueueTimeout: config.Int(1000)})
+		defer config.ConfigureCommand("queued_timeout", config.CommandConfig{})
+		cb, _, _ := circuit.GetCircuitBreaker("queued_timeout")
+		pool := cb.Pool()
+
+		var ran int32
+		run := func(ctx context.Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}
+
+		Convey("it should always time out", func() {
+			ticket := pool.AcquireTicket(context.Background())
+			defer pool.ReturnTicket(ticket)
+			for i := 0; i < 10; i++ {
+				So(errors.Is(DoC(context.Background(), "queued_timeout", run, nil), ErrTimeout), ShouldBeTrue)
+			}
+			So(atomic.LoadInt32(&ran), ShouldEqual, 0)
+		})
+
+		Convey("a ticket coming as it times out should not run it", func() {
+			for i := 0; i < 10; i++ {
+				atomic.StoreInt32(&ran, 0)
+				ticket := pool.AcquireTicket(context.Background())
+				time.AfterFunc(20*time.Millisecond, func() { pool.ReturnTicket(ticket) })
+
+				err := DoC(context.Background(), "queued_timeout", run, nil)
+				time.Sleep(10 * time.Millisecond)
+				if err != nil {
+					So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+					So(atomic.LoadInt32(&ran), ShouldEqual, 0)
+				}
+			}
+			So(pool.ActiveCount(), ShouldEqual, 0)
+		})
+	})
+}
+
+type testLogEntry struct {
+	level string
+	msg   string
+}
+
+type testLogger struct {
+	sync.Mutex
+	entries []testLogEntry
+}
+
+func (l *testLogger) log(level, msg string) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, testLogEntry{level, msg})
+}
+
+func (l *testLogger) Debug(msg string, keysAndValues ...interface{}) { l.log("debug", msg) }
+func (l *testLogger) Info(msg string, keysAndValues ...interface{})  { l.log("info", msg) }
+func (l *testLogger) Warn(msg string, keysAndValues ...interface{})  { l.log("warn", msg) }
+func (l *testLogger) Error(msg string, keysAndValues ...interface{}) { l.log("error", msg) }
+
+func (l *testLogger) Entries() []testLogEntry {
+	l.Lock()
+	defer l.Unlock()
+	return append([]testLogEntry(nil), l.entries...)
+}
+
+func TestCommandLogger(t *testing.T) {
+	Convey("with a command which has its own logger", t, func() {
+		defer circuit.Flush()
+		logger := &testLogger{}
+		config.ConfigureCommand("logged", config.CommandConfig{Logger: logger})
+		defer config.ConfigureCommand("logged", config.CommandConfig{})
+
+		Convey("a successful run logs nothing", func() {
+			So(DoC(context.Background(), "logged", func(ctx context.Context) error {
+				return nil
+			}, nil), ShouldBeNil)
+			So(logger.Entries(), ShouldBeEmpty)
+		})
+
+		Convey("a failed run is logged at debug level", func() {
+			err := <-GoC(context.Background(), "logged", func(ctx context.Context) error {
+				return fmt.Errorf("error")
+			}, nil)
+			So(err, ShouldNotBeNil)
+			So(logger.Entries(), ShouldContain, testLogEntry{"debug", "run failed"})
+		})
+	})
+}
+
+func TestErrorsIsAs(t *testing.T) {
+	failingFallback := func(ctx context.Context, err error) error {
+		return fmt.Errorf("fallback failed")
+	}
+
+	Convey("with a command which times out and whose fallback fails", t, func() {
+		defer circuit.Flush()
+		config.ConfigureCommand("errors", config.CommandConfig{Timeout: config.Int(10)})
+		defer config.ConfigureCommand("errors", config.CommandConfig{})
+
+		err := <-GoC(context.Background(), "errors", func(ctx context.Context) error {
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		}, failingFallback)
+
+		Convey("the error is still a timeout", func() {
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeFalse)
+		})
+
+		Convey("the error tells the circuit, the event and both errors apart", func() {
+			var circuitErr *CircuitError
+			So(errors.As(err, &circuitErr), ShouldBeTrue)
+			So(circuitErr.Name, ShouldEqual, "errors")
+			So(circuitErr.Event, ShouldEqual, metrics.EventTimeout)
+			So(circuitErr.RunErr, ShouldEqual, ErrTimeout)
+			So(circuitErr.FallbackErr.Error(), ShouldEqual, "fallback failed")
+		})
+	})
+
+	Convey("with a command whose run and fallback fail", t, func() {
+		defer circuit.Flush()
+		runErr := &testRunError{}
+
+		err := DoC(context.Background(), "errors", func(ctx context.Context) error {
+			return runErr
+		}, failingFallback)
+
+		Convey("errors.As finds the run error", func() {
+			var target *testRunError
+			So(errors.As(err, &target), ShouldBeTrue)
+			So(target, ShouldEqual, runErr)
+		})
+	})
+
+	Convey("with commands without fallback", t, func() {
+		defer circuit.Flush()
+		defer config.ConfigureCommand("errors_unhandled", config.CommandConfig{})
+		config.ConfigureCommand("errors_unhandled", config.CommandConfig{Timeout: config.Int(10)})
+		runErr := &testRunError{}
+
+		Convey("a failed run should return a CircuitError naming the circuit and holding the run error", func() {
+			err := DoC(context.Background(), "errors_unhandled", func(ctx context.Context) error {
+				return runErr
+			}, nil)
+
+			var circuitErr *CircuitError
+			So(errors.As(err, &circuitErr), ShouldBeTrue)
+			So(circuitErr.Name, ShouldEqual, "errors_unhandled")
+			So(circuitErr.Event, ShouldEqual, metrics.EventFailure)
+			So(circuitErr.RunErr, ShouldEqual, runErr)
+			So(circuitErr.FallbackErr, ShouldBeNil)
+			So(err.Error(), ShouldEqual, runErr.Error())
+		})
+
+		Convey("a timeout should return a CircuitError naming the circuit", func() {
+			err := DoC(context.Background(), "errors_unhandled", func(ctx context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				return nil
+			}, nil)
+
+			var circuitErr *CircuitError
+			So(errors.As(err, &circuitErr), ShouldBeTrue)
+			So(circuitErr.Name, ShouldEqual, "errors_unhandled")
+			So(circuitErr.Event, ShouldEqual, metrics.EventTimeout)
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+		})
+	})
+
+	Convey("with a command on a forced open circuit whose fallback fails", t, func() {
+		defer circuit.Flush()
+		cb, _, _ := circuit.GetCircuitBreaker("errors")
+		cb.SwitchForceOpen(true)
+
+		err := DoC(context.Background(), "errors", func(ctx context.Context) error {
+			return nil
+		}, failingFallback)
+
+		Convey("the error is a short-circuit", func() {
+			So(errors.Is(err, ErrCircuitOpen), ShouldBeTrue)
+		})
+	})
+}
+
+type testRunError struct{}
+
+func (e *testRunError) Error() string { return "run failed" }
+
+func TestReconfigureCommand(t *testing.T) {
+	Convey("with a circuit which already ran a command", t, func() {
+		defer circuit.Flush()
+		defer config.ConfigureCommand("reconfigured", config.CommandConfig{})
+		config.ConfigureCommand("reconfigured", config.CommandConfig{Timeout: config.Int(1000), MaxConcurrentRequests: config.Int(1)})
+		So(Do("reconfigured", func() error { return nil }, nil), ShouldBeNil)
+		time.Sleep(10 * time.Millisecond) // let the ticket be returned
+
+		Convey("a new timeout should apply to the next command", func() {
+			config.ConfigureCommand("reconfigured", config.CommandConfig{Timeout: config.Int(10), MaxConcurrentRequests: config.Int(1)})
+			err := Do("reconfigured", func() error {
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			}, nil)
+			So(errors.Is(err, ErrTimeout), ShouldBeTrue)
+		})
+
+		Convey("a larger pool should admit more commands at once", func() {
+			config.ConfigureCommand("reconfigured", config.CommandConfig{Timeout: config.Int(1000), MaxConcurrentRequests: config.Int(2)})
+			release := make(chan struct{})
+			run := func() error {
+				<-release
+				return nil
+			}
+			errs := make(chan error, 2)
+			for i := 0; i < 2; i++ {
+				go func() { errs <- Do("reconfigured", run, nil) }()
+			}
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+
+			So(<-errs, ShouldBeNil)
+			So(<-errs, ShouldBeNil)
+		})
+	})
+}
+
+func TestRateLimited(t *testing.T) {
+	Convey("with a circuit letting 2 commands start per minute", t, func() {
+		defer circuit.Flush()
+		defer config.ConfigureCommand("rate_limited", config.CommandConfig{})
+		config.ConfigureCommand("rate_limited", config.CommandConfig{
+			RateLimiter:     circuit.RateLimiterSlidingWindow,
+			RateLimit:       config.Int(2),
+			RateLimitWindow: config.Int(60000),
+		})
+		run := func() error { return nil }
+		So(Do("rate_limited", run, nil), ShouldBeNil)
+		So(Do("rate_limited", run, nil), ShouldBeNil)
+
+		Convey("the next command should be rejected without running", func() {
+			ran := false
+			err := Do("rate_limited", func() error {
+				ran = true
+				return nil
+			}, nil)
+			So(errors.Is(err, ErrRateLimited), ShouldBeTrue)
+			So(ran, ShouldBeFalse)
+
+			Convey("and counted apart from the other rejections, not as an error", func() {
+				time.Sleep(100 * time.Millisecond)
+				cb, _, _ := circuit.GetCircuitBreaker("rate_limited")
+				So(cb.Metrics.DefaultCollector().RateLimited().Sum(time.Now()), ShouldEqual, 1)
+				So(cb.Metrics.DefaultCollector().Rejects().Sum(time.Now()), ShouldEqual, 0)
+				So(cb.Metrics.DefaultCollector().Errors().Sum(time.Now()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("the fallback should receive ErrRateLimited", func() {
+			var fallbackErr error
+			err := Do("rate_limited", run, func(err error) error {
+				fallbackErr = err
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(fallbackErr, ShouldEqual, ErrRateLimited)
+		})
+
+		Convey("raising the limit should let more commands start", func() {
+			config.ConfigureCommand("rate_limited", config.CommandConfig{
+				RateLimiter:     circuit.RateLimiterSlidingWindow,
+				RateLimit:       config.Int(3),
+				RateLimitWindow: config.Int(60000),
+			})
+			So(Do("rate_limited", run, nil), ShouldBeNil)
+		})
+	})
+}
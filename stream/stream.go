@@ -0,0 +1,359 @@
+// Package stream publishes circuit metrics as Server-Sent Events in the format
+// understood by the Hystrix dashboard and Turbine.
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/xiaoyisha/Perseus/circuit"
+	"github.com/xiaoyisha/Perseus/config"
+	"github.com/xiaoyisha/Perseus/rolling"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const streamEventBufferSize = 10
+
+// StreamHandler is an http.Handler which streams the metrics of every circuit and executor pool
+// to its clients. A HystrixCommand event is sent per circuit and a HystrixThreadPool event per
+// executor pool every Interval.
+type StreamHandler struct {
+	Interval time.Duration
+
+	requests map[*http.Request]chan []byte
+	mu       sync.RWMutex
+	done     chan struct{}
+	started  bool
+}
+
+// NewStreamHandler returns a handler for the Hystrix dashboard event stream.
+// Clients may connect before Start is called; they receive events once the handler is started.
+func NewStreamHandler() *StreamHandler {
+	return &StreamHandler{
+		Interval: time.Second,
+		requests: make(map[*http.Request]chan []byte),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start begins watching the in-memory circuit breakers for metrics. Starting a handler which is
+// already started does nothing.
+func (sh *StreamHandler) Start() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.started {
+		return
+	}
+	select {
+	case <-sh.done:
+		// restarting a stopped handler
+		sh.done = make(chan struct{})
+	default:
+	}
+	sh.started = true
+
+	go sh.loop(sh.done)
+}
+
+// Stop shuts down the metric collection routine and disconnects the clients. Stopping a handler
+// twice does nothing.
+func (sh *StreamHandler) Stop() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.done == nil {
+		return
+	}
+	select {
+	case <-sh.done:
+		// already stopped
+	default:
+		close(sh.done)
+	}
+	sh.started = false
+}
+
+func (sh *StreamHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	events, done := sh.register(req)
+	defer sh.unregister(req)
+
+	rw.Header().Add("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-done:
+			return
+		case event := <-events:
+			_, err := rw.Write(event)
+			if err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
+
+func (sh *StreamHandler) loop(done chan struct{}) {
+	tick := time.NewTicker(sh.Interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			for _, cb := range circuit.GetCircuitBreakerMap() {
+				sh.publishMetrics(cb)
+			}
+			for _, pool := range circuit.GetExecutorPoolMap() {
+				sh.publishThreadPools(pool)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (sh *StreamHandler) publishMetrics(cb *circuit.CircuitBreaker) {
+	now := time.Now()
+	pool := cb.Pool()
+	reqCount := cb.Metrics.Requests().Sum(now)
+	errCount := cb.Metrics.DefaultCollector().Errors().Sum(now)
+	errPct := cb.Metrics.ErrorPercent(now)
+	cfg := config.GetCircuitConfig(cb.Name)
+	// unlike IsOpen, State does not run the trip strategy, which may open the circuit
+	isOpen := cb.State() != circuit.StateClosed
+
+	eventBytes, err := json.Marshal(&streamCmdMetric{
+		Type:           "HystrixCommand",
+		Name:           cb.Name,
+		Group:          cb.Name,
+		Time:           currentTime(),
+		ReportingHosts: 1,
+
+		RequestCount:       uint32(reqCount),
+		ErrorCount:         uint32(errCount),
+		ErrorPct:           uint32(errPct),
+		CircuitBreakerOpen: isOpen,
+
+		RollingCountSuccess:            uint32(cb.Metrics.DefaultCollector().Successes().Sum(now)),
+		RollingCountFailure:            uint32(cb.Metrics.DefaultCollector().Failures().Sum(now)),
+		RollingCountThreadPoolRejected: uint32(cb.Metrics.DefaultCollector().Rejects().Sum(now)),
+		RollingCountShortCircuited:     uint32(cb.Metrics.DefaultCollector().ShortCircuits().Sum(now)),
+		RollingCountTimeout:            uint32(cb.Metrics.DefaultCollector().Timeouts().Sum(now)),
+		RollingCountFallbackSuccess:    uint32(cb.Metrics.DefaultCollector().FallbackSuccesses().Sum(now)),
+		RollingCountFallbackFailure:    uint32(cb.Metrics.DefaultCollector().FallbackFailures().Sum(now)),
+
+		LatencyTotal:       generateLatencyTimings(cb.Metrics.DefaultCollector().TotalDuration()),
+		LatencyTotalMean:   cb.Metrics.DefaultCollector().TotalDuration().Mean(),
+		LatencyExecute:     generateLatencyTimings(cb.Metrics.DefaultCollector().RunDuration()),
+		LatencyExecuteMean: cb.Metrics.DefaultCollector().RunDuration().Mean(),
+
+		CurrentConcurrentExecutionCount: uint32(pool.ActiveCount()),
+
+		RollingStatsWindowInMilliseconds:        uint32(cb.Metrics.Requests().Window() / time.Millisecond),
+		ExecutionIsolationStrategy:              "THREAD",
+		ExecutionIsolationThreadPoolKeyOverride: pool.Name,
+
+		CircuitBreakerEnabled:                         true,
+		CircuitBreakerForceClosed:                     false,
+		CircuitBreakerForceOpen:                       cb.IsForceOpen(),
+		CircuitBreakerErrorThresholdPercentage:        uint32(cfg.ErrorPercentThreshold),
+		CircuitBreakerSleepWindowInMilliseconds:       uint32(cfg.SleepWindow.Nanoseconds() / 1000000),
+		CircuitBreakerRequestVolumeThreshold:          uint32(cfg.RequestVolumeThreshold),
+		ExecutionIsolationThreadTimeoutInMilliseconds: uint32(cfg.Timeout.Nanoseconds() / 1000000),
+	})
+	if err != nil {
+		return
+	}
+	sh.writeToRequests(eventBytes)
+}
+
+func (sh *StreamHandler) publishThreadPools(pool *circuit.ExecutorPool) {
+	now := time.Now()
+	size := uint32(pool.Size())
+
+	pool.Metrics.Mutex.RLock()
+	executed := pool.Metrics.Executed.Sum(now)
+	maxActive := pool.Metrics.MaxActiveRequests.Max(now)
+	window := pool.Metrics.Executed.Window()
+	pool.Metrics.Mutex.RUnlock()
+
+	eventBytes, err := json.Marshal(&streamThreadPoolMetric{
+		Type:           "HystrixThreadPool",
+		Name:           pool.Name,
+		ReportingHosts: 1,
+
+		CurrentActiveCount:        uint32(pool.ActiveCount()),
+		CurrentTaskCount:          0,
+		CurrentCompletedTaskCount: 0,
+
+		RollingCountThreadsExecuted: uint32(executed),
+		RollingMaxActiveThreads:     uint32(maxActive),
+
+		CurrentPoolSize:        uint32(pool.Metrics.ConcurrencyLimit()),
+		CurrentCorePoolSize:    uint32(pool.Metrics.ConcurrencyLimit()),
+		CurrentLargestPoolSize: size,
+		CurrentMaximumPoolSize: size,
+		CurrentQueueSize:       uint32(pool.QueuedCount()),
+
+		RollingStatsWindowInMilliseconds: uint32(window / time.Millisecond),
+		QueueSizeRejectionThreshold:      uint32(pool.QueueLimit()),
+	})
+	if err != nil {
+		return
+	}
+	sh.writeToRequests(eventBytes)
+}
+
+func (sh *StreamHandler) writeToRequests(eventBytes []byte) {
+	var b bytes.Buffer
+	b.Write([]byte("data:"))
+	b.Write(eventBytes)
+	b.Write([]byte("\n\n"))
+	dataBytes := b.Bytes()
+
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	for _, requestEvents := range sh.requests {
+		select {
+		case requestEvents <- dataBytes:
+		default:
+			// a slow client misses events rather than holding up the others
+		}
+	}
+}
+
+// register adds a client, and returns the channel of its events along with the channel closed
+// once the handler stops.
+func (sh *StreamHandler) register(req *http.Request) (<-chan []byte, <-chan struct{}) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	events := make(chan []byte, streamEventBufferSize)
+	sh.requests[req] = events
+
+	return events, sh.done
+}
+
+func (sh *StreamHandler) unregister(req *http.Request) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	delete(sh.requests, req)
+}
+
+func generateLatencyTimings(r *rolling.Timing) streamCmdLatency {
+	return streamCmdLatency{
+		Timing0:   r.Percentile(0),
+		Timing25:  r.Percentile(25),
+		Timing50:  r.Percentile(50),
+		Timing75:  r.Percentile(75),
+		Timing90:  r.Percentile(90),
+		Timing95:  r.Percentile(95),
+		Timing99:  r.Percentile(99),
+		Timing995: r.Percentile(99.5),
+		Timing100: r.Percentile(100),
+	}
+}
+
+func currentTime() int64 {
+	return time.Now().UnixNano() / int64(1000000)
+}
+
+type streamCmdMetric struct {
+	Type           string `json:"type"`
+	Name           string `json:"name"`
+	Group          string `json:"group"`
+	Time           int64  `json:"currentTime"`
+	ReportingHosts uint32 `json:"reportingHosts"`
+
+	// Health
+	RequestCount       uint32 `json:"requestCount"`
+	ErrorCount         uint32 `json:"errorCount"`
+	ErrorPct           uint32 `json:"errorPercentage"`
+	CircuitBreakerOpen bool   `json:"isCircuitBreakerOpen"`
+
+	RollingCountCollapsedRequests  uint32 `json:"rollingCountCollapsedRequests"`
+	RollingCountExceptionsThrown   uint32 `json:"rollingCountExceptionsThrown"`
+	RollingCountFailure            uint32 `json:"rollingCountFailure"`
+	RollingCountFallbackFailure    uint32 `json:"rollingCountFallbackFailure"`
+	RollingCountFallbackRejection  uint32 `json:"rollingCountFallbackRejection"`
+	RollingCountFallbackSuccess    uint32 `json:"rollingCountFallbackSuccess"`
+	RollingCountResponsesFromCache uint32 `json:"rollingCountResponsesFromCache"`
+	RollingCountSemaphoreRejected  uint32 `json:"rollingCountSemaphoreRejected"`
+	RollingCountShortCircuited     uint32 `json:"rollingCountShortCircuited"`
+	RollingCountSuccess            uint32 `json:"rollingCountSuccess"`
+	RollingCountThreadPoolRejected uint32 `json:"rollingCountThreadPoolRejected"`
+	RollingCountTimeout            uint32 `json:"rollingCountTimeout"`
+
+	CurrentConcurrentExecutionCount uint32 `json:"currentConcurrentExecutionCount"`
+
+	LatencyExecuteMean uint32           `json:"latencyExecute_mean"`
+	LatencyExecute     streamCmdLatency `json:"latencyExecute"`
+	LatencyTotalMean   uint32           `json:"latencyTotal_mean"`
+	LatencyTotal       streamCmdLatency `json:"latencyTotal"`
+
+	// Properties
+	CircuitBreakerRequestVolumeThreshold             uint32 `json:"propertyValue_circuitBreakerRequestVolumeThreshold"`
+	CircuitBreakerSleepWindowInMilliseconds          uint32 `json:"propertyValue_circuitBreakerSleepWindowInMilliseconds"`
+	CircuitBreakerErrorThresholdPercentage           uint32 `json:"propertyValue_circuitBreakerErrorThresholdPercentage"`
+	CircuitBreakerForceOpen                          bool   `json:"propertyValue_circuitBreakerForceOpen"`
+	CircuitBreakerForceClosed                        bool   `json:"propertyValue_circuitBreakerForceClosed"`
+	CircuitBreakerEnabled                            bool   `json:"propertyValue_circuitBreakerEnabled"`
+	ExecutionIsolationStrategy                       string `json:"propertyValue_executionIsolationStrategy"`
+	ExecutionIsolationThreadTimeoutInMilliseconds    uint32 `json:"propertyValue_executionIsolationThreadTimeoutInMilliseconds"`
+	ExecutionIsolationThreadInterruptOnTimeout       bool   `json:"propertyValue_executionIsolationThreadInterruptOnTimeout"`
+	ExecutionIsolationThreadPoolKeyOverride          string `json:"propertyValue_executionIsolationThreadPoolKeyOverride"`
+	ExecutionIsolationSemaphoreMaxConcurrentRequests uint32 `json:"propertyValue_executionIsolationSemaphoreMaxConcurrentRequests"`
+	FallbackIsolationSemaphoreMaxConcurrentRequests  uint32 `json:"propertyValue_fallbackIsolationSemaphoreMaxConcurrentRequests"`
+	RollingStatsWindowInMilliseconds                 uint32 `json:"propertyValue_metricsRollingStatisticalWindowInMilliseconds"`
+	RequestCacheEnabled                              bool   `json:"propertyValue_requestCacheEnabled"`
+	RequestLogEnabled                                bool   `json:"propertyValue_requestLogEnabled"`
+}
+
+type streamCmdLatency struct {
+	Timing0   uint32 `json:"0"`
+	Timing25  uint32 `json:"25"`
+	Timing50  uint32 `json:"50"`
+	Timing75  uint32 `json:"75"`
+	Timing90  uint32 `json:"90"`
+	Timing95  uint32 `json:"95"`
+	Timing99  uint32 `json:"99"`
+	Timing995 uint32 `json:"99.5"`
+	Timing100 uint32 `json:"100"`
+}
+
+type streamThreadPoolMetric struct {
+	Type           string `json:"type"`
+	Name           string `json:"name"`
+	ReportingHosts uint32 `json:"reportingHosts"`
+
+	CurrentActiveCount        uint32 `json:"currentActiveCount"`
+	CurrentCompletedTaskCount uint32 `json:"currentCompletedTaskCount"`
+	CurrentCorePoolSize       uint32 `json:"currentCorePoolSize"`
+	CurrentLargestPoolSize    uint32 `json:"currentLargestPoolSize"`
+	CurrentMaximumPoolSize    uint32 `json:"currentMaximumPoolSize"`
+	CurrentPoolSize           uint32 `json:"currentPoolSize"`
+	CurrentQueueSize          uint32 `json:"currentQueueSize"`
+	CurrentTaskCount          uint32 `json:"currentTaskCount"`
+
+	RollingMaxActiveThreads     uint32 `json:"rollingMaxActiveThreads"`
+	RollingCountThreadsExecuted uint32 `json:"rollingCountThreadsExecuted"`
+
+	RollingStatsWindowInMilliseconds uint32 `json:"propertyValue_metricsRollingStatisticalWindowInMilliseconds"`
+	QueueSizeRejectionThreshold      uint32 `json:"propertyValue_queueSizeRejectionThreshold"`
+}
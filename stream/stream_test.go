@@ -0,0 +1,179 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/xiaoyisha/Perseus/circuit"
+	"github.com/xiaoyisha/Perseus/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func startTestServer() (*httptest.Server, *StreamHandler) {
+	sh := NewStreamHandler()
+	sh.Interval = 10 * time.Millisecond
+	sh.Start()
+	return httptest.NewServer(sh), sh
+}
+
+// readEvents reads events from the stream until one of each type was seen for the circuit.
+func readEvents(t *testing.T, url string, name string) (map[string]interface{}, map[string]interface{}) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var cmd, pool map[string]interface{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && (cmd == nil || pool == nil) {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		event := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event["name"] != name {
+			continue
+		}
+		switch event["type"] {
+		case "HystrixCommand":
+			cmd = event
+		case "HystrixThreadPool":
+			pool = event
+		}
+	}
+	return cmd, pool
+}
+
+func TestStreamHandler(t *testing.T) {
+	Convey("with a circuit which succeeded twice and was rejected once", t, func() {
+		defer circuit.Flush()
+		server, sh := startTestServer()
+		defer server.Close()
+		defer sh.Stop()
+
+		cb, _, _ := circuit.GetCircuitBreaker("stream")
+		cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), time.Millisecond)
+		cb.ReportEvent(metrics.Outcome{Event: metrics.EventSuccess}, time.Now(), time.Millisecond)
+		cb.ReportEvent(metrics.Outcome{Event: metrics.EventRejected}, time.Now(), 0)
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("the stream publishes its command and thread pool metrics", func() {
+			cmd, pool := readEvents(t, server.URL, "stream")
+
+			So(cmd["requestCount"], ShouldEqual, 3)
+			So(cmd["errorCount"], ShouldEqual, 1)
+			So(cmd["rollingCountSuccess"], ShouldEqual, 2)
+			So(cmd["rollingCountThreadPoolRejected"], ShouldEqual, 1)
+			So(cmd["isCircuitBreakerOpen"], ShouldEqual, false)
+			So(cmd["latencyExecute"], ShouldContainKey, "99.5")
+
+			So(pool["currentMaximumPoolSize"], ShouldEqual, cb.ExecutorPool.MaxReq)
+			So(pool["currentActiveCount"], ShouldEqual, 0)
+		})
+	})
+}
+
+func TestStreamHandlerReadOnly(t *testing.T) {
+	Convey("with a circuit whose error percent is over its threshold", t, func() {
+		defer circuit.Flush()
+		server, sh := startTestServer()
+		defer server.Close()
+		defer sh.Stop()
+
+		cb, _, _ := circuit.GetCircuitBreaker("stream_failing")
+		for i := 0; i < 30; i++ {
+			cb.ReportEvent(metrics.Outcome{Event: metrics.EventFailure}, time.Now(), time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		Convey("publishing its metrics should not open it", func() {
+			cmd, _ := readEvents(t, server.URL, "stream_failing")
+			So(cmd["isCircuitBreakerOpen"], ShouldEqual, false)
+			So(cb.State(), ShouldEqual, circuit.StateClosed)
+		})
+	})
+}
+
+func TestStreamHandlerStop(t *testing.T) {
+	Convey("stopping a handler which was never started should do nothing", t, func() {
+		So(func() { NewStreamHandler().Stop() }, ShouldNotPanic)
+	})
+
+	Convey("stopping a handler twice should do nothing", t, func() {
+		sh := NewStreamHandler()
+		sh.Start()
+		sh.Stop()
+		So(sh.Stop, ShouldNotPanic)
+	})
+}
+
+func TestStreamHandlerStartTwice(t *testing.T) {
+	Convey("with a handler started twice", t, func() {
+		defer circuit.Flush()
+		circuit.GetCircuitBreaker("stream_twice")
+		sh := NewStreamHandler()
+		sh.Interval = 50 * time.Millisecond
+		sh.Start()
+		sh.Start()
+		defer sh.Stop()
+		server := httptest.NewServer(sh)
+		defer server.Close()
+
+		Convey("its events should be published once per interval", func() {
+			resp, err := http.Get(server.URL)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+
+			events := make(chan struct{}, 100)
+			go func() {
+				scanner := bufio.NewScanner(resp.Body)
+				for scanner.Scan() {
+					line := scanner.Text()
+					if strings.HasPrefix(line, "data:") && strings.Contains(line, `"HystrixCommand"`) && strings.Contains(line, `"stream_twice"`) {
+						events <- struct{}{}
+					}
+				}
+			}()
+			time.Sleep(260 * time.Millisecond)
+			So(len(events), ShouldBeBetweenOrEqual, 3, 6)
+		})
+	})
+}
+
+func TestStreamHandlerBeforeStart(t *testing.T) {
+	Convey("with a client connected before the handler is started", t, func() {
+		defer circuit.Flush()
+		circuit.GetCircuitBreaker("stream_early")
+		sh := NewStreamHandler()
+		sh.Interval = 10 * time.Millisecond
+		server := httptest.NewServer(sh)
+		defer server.Close()
+
+		cmds := make(chan map[string]interface{}, 1)
+		go func() {
+			cmd, _ := readEvents(t, server.URL, "stream_early")
+			cmds <- cmd
+		}()
+		time.Sleep(20 * time.Millisecond)
+		sh.Start()
+		defer sh.Stop()
+
+		Convey("it should receive the events once the handler starts", func() {
+			select {
+			case cmd := <-cmds:
+				So(cmd["name"], ShouldEqual, "stream_early")
+			case <-time.After(time.Second):
+				t.Error("no event was streamed")
+			}
+		})
+	})
+}